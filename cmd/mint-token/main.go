@@ -0,0 +1,75 @@
+// Command mint-token prints a WebSocket auth token signed with the server's
+// auth.secret, read from the same config file, environment and flags as the
+// server.
+//
+//	mint-token -config config.yaml -peer headset-1 -rooms lab -roles controller
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+    "VR-Distributed/internal/auth"
+    "VR-Distributed/internal/config"
+)
+
+func main() {
+    fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+    peer := fs.String("peer", "", "peer ID the token is issued to (required)")
+    rooms := fs.String("rooms", "", "comma-separated rooms the token allows, * for any (default: the default room)")
+    roles := fs.String("roles", auth.RoleHost+","+auth.RoleController, "comma-separated roles: host, controller, spectator")
+    ttl := fs.Duration("ttl", 24*time.Hour, "how long the token is valid")
+    cfg, err := config.Load(fs, os.Args[1:])
+    if err != nil {
+        fatal("failed to load configuration: %v", err)
+    }
+
+    if cfg.Auth.Secret == "" {
+        fatal("auth.secret is not set (use -auth-secret, AUTH_SECRET or a config file)")
+    }
+    if *peer == "" {
+        fatal("-peer is required")
+    }
+    if *ttl <= 0 {
+        fatal("-ttl must be positive")
+    }
+
+    claims := auth.Claims{
+        Subject: *peer,
+        Rooms:   splitList(*rooms),
+        Roles:   splitList(*roles),
+    }
+    if len(claims.Rooms) == 0 {
+        claims.Rooms = []string{cfg.DefaultRoom}
+    }
+    for _, role := range claims.Roles {
+        if role != auth.RoleHost && role != auth.RoleController && role != auth.RoleSpectator {
+            fatal("unknown role %q", role)
+        }
+    }
+
+    now := time.Now()
+    claims.IssuedAt, claims.ExpiresAt = now.Unix(), now.Add(*ttl).Unix()
+    token, err := auth.Sign(claims, []byte(cfg.Auth.Secret))
+    if err != nil {
+        fatal("%v", err)
+    }
+    fmt.Println(token)
+}
+
+func splitList(value string) []string {
+    var items []string
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+func fatal(format string, args ...interface{}) {
+    fmt.Fprintf(os.Stderr, "mint-token: "+format+"\n", args...)
+    os.Exit(1)
+}
@@ -1,29 +1,77 @@
 package main
 
 import (
-    "log"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log/slog"
+    "os"
+    "time"
     "VR-Distributed/internal/config"
     "VR-Distributed/internal/crypto"
+    "VR-Distributed/internal/logging"
     "VR-Distributed/internal/server"
     "VR-Distributed/internal/webrtc"
 )
 
 func main() {
-    // Load configuration
-    cfg := config.Load()
-    
+    // Load configuration: defaults < config file < env < flags
+    fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+    printConfig := fs.Bool("print-config", false, "print the effective configuration as JSON and exit")
+    cfg, err := config.Load(fs, os.Args[1:])
+    if err != nil {
+        fatal("Failed to load configuration", err)
+    }
+
+    if *printConfig {
+        out, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+        if err != nil {
+            fatal("Failed to encode configuration", err)
+        }
+        fmt.Println(string(out))
+        if err := cfg.Validate(); err != nil {
+            fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    if err := cfg.Validate(); err != nil {
+        fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+        os.Exit(1)
+    }
+    config.Store(cfg)
+
+    if err := logging.Setup(cfg.Log.Level, cfg.Log.Format); err != nil {
+        fatal("Failed to set up logging", err)
+    }
+
     // Initialize crypto
     if err := crypto.InitializeRSA(); err != nil {
-        log.Fatal("Failed to initialize RSA keys:", err)
+        fatal("Failed to initialize RSA keys", err)
+    }
+    security := cfg.Security
+    if err := crypto.LoadIdentity(security.IdentityKeyDir, time.Duration(security.IdentityRotation), time.Duration(security.IdentityOverlap)); err != nil {
+        fatal("Failed to load identity keys", err)
     }
-    
+    for _, key := range crypto.IdentityKeys() {
+        slog.Info("Server identity key", "key_id", key.ID, "sha256", key.Fingerprint, "created_at", key.CreatedAt)
+    }
+
     // Initialize WebRTC
     if err := webrtc.Initialize(); err != nil {
-        log.Fatal("Failed to initialize WebRTC:", err)
+        fatal("Failed to initialize WebRTC", err)
     }
-    
+
     // Start server
     srv := server.New(cfg)
-    log.Printf("WebRTC Media Server started on %s", cfg.ServerAddress)
-    log.Fatal(srv.Start())
-}
\ No newline at end of file
+    slog.Info("WebRTC Media Server started", "addr", cfg.ServerAddress)
+    if err := srv.Start(); err != nil {
+        fatal("Server stopped", err)
+    }
+}
+
+func fatal(msg string, err error) {
+    slog.Error(msg, "error", err)
+    os.Exit(1)
+}
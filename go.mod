@@ -7,7 +7,12 @@ require (
 	github.com/pion/webrtc/v3 v3.2.24
 )
 
-require github.com/edsrzf/mmap-go v1.2.0
+require (
+	github.com/edsrzf/mmap-go v1.2.0
+	golang.org/x/crypto v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -29,9 +34,6 @@ require (
 	github.com/pion/turn/v2 v2.1.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.8.4 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32 // indirect
 )
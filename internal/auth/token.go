@@ -0,0 +1,124 @@
+// Package auth signs and verifies the HMAC tokens clients present when they
+// open a WebSocket. Tokens are JWTs signed with HS256 and a secret shared by
+// the server and whoever mints them, so they are verified without any
+// external service.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Roles a token can grant.
+const (
+	RoleHost       = "host"       // may start and stop the VR process
+	RoleController = "controller" // may send gyro, hand and playback controls
+	RoleSpectator  = "spectator"  // may only watch
+)
+
+// AnyRoom in a token's rooms allows every room.
+const AnyRoom = "*"
+
+var (
+	ErrMalformed   = errors.New("malformed token")
+	ErrSignature   = errors.New("invalid token signature")
+	ErrExpired     = errors.New("token expired")
+	ErrNotYetValid = errors.New("token not yet valid")
+)
+
+// clockSkew is how far ahead of the server's clock a token's iat or nbf may
+// be, since it may have been minted on another machine.
+const clockSkew = time.Minute
+
+// Claims is the payload of a token.
+type Claims struct {
+	Subject   string   `json:"sub"` // peer ID
+	Rooms     []string `json:"rooms"`
+	Roles     []string `json:"roles"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// AllowsRoom reports whether the token grants access to room.
+func (c *Claims) AllowsRoom(room string) bool {
+	return slices.Contains(c.Rooms, AnyRoom) || slices.Contains(c.Rooms, room)
+}
+
+// HasRole reports whether the token grants role.
+func (c *Claims) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
+}
+
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign returns claims as a token signed with secret.
+func Sign(claims Claims, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode claims: %w", err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac(signed, secret)), nil
+}
+
+// Verify checks the token's signature against secret and its validity
+// period against now, and returns its claims.
+func Verify(token string, secret []byte, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var head struct {
+		Alg string `json:"alg"`
+	}
+	headJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headJSON, &head) != nil {
+		return nil, ErrMalformed
+	}
+	// Only HS256 is accepted, whatever the header claims
+	if head.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrMalformed, head.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal(signature, mac(parts[0]+"."+parts[1], secret)) {
+		return nil, ErrSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrMalformed)
+	}
+	if claims.ExpiresAt == 0 || !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrExpired
+	}
+	if latest := now.Add(clockSkew); time.Unix(claims.IssuedAt, 0).After(latest) || time.Unix(claims.NotBefore, 0).After(latest) {
+		return nil, ErrNotYetValid
+	}
+	return &claims, nil
+}
+
+func mac(signed string, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(signed))
+	return h.Sum(nil)
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testNow    = time.Unix(1_700_000_000, 0)
+)
+
+func validClaims() Claims {
+	return Claims{
+		Subject:   "headset-1",
+		Rooms:     []string{"lab"},
+		Roles:     []string{RoleController},
+		IssuedAt:  testNow.Add(-time.Minute).Unix(),
+		ExpiresAt: testNow.Add(time.Hour).Unix(),
+	}
+}
+
+// rawToken builds a token from a literal header and claims, signed with
+// secret unless sign is false, in which case the signature is empty.
+func rawToken(t *testing.T, headerJSON string, claims Claims, secret []byte, sign bool) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(headerJSON)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	if !sign {
+		return signed + "."
+	}
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func signed(t *testing.T, claims Claims) string {
+	t.Helper()
+	token, err := Sign(claims, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		wantErr error
+	}{
+		{
+			name:  "valid",
+			token: func(t *testing.T) string { return signed(t, validClaims()) },
+		},
+		{
+			name: "alg none",
+			token: func(t *testing.T) string {
+				return rawToken(t, `{"alg":"none","typ":"JWT"}`, validClaims(), nil, false)
+			},
+			wantErr: ErrMalformed,
+		},
+		{
+			name: "alg none with a signature",
+			token: func(t *testing.T) string {
+				return rawToken(t, `{"alg":"none","typ":"JWT"}`, validClaims(), testSecret, true)
+			},
+			wantErr: ErrMalformed,
+		},
+		{
+			name: "alg HS512",
+			token: func(t *testing.T) string {
+				return rawToken(t, `{"alg":"HS512","typ":"JWT"}`, validClaims(), testSecret, true)
+			},
+			wantErr: ErrMalformed,
+		},
+		{
+			name: "alg RS256",
+			token: func(t *testing.T) string {
+				return rawToken(t, `{"alg":"RS256","typ":"JWT"}`, validClaims(), testSecret, true)
+			},
+			wantErr: ErrMalformed,
+		},
+		{
+			name: "alg missing",
+			token: func(t *testing.T) string {
+				return rawToken(t, `{"typ":"JWT"}`, validClaims(), testSecret, true)
+			},
+			wantErr: ErrMalformed,
+		},
+		{
+			name: "wrong secret",
+			token: func(t *testing.T) string {
+				return rawToken(t, `{"alg":"HS256","typ":"JWT"}`, validClaims(), []byte("another secret, just as long....."), true)
+			},
+			wantErr: ErrSignature,
+		},
+		{
+			name: "payload changed after signing",
+			token: func(t *testing.T) string {
+				parts := strings.Split(signed(t, validClaims()), ".")
+				claims := validClaims()
+				claims.Roles = []string{RoleHost}
+				payload, _ := json.Marshal(claims)
+				parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+				return strings.Join(parts, ".")
+			},
+			wantErr: ErrSignature,
+		},
+		{
+			name: "unsigned",
+			token: func(t *testing.T) string {
+				return rawToken(t, `{"alg":"HS256","typ":"JWT"}`, validClaims(), nil, false)
+			},
+			wantErr: ErrSignature,
+		},
+		{
+			name: "expired",
+			token: func(t *testing.T) string {
+				claims := validClaims()
+				claims.ExpiresAt = testNow.Add(-time.Second).Unix()
+				return signed(t, claims)
+			},
+			wantErr: ErrExpired,
+		},
+		{
+			name: "expires now",
+			token: func(t *testing.T) string {
+				claims := validClaims()
+				claims.ExpiresAt = testNow.Unix()
+				return signed(t, claims)
+			},
+			wantErr: ErrExpired,
+		},
+		{
+			name: "no expiry",
+			token: func(t *testing.T) string {
+				claims := validClaims()
+				claims.ExpiresAt = 0
+				return signed(t, claims)
+			},
+			wantErr: ErrExpired,
+		},
+		{
+			name: "issued in the future",
+			token: func(t *testing.T) string {
+				claims := validClaims()
+				claims.IssuedAt = testNow.Add(time.Hour).Unix()
+				return signed(t, claims)
+			},
+			wantErr: ErrNotYetValid,
+		},
+		{
+			name: "not before in the future",
+			token: func(t *testing.T) string {
+				claims := validClaims()
+				claims.NotBefore = testNow.Add(10 * time.Minute).Unix()
+				return signed(t, claims)
+			},
+			wantErr: ErrNotYetValid,
+		},
+		{
+			name: "not before within clock skew",
+			token: func(t *testing.T) string {
+				claims := validClaims()
+				claims.NotBefore = testNow.Add(30 * time.Second).Unix()
+				return signed(t, claims)
+			},
+		},
+		{
+			name: "missing subject",
+			token: func(t *testing.T) string {
+				claims := validClaims()
+				claims.Subject = ""
+				return signed(t, claims)
+			},
+			wantErr: ErrMalformed,
+		},
+		{
+			name:    "two parts",
+			token:   func(t *testing.T) string { return "a.b" },
+			wantErr: ErrMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := Verify(tt.token(t), testSecret, testNow)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Verify error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if claims.Subject != "headset-1" {
+				t.Fatalf("Subject = %q, want headset-1", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestRoleClaims(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles []string
+		want  map[string]bool
+	}{
+		{
+			name:  "none",
+			roles: nil,
+			want:  map[string]bool{RoleHost: false, RoleController: false, RoleSpectator: false},
+		},
+		{
+			name:  "spectator",
+			roles: []string{RoleSpectator},
+			want:  map[string]bool{RoleHost: false, RoleController: false, RoleSpectator: true},
+		},
+		{
+			name:  "controller",
+			roles: []string{RoleController},
+			want:  map[string]bool{RoleHost: false, RoleController: true, RoleSpectator: false},
+		},
+		{
+			name:  "host and controller",
+			roles: []string{RoleHost, RoleController},
+			want:  map[string]bool{RoleHost: true, RoleController: true, RoleSpectator: false},
+		},
+		{
+			name:  "unknown role grants nothing",
+			roles: []string{"admin"},
+			want:  map[string]bool{RoleHost: false, RoleController: false, RoleSpectator: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued := validClaims()
+			issued.Roles = tt.roles
+			claims, err := Verify(signed(t, issued), testSecret, testNow)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if !slices.Equal(claims.Roles, tt.roles) {
+				t.Fatalf("Roles = %v, want %v", claims.Roles, tt.roles)
+			}
+			for role, want := range tt.want {
+				if got := claims.HasRole(role); got != want {
+					t.Errorf("HasRole(%q) = %v, want %v", role, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowsRoom(t *testing.T) {
+	claims := validClaims()
+	if !claims.AllowsRoom("lab") || claims.AllowsRoom("other") {
+		t.Fatalf("rooms %v: AllowsRoom(lab) = %v, AllowsRoom(other) = %v", claims.Rooms, claims.AllowsRoom("lab"), claims.AllowsRoom("other"))
+	}
+	claims.Rooms = []string{AnyRoom}
+	if !claims.AllowsRoom("other") {
+		t.Fatal("AnyRoom does not allow every room")
+	}
+}
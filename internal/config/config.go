@@ -1,25 +1,827 @@
 package config
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"VR-Distributed/internal/logging"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	ServerAddress   string
-	MediaDir        string
-	StaticDir       string
-	DefaultRoom     string
-	DefaultFilePath string
+	ServerAddress   string `json:"server_address" yaml:"server_address"`
+	MediaDir        string `json:"media_dir" yaml:"media_dir"`
+	StaticDir       string `json:"static_dir" yaml:"static_dir"`
+	DefaultRoom     string `json:"default_room" yaml:"default_room"`
+	DefaultFilePath string `json:"default_file_path" yaml:"default_file_path"`
+
+	TLS       TLSConfig       `json:"tls" yaml:"tls"`
+	WebRTC    WebRTCConfig    `json:"webrtc" yaml:"webrtc"`
+	Media     MediaConfig     `json:"media" yaml:"media"`
+	WebSocket WebSocketConfig `json:"websocket" yaml:"websocket"`
+	Rooms     RoomsConfig     `json:"rooms" yaml:"rooms"`
+	Admin     AdminConfig     `json:"admin" yaml:"admin"`
+	Auth      AuthConfig      `json:"auth" yaml:"auth"`
+	RateLimit RateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+	Security  SecurityConfig  `json:"security" yaml:"security"`
+	Shutdown  ShutdownConfig  `json:"shutdown" yaml:"shutdown"`
+	Log       LogConfig       `json:"log" yaml:"log"`
+
+	// Size in bytes of the per-session shared-memory file
+	SharedMemorySize int `json:"shared_memory_size" yaml:"shared_memory_size"`
+}
+
+// TLS modes
+const (
+	TLSModeFiles      = "files"       // serve the configured cert/key, which must exist
+	TLSModeSelfSigned = "self-signed" // generate and persist a self-signed cert/key on first start
+	TLSModeDisabled   = "disabled"    // plain HTTP, for deployments behind a TLS-terminating proxy
+)
+
+type TLSConfig struct {
+	Mode     string `json:"mode" yaml:"mode"`
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+}
+
+type ICEServer struct {
+	URLs       []string `json:"urls" yaml:"urls"`
+	Username   string   `json:"username,omitempty" yaml:"username,omitempty"`
+	Credential string   `json:"credential,omitempty" yaml:"credential,omitempty"`
+}
+
+type WebRTCConfig struct {
+	ICEServers []ICEServer `json:"ice_servers" yaml:"ice_servers"`
+}
+
+// MediaConfig holds the ffmpeg and Opus encoder settings used for new streams.
+type MediaConfig struct {
+	FFmpegPath       string `json:"ffmpeg_path" yaml:"ffmpeg_path"`
+	FFprobePath      string `json:"ffprobe_path" yaml:"ffprobe_path"`
+	VideoPreset      string `json:"video_preset" yaml:"video_preset"`
+	VideoBitrate     string `json:"video_bitrate" yaml:"video_bitrate"`
+	VideoMaxRate     string `json:"video_max_rate" yaml:"video_max_rate"`
+	VideoBufSize     string `json:"video_buf_size" yaml:"video_buf_size"`
+	KeyframeInterval int    `json:"keyframe_interval" yaml:"keyframe_interval"`
+	AudioBitrate     string `json:"audio_bitrate" yaml:"audio_bitrate"`
+	OpusBitrate      int    `json:"opus_bitrate" yaml:"opus_bitrate"`
+
+	// x264 settings for media files streamed without audio, which get a
+	// higher bitrate than the video_* settings used alongside audio
+	VideoOnlyPreset  string `json:"video_only_preset" yaml:"video_only_preset"`
+	VideoOnlyBitrate string `json:"video_only_bitrate" yaml:"video_only_bitrate"`
+	VideoOnlyMaxRate string `json:"video_only_max_rate" yaml:"video_only_max_rate"`
+	VideoOnlyBufSize string `json:"video_only_buf_size" yaml:"video_only_buf_size"`
+
+	// ffmpeg input format and device used to capture the VR process audio
+	AudioCaptureFormat string `json:"audio_capture_format" yaml:"audio_capture_format"`
+	AudioCaptureDevice string `json:"audio_capture_device" yaml:"audio_capture_device"`
+}
+
+type WebSocketConfig struct {
+	ReadBufferSize  int `json:"read_buffer_size" yaml:"read_buffer_size"`
+	WriteBufferSize int `json:"write_buffer_size" yaml:"write_buffer_size"`
+
+	// Origins, such as https://vr.example.com, allowed to open a WebSocket
+	// besides the server's own, or * for any. Requests without an Origin
+	// header come from native clients and are always allowed.
+	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins"`
+
+	// Largest message in bytes accepted before the key exchange, and
+	// text (JSON) and binary (encrypted) messages afterwards. Larger ones
+	// close the connection with 1009.
+	MaxHandshakeMessage int64 `json:"max_handshake_message" yaml:"max_handshake_message"`
+	MaxTextMessage      int64 `json:"max_text_message" yaml:"max_text_message"`
+	MaxBinaryMessage    int64 `json:"max_binary_message" yaml:"max_binary_message"`
+
+	// Negotiate permessage-deflate with clients that offer it. Only
+	// plaintext frames are compressed, encrypted ones would not shrink.
+	Compression      bool `json:"compression" yaml:"compression"`
+	CompressionLevel int  `json:"compression_level" yaml:"compression_level"`
+
+	// Concurrent connections allowed from one IP address, 0 for no limit
+	MaxConnectionsPerIP int `json:"max_connections_per_ip" yaml:"max_connections_per_ip"`
+	// Addresses or CIDR ranges of reverse proxies whose X-Forwarded-For
+	// header names the client address the limit applies to
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies"`
+
+	// Messages each of a client's two send queues (signalling and status)
+	// holds before the client is disconnected as too slow
+	SendQueueSize int `json:"send_queue_size" yaml:"send_queue_size"`
+	// Deadline for writing one message to a client
+	WriteTimeout Duration `json:"write_timeout" yaml:"write_timeout"`
+
+	// Clients are pinged every PingInterval and disconnected, stopping
+	// their stream and VR process, once nothing has been read from them
+	// for IdleTimeout
+	PingInterval Duration `json:"ping_interval" yaml:"ping_interval"`
+	IdleTimeout  Duration `json:"idle_timeout" yaml:"idle_timeout"`
+
+	// A keyed client whose connection drops keeps its session, VR process
+	// and stream for ResumeGrace, and can reattach by reconnecting with its
+	// resume token; 0 ends sessions on disconnect. The last ResumeReplay
+	// encrypted messages are kept to resend those the client missed.
+	ResumeGrace  Duration `json:"resume_grace" yaml:"resume_grace"`
+	ResumeReplay int      `json:"resume_replay" yaml:"resume_replay"`
+}
+
+type RoomsConfig struct {
+	// Peers allowed in one room, 0 for no limit. A peer reconnecting under
+	// the peer ID it already has in the room does not count twice.
+	MaxPeers int `json:"max_peers" yaml:"max_peers"`
+	// How long an empty room keeps its metadata and password before it is
+	// deleted, 0 to delete it as soon as its last client leaves
+	Linger Duration `json:"linger" yaml:"linger"`
+}
+
+type AdminConfig struct {
+	// Bearer token required by the admin endpoints. When empty they only
+	// accept requests from loopback addresses.
+	Token string `json:"token,omitempty" yaml:"token,omitempty"`
+}
+
+type AuthConfig struct {
+	// HMAC secret WebSocket tokens are signed with. When empty, clients
+	// connect without a token and may use any room and peer ID.
+	Secret string `json:"secret,omitempty" yaml:"secret,omitempty"`
+}
+
+// Rate limit policies, applied to messages over the limit
+const (
+	RateLimitDrop       = "drop"       // discard the message
+	RateLimitCoalesce   = "coalesce"   // keep only the latest and handle it once allowed
+	RateLimitDisconnect = "disconnect" // close the connection
+)
+
+// RateLimit is a token bucket refilled at Rate messages per second and
+// holding up to Burst. A Rate of 0 disables it.
+type RateLimit struct {
+	Rate   float64 `json:"rate" yaml:"rate"`
+	Burst  int     `json:"burst" yaml:"burst"`
+	Policy string  `json:"policy" yaml:"policy"`
+}
+
+type RateLimitConfig struct {
+	// Every message a client sends, checked before it is decrypted
+	Client RateLimit `json:"client" yaml:"client"`
+	// Messages of one type, on top of Client
+	Types map[string]RateLimit `json:"types" yaml:"types"`
+}
+
+type SecurityConfig struct {
+	// Only accept encrypted frames for every message type except the key
+	// exchange itself, including WebRTC signalling.
+	RequireEncryption bool `json:"require_encryption" yaml:"require_encryption"`
+	// Also offer the legacy RSA PKCS#1 v1.5 key transport (aes_key_exchange)
+	// for clients that predate the ECDH handshake.
+	RSAKeyExchange bool `json:"rsa_key_exchange" yaml:"rsa_key_exchange"`
+
+	// Directory holding the persisted ECDSA identity keys that sign the
+	// init message
+	IdentityKeyDir string `json:"identity_key_dir" yaml:"identity_key_dir"`
+	// Age after which a new identity key is generated, 0 to never rotate
+	IdentityRotation Duration `json:"identity_rotation" yaml:"identity_rotation"`
+	// How long the previous identity key keeps signing after a rotation, so
+	// clients pinning it can move to the new one
+	IdentityOverlap Duration `json:"identity_overlap" yaml:"identity_overlap"`
+
+	// A new session key is negotiated after this many encrypted frames in
+	// either direction, or once the key is older than RekeyInterval. 0
+	// disables either trigger.
+	RekeyAfterMessages int      `json:"rekey_after_messages" yaml:"rekey_after_messages"`
+	RekeyInterval      Duration `json:"rekey_interval" yaml:"rekey_interval"`
+	// How long frames sealed with the previous session key are still
+	// accepted after a rekey
+	RekeyGrace Duration `json:"rekey_grace" yaml:"rekey_grace"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level" yaml:"level"`   // debug, info, warn or error
+	Format string `json:"format" yaml:"format"` // text or json
+}
+
+type ShutdownConfig struct {
+	// Deadline for draining sessions after SIGINT/SIGTERM
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// How long a VR process gets to exit on its own before it is killed
+	ProcessGrace Duration `json:"process_grace" yaml:"process_grace"`
 }
 
-func Load() *Config {
+// Duration is a time.Duration written as a string such as "10s" in config
+// files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+var current atomic.Pointer[Config]
+
+// source remembers the config file and flags the running configuration was
+// built from, so Reload can rebuild it the same way.
+var source struct {
+	mutex sync.Mutex
+	file  string
+	flags map[string]string
+}
+
+func init() {
+	current.Store(Default())
+}
+
+// Current returns the configuration the server is running with.
+func Current() *Config {
+	return current.Load()
+}
+
+// Store makes cfg the configuration returned by Current.
+func Store(cfg *Config) {
+	current.Store(cfg)
+}
+
+// Default returns the built-in configuration before any file, env or flag
+// overrides are applied.
+func Default() *Config {
 	return &Config{
-		ServerAddress:   getEnv("SERVER_ADDRESS", "0.0.0.0:8000"),
-		MediaDir:        getEnv("MEDIA_DIR", "media"),
-		StaticDir:       getEnv("STATIC_DIR", "static"),
-		DefaultRoom:     getEnv("DEFAULT_ROOM", "default"),
-		DefaultFilePath: getEnv("filePath", "execs/VRenv(raylib).exe"),
+		ServerAddress:   "0.0.0.0:8000",
+		MediaDir:        "media",
+		StaticDir:       "static",
+		DefaultRoom:     "default",
+		DefaultFilePath: "execs/VRenv(raylib).exe",
+		TLS: TLSConfig{
+			Mode:     TLSModeFiles,
+			CertFile: "cert.pem",
+			KeyFile:  "key.pem",
+		},
+		WebRTC: WebRTCConfig{
+			ICEServers: []ICEServer{
+				{URLs: []string{"stun:stun.l.google.com:19302"}},
+			},
+		},
+		Media: MediaConfig{
+			FFmpegPath:         "ffmpeg",
+			FFprobePath:        "ffprobe",
+			VideoPreset:        "ultrafast",
+			VideoBitrate:       "1M",
+			VideoMaxRate:       "1M",
+			VideoBufSize:       "2M",
+			KeyframeInterval:   30,
+			AudioBitrate:       "128k",
+			OpusBitrate:        64000,
+			VideoOnlyPreset:    "veryfast",
+			VideoOnlyBitrate:   "4M",
+			VideoOnlyMaxRate:   "8M",
+			VideoOnlyBufSize:   "10M",
+			AudioCaptureFormat: "dshow",
+			AudioCaptureDevice: "audio=CABLE Output (VB-Audio Virtual Cable)",
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+
+			MaxHandshakeMessage: 16 << 10,
+			MaxTextMessage:      64 << 10,
+			MaxBinaryMessage:    64 << 10,
+
+			CompressionLevel: 1,
+
+			MaxConnectionsPerIP: 16,
+
+			SendQueueSize: 256,
+			WriteTimeout:  Duration(10 * time.Second),
+
+			PingInterval: Duration(15 * time.Second),
+			IdleTimeout:  Duration(45 * time.Second),
+
+			ResumeGrace:  Duration(30 * time.Second),
+			ResumeReplay: 128,
+		},
+		Rooms: RoomsConfig{
+			MaxPeers: 8,
+		},
+		RateLimit: RateLimitConfig{
+			Client: RateLimit{Rate: 200, Burst: 400, Policy: RateLimitDisconnect},
+			Types: map[string]RateLimit{
+				"gyro": {Rate: 120, Burst: 30, Policy: RateLimitCoalesce},
+				"hand": {Rate: 60, Burst: 15, Policy: RateLimitCoalesce},
+			},
+		},
+		Security: SecurityConfig{
+			IdentityKeyDir:   "keys",
+			IdentityRotation: Duration(90 * 24 * time.Hour),
+			IdentityOverlap:  Duration(14 * 24 * time.Hour),
+
+			RekeyAfterMessages: 1000000,
+			RekeyInterval:      Duration(30 * time.Minute),
+			RekeyGrace:         Duration(10 * time.Second),
+		},
+		Shutdown: ShutdownConfig{
+			Timeout:      Duration(10 * time.Second),
+			ProcessGrace: Duration(3 * time.Second),
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		SharedMemorySize: 65536,
+	}
+}
+
+// Load builds the effective configuration by layering, in increasing order
+// of precedence, the defaults, the config file (-config or CONFIG_FILE),
+// environment variables and the command-line flags registered on fs.
+// The returned configuration has not been validated.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	configFile := fs.String("config", "", "path to a YAML or JSON config file")
+	fs.String("addr", "", "address to listen on")
+	fs.String("media-dir", "", "directory containing media files")
+	fs.String("static-dir", "", "directory containing the frontend")
+	fs.String("default-room", "", "room used when a client does not name one")
+	fs.String("vr-executable", "", "media file or VR executable started by start_vr")
+	fs.String("tls-mode", "", "TLS mode: files, self-signed or disabled")
+	fs.String("tls-cert", "", "TLS certificate file")
+	fs.String("tls-key", "", "TLS private key file")
+	fs.String("ice-servers", "", "comma-separated STUN/TURN URLs")
+	fs.String("log-level", "", "log level: debug, info, warn or error")
+	fs.String("log-format", "", "log format: text or json")
+	fs.String("auth-secret", "", "HMAC secret for WebSocket auth tokens")
+	fs.String("allowed-origins", "", "comma-separated origins allowed to open a WebSocket, * for any")
+	fs.Bool("require-encryption", false, "only accept encrypted messages after the key exchange")
+	fs.Bool("rsa-key-exchange", false, "also offer the legacy RSA key exchange for old clients")
+	fs.String("identity-key-dir", "", "directory holding the server identity keys")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	source.mutex.Lock()
+	source.file, source.flags = path, flags
+	source.mutex.Unlock()
+	return build(path, flags)
+}
+
+// Reload re-reads the configuration from the same file, environment and
+// flags that Load used. The returned configuration has not been validated.
+func Reload() (*Config, error) {
+	source.mutex.Lock()
+	path, flags := source.file, source.flags
+	source.mutex.Unlock()
+	return build(path, flags)
+}
+
+func build(path string, flags map[string]string) (*Config, error) {
+	cfg, err := LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.applyEnv()
+	for name, value := range flags {
+		cfg.applyFlag(name, value)
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyFlag(name, value string) {
+	switch name {
+	case "addr":
+		c.ServerAddress = value
+	case "media-dir":
+		c.MediaDir = value
+	case "static-dir":
+		c.StaticDir = value
+	case "default-room":
+		c.DefaultRoom = value
+	case "vr-executable":
+		c.DefaultFilePath = value
+	case "tls-mode":
+		c.TLS.Mode = value
+	case "tls-cert":
+		c.TLS.CertFile = value
+	case "tls-key":
+		c.TLS.KeyFile = value
+	case "ice-servers":
+		c.WebRTC.ICEServers = parseICEServers(value)
+	case "log-level":
+		c.Log.Level = value
+	case "log-format":
+		c.Log.Format = value
+	case "auth-secret":
+		c.Auth.Secret = value
+	case "allowed-origins":
+		c.WebSocket.AllowedOrigins = parseList(value)
+	case "require-encryption":
+		c.Security.RequireEncryption, _ = strconv.ParseBool(value)
+	case "rsa-key-exchange":
+		c.Security.RSAKeyExchange, _ = strconv.ParseBool(value)
+	case "identity-key-dir":
+		c.Security.IdentityKeyDir = value
+	}
+}
+
+// LoadFile returns the defaults overlaid with the given YAML or JSON file.
+// An empty path returns the defaults.
+func LoadFile(path string) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q (use .yaml, .yml or .json)", filepath.Ext(path))
 	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() {
+	c.ServerAddress = getEnv("SERVER_ADDRESS", c.ServerAddress)
+	c.MediaDir = getEnv("MEDIA_DIR", c.MediaDir)
+	c.StaticDir = getEnv("STATIC_DIR", c.StaticDir)
+	c.DefaultRoom = getEnv("DEFAULT_ROOM", c.DefaultRoom)
+	// filePath is the historical name, kept for existing env files
+	c.DefaultFilePath = getEnv("VR_EXECUTABLE", getEnv("filePath", c.DefaultFilePath))
+	c.TLS.Mode = getEnv("TLS_MODE", c.TLS.Mode)
+	c.TLS.CertFile = getEnv("TLS_CERT_FILE", c.TLS.CertFile)
+	c.TLS.KeyFile = getEnv("TLS_KEY_FILE", c.TLS.KeyFile)
+	c.Media.FFmpegPath = getEnv("FFMPEG_PATH", c.Media.FFmpegPath)
+	c.Media.FFprobePath = getEnv("FFPROBE_PATH", c.Media.FFprobePath)
+	c.Admin.Token = getEnv("ADMIN_TOKEN", c.Admin.Token)
+	c.Auth.Secret = getEnv("AUTH_SECRET", c.Auth.Secret)
+	if value := os.Getenv("ALLOWED_ORIGINS"); value != "" {
+		c.WebSocket.AllowedOrigins = parseList(value)
+	}
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		c.WebSocket.TrustedProxies = parseList(value)
+	}
+	c.Log.Level = getEnv("LOG_LEVEL", c.Log.Level)
+	c.Log.Format = getEnv("LOG_FORMAT", c.Log.Format)
+	c.Security.RequireEncryption = getEnvBool("REQUIRE_ENCRYPTION", c.Security.RequireEncryption)
+	c.Security.RSAKeyExchange = getEnvBool("RSA_KEY_EXCHANGE", c.Security.RSAKeyExchange)
+	c.Security.IdentityKeyDir = getEnv("IDENTITY_KEY_DIR", c.Security.IdentityKeyDir)
+	if value := os.Getenv("ICE_SERVERS"); value != "" {
+		c.WebRTC.ICEServers = parseICEServers(value)
+	}
+}
+
+// Redacted returns a copy of c with secrets masked, for printing.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.Admin.Token != "" {
+		redacted.Admin.Token = "REDACTED"
+	}
+	if redacted.Auth.Secret != "" {
+		redacted.Auth.Secret = "REDACTED"
+	}
+	return &redacted
+}
+
+// Reloaded returns next with every field that cannot change while the
+// server is running reset to its value in c, together with the names of the
+// fields that were held back and need a restart to take effect.
+func (c *Config) Reloaded(next *Config) (*Config, []string) {
+	merged := *next
+	var restart []string
+	if next.ServerAddress != c.ServerAddress {
+		merged.ServerAddress = c.ServerAddress
+		restart = append(restart, "server_address")
+	}
+	if next.StaticDir != c.StaticDir {
+		merged.StaticDir = c.StaticDir
+		restart = append(restart, "static_dir")
+	}
+	if next.TLS != c.TLS {
+		merged.TLS = c.TLS
+		restart = append(restart, "tls")
+	}
+	if next.Security.IdentityKeyDir != c.Security.IdentityKeyDir {
+		merged.Security.IdentityKeyDir = c.Security.IdentityKeyDir
+		restart = append(restart, "security.identity_key_dir")
+	}
+	if next.Log.Format != c.Log.Format {
+		merged.Log.Format = c.Log.Format
+		restart = append(restart, "log.format")
+	}
+	return &merged, restart
+}
+
+// Diff returns the names of the fields that differ between a and b, using
+// the same dotted names as the config file.
+func Diff(a, b *Config) []string {
+	return diff("", reflect.ValueOf(*a), reflect.ValueOf(*b))
+}
+
+func diff(prefix string, a, b reflect.Value) []string {
+	var changed []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if field.Type.Kind() == reflect.Struct {
+			changed = append(changed, diff(name, a.Field(i), b.Field(i))...)
+		} else if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseICEServers(value string) []ICEServer {
+	var servers []ICEServer
+	for _, url := range strings.Split(value, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			servers = append(servers, ICEServer{URLs: []string{url}})
+		}
+	}
+	return servers
+}
+
+// minAuthSecretLength keeps HMAC-SHA256 secrets at least as long as the
+// hash, so tokens cannot be forged by guessing the secret.
+const minAuthSecretLength = 32
+
+var bitratePattern = regexp.MustCompile(`^[0-9]+[kKmM]?$`)
+
+// Validate checks every field and reports all problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if _, port, err := net.SplitHostPort(c.ServerAddress); err != nil {
+		fail("server_address", "%v", err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		fail("server_address", "invalid port %q", port)
+	}
+	if c.MediaDir == "" {
+		fail("media_dir", "must not be empty")
+	}
+	if info, err := os.Stat(c.StaticDir); err != nil {
+		fail("static_dir", "%v", err)
+	} else if !info.IsDir() {
+		fail("static_dir", "%s is not a directory", c.StaticDir)
+	}
+	if c.DefaultRoom == "" {
+		fail("default_room", "must not be empty")
+	}
+	if c.DefaultFilePath == "" {
+		fail("default_file_path", "must not be empty")
+	}
+
+	switch c.TLS.Mode {
+	case TLSModeFiles:
+		for _, file := range []struct{ field, path string }{
+			{"tls.cert_file", c.TLS.CertFile},
+			{"tls.key_file", c.TLS.KeyFile},
+		} {
+			if file.path == "" {
+				fail(file.field, "must not be empty")
+			} else if _, err := os.Stat(file.path); err != nil {
+				fail(file.field, "%v (use tls.mode %q to generate one)", err, TLSModeSelfSigned)
+			}
+		}
+	case TLSModeSelfSigned:
+		if c.TLS.CertFile == "" {
+			fail("tls.cert_file", "must not be empty")
+		}
+		if c.TLS.KeyFile == "" {
+			fail("tls.key_file", "must not be empty")
+		}
+	case TLSModeDisabled:
+	default:
+		fail("tls.mode", "must be one of %s, %s or %s, got %q", TLSModeFiles, TLSModeSelfSigned, TLSModeDisabled, c.TLS.Mode)
+	}
+
+	for i, server := range c.WebRTC.ICEServers {
+		if len(server.URLs) == 0 {
+			fail(fmt.Sprintf("webrtc.ice_servers[%d].urls", i), "must not be empty")
+		}
+		for _, url := range server.URLs {
+			if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "turn:") && !strings.HasPrefix(url, "turns:") {
+				fail(fmt.Sprintf("webrtc.ice_servers[%d].urls", i), "%q is not a stun:, turn: or turns: URL", url)
+			}
+		}
+	}
+
+	if c.Media.FFmpegPath == "" {
+		fail("media.ffmpeg_path", "must not be empty")
+	}
+	if c.Media.FFprobePath == "" {
+		fail("media.ffprobe_path", "must not be empty")
+	}
+	if c.Media.VideoPreset == "" {
+		fail("media.video_preset", "must not be empty")
+	}
+	if c.Media.VideoOnlyPreset == "" {
+		fail("media.video_only_preset", "must not be empty")
+	}
+	for _, bitrate := range []struct{ field, value string }{
+		{"media.video_bitrate", c.Media.VideoBitrate},
+		{"media.video_max_rate", c.Media.VideoMaxRate},
+		{"media.video_buf_size", c.Media.VideoBufSize},
+		{"media.audio_bitrate", c.Media.AudioBitrate},
+		{"media.video_only_bitrate", c.Media.VideoOnlyBitrate},
+		{"media.video_only_max_rate", c.Media.VideoOnlyMaxRate},
+		{"media.video_only_buf_size", c.Media.VideoOnlyBufSize},
+	} {
+		if !bitratePattern.MatchString(bitrate.value) {
+			fail(bitrate.field, "%q is not a bitrate like 800k or 2M", bitrate.value)
+		}
+	}
+	if c.Media.KeyframeInterval <= 0 {
+		fail("media.keyframe_interval", "must be positive, got %d", c.Media.KeyframeInterval)
+	}
+	if c.Media.OpusBitrate < 6000 || c.Media.OpusBitrate > 510000 {
+		fail("media.opus_bitrate", "must be between 6000 and 510000, got %d", c.Media.OpusBitrate)
+	}
+
+	if c.WebSocket.ReadBufferSize <= 0 {
+		fail("websocket.read_buffer_size", "must be positive, got %d", c.WebSocket.ReadBufferSize)
+	}
+	if c.WebSocket.WriteBufferSize <= 0 {
+		fail("websocket.write_buffer_size", "must be positive, got %d", c.WebSocket.WriteBufferSize)
+	}
+	for i, origin := range c.WebSocket.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			fail(fmt.Sprintf("websocket.allowed_origins[%d]", i), "%q is not an origin like https://vr.example.com", origin)
+		}
+	}
+	for _, limit := range []struct {
+		field string
+		value int64
+	}{
+		{"websocket.max_handshake_message", c.WebSocket.MaxHandshakeMessage},
+		{"websocket.max_text_message", c.WebSocket.MaxTextMessage},
+		{"websocket.max_binary_message", c.WebSocket.MaxBinaryMessage},
+	} {
+		if limit.value <= 0 {
+			fail(limit.field, "must be positive, got %d", limit.value)
+		}
+	}
+	if c.WebSocket.CompressionLevel < flate.HuffmanOnly || c.WebSocket.CompressionLevel > flate.BestCompression {
+		fail("websocket.compression_level", "must be between %d and %d, got %d", flate.HuffmanOnly, flate.BestCompression, c.WebSocket.CompressionLevel)
+	}
+	if c.WebSocket.MaxConnectionsPerIP < 0 {
+		fail("websocket.max_connections_per_ip", "must not be negative, got %d", c.WebSocket.MaxConnectionsPerIP)
+	}
+	for i, proxy := range c.WebSocket.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			fail(fmt.Sprintf("websocket.trusted_proxies[%d]", i), "%q is not an IP address or CIDR range", proxy)
+		}
+	}
+	if c.WebSocket.SendQueueSize <= 0 {
+		fail("websocket.send_queue_size", "must be positive, got %d", c.WebSocket.SendQueueSize)
+	}
+	if c.WebSocket.WriteTimeout <= 0 {
+		fail("websocket.write_timeout", "must be positive, got %s", time.Duration(c.WebSocket.WriteTimeout))
+	}
+	if c.WebSocket.PingInterval <= 0 {
+		fail("websocket.ping_interval", "must be positive, got %s", time.Duration(c.WebSocket.PingInterval))
+	}
+	if c.WebSocket.IdleTimeout <= c.WebSocket.PingInterval {
+		fail("websocket.idle_timeout", "must be longer than websocket.ping_interval, got %s", time.Duration(c.WebSocket.IdleTimeout))
+	}
+	if c.WebSocket.ResumeGrace < 0 {
+		fail("websocket.resume_grace", "must not be negative, got %s", time.Duration(c.WebSocket.ResumeGrace))
+	}
+	if c.WebSocket.ResumeReplay < 0 {
+		fail("websocket.resume_replay", "must not be negative, got %d", c.WebSocket.ResumeReplay)
+	}
+	if c.Rooms.MaxPeers < 0 {
+		fail("rooms.max_peers", "must not be negative, got %d", c.Rooms.MaxPeers)
+	}
+	if c.Rooms.Linger < 0 {
+		fail("rooms.linger", "must not be negative, got %s", time.Duration(c.Rooms.Linger))
+	}
+	if c.Auth.Secret != "" && len(c.Auth.Secret) < minAuthSecretLength {
+		fail("auth.secret", "must be at least %d bytes", minAuthSecretLength)
+	}
+	validateRateLimit := func(field string, limit RateLimit) {
+		if limit.Rate < 0 {
+			fail(field+".rate", "must not be negative, got %g", limit.Rate)
+		}
+		if limit.Rate > 0 && limit.Burst < 1 {
+			fail(field+".burst", "must be at least 1, got %d", limit.Burst)
+		}
+		switch limit.Policy {
+		case RateLimitDrop, RateLimitCoalesce, RateLimitDisconnect:
+		default:
+			fail(field+".policy", "must be one of %s, %s or %s, got %q", RateLimitDrop, RateLimitCoalesce, RateLimitDisconnect, limit.Policy)
+		}
+	}
+	validateRateLimit("rate_limit.client", c.RateLimit.Client)
+	if c.RateLimit.Client.Policy == RateLimitCoalesce {
+		fail("rate_limit.client.policy", "%s only applies to rate_limit.types", RateLimitCoalesce)
+	}
+	msgTypes := make([]string, 0, len(c.RateLimit.Types))
+	for msgType := range c.RateLimit.Types {
+		msgTypes = append(msgTypes, msgType)
+	}
+	sort.Strings(msgTypes)
+	for _, msgType := range msgTypes {
+		validateRateLimit("rate_limit.types."+msgType, c.RateLimit.Types[msgType])
+	}
+	if c.Security.IdentityKeyDir == "" {
+		fail("security.identity_key_dir", "must not be empty")
+	}
+	if c.Security.IdentityRotation < 0 {
+		fail("security.identity_rotation", "must not be negative, got %s", time.Duration(c.Security.IdentityRotation))
+	}
+	if c.Security.IdentityOverlap < 0 || c.Security.IdentityRotation > 0 && c.Security.IdentityOverlap >= c.Security.IdentityRotation {
+		fail("security.identity_overlap", "must be between 0 and security.identity_rotation, got %s", time.Duration(c.Security.IdentityOverlap))
+	}
+	if c.Security.RekeyAfterMessages < 0 {
+		fail("security.rekey_after_messages", "must not be negative, got %d", c.Security.RekeyAfterMessages)
+	}
+	if c.Security.RekeyInterval < 0 {
+		fail("security.rekey_interval", "must not be negative, got %s", time.Duration(c.Security.RekeyInterval))
+	}
+	if c.Security.RekeyGrace <= 0 {
+		fail("security.rekey_grace", "must be positive, got %s", time.Duration(c.Security.RekeyGrace))
+	}
+	if c.Shutdown.Timeout <= 0 {
+		fail("shutdown.timeout", "must be positive, got %s", time.Duration(c.Shutdown.Timeout))
+	}
+	if c.Shutdown.ProcessGrace < 0 || c.Shutdown.ProcessGrace >= c.Shutdown.Timeout {
+		fail("shutdown.process_grace", "must be between 0 and shutdown.timeout, got %s", time.Duration(c.Shutdown.ProcessGrace))
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		fail("log.level", "%v", err)
+	}
+	if c.Log.Format != logging.FormatText && c.Log.Format != logging.FormatJSON {
+		fail("log.format", "must be %s or %s, got %q", logging.FormatText, logging.FormatJSON, c.Log.Format)
+	}
+	if c.SharedMemorySize < 1024 {
+		fail("shared_memory_size", "must be at least 1024 bytes, got %d", c.SharedMemorySize)
+	}
+
+	return errors.Join(errs...)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -28,3 +830,12 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvBool returns defaultValue unless key holds a value strconv.ParseBool
+// understands.
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
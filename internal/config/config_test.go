@@ -0,0 +1,311 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envVars are the environment variables the tests set, cleared before each
+// case so the environment running the tests does not leak in.
+var envVars = []string{"CONFIG_FILE", "SERVER_ADDRESS", "LOG_LEVEL", "ALLOWED_ORIGINS", "REQUIRE_ENCRYPTION", "STATIC_DIR"}
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	const file = `
+server_address: 127.0.0.1:1000
+websocket:
+  allowed_origins: [https://file.example]
+security:
+  require_encryption: false
+log:
+  level: warn
+`
+	env := map[string]string{
+		"SERVER_ADDRESS":     "127.0.0.1:2000",
+		"LOG_LEVEL":          "debug",
+		"ALLOWED_ORIGINS":    "https://env.example, https://other.example",
+		"REQUIRE_ENCRYPTION": "true",
+	}
+	// want lists server_address, log.level, websocket.allowed_origins and
+	// security.require_encryption
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want []string
+	}{
+		{
+			name: "defaults",
+			want: []string{"0.0.0.0:8000", "info", "", "false"},
+		},
+		{
+			name: "file over defaults",
+			file: file,
+			want: []string{"127.0.0.1:1000", "warn", "https://file.example", "false"},
+		},
+		{
+			name: "env over file",
+			file: file,
+			env:  env,
+			want: []string{"127.0.0.1:2000", "debug", "https://env.example,https://other.example", "true"},
+		},
+		{
+			name: "flags over env",
+			file: file,
+			env:  env,
+			args: []string{"-addr", "127.0.0.1:3000", "-log-level", "error", "-allowed-origins", "https://flag.example", "-require-encryption=false"},
+			want: []string{"127.0.0.1:3000", "error", "https://flag.example", "false"},
+		},
+		{
+			name: "empty or malformed env keeps the file",
+			file: file,
+			env:  map[string]string{"SERVER_ADDRESS": "", "REQUIRE_ENCRYPTION": "not-a-bool"},
+			want: []string{"127.0.0.1:1000", "warn", "https://file.example", "false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range envVars {
+				t.Setenv(key, "")
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeFile(t, "config.yaml", tt.file)}, args...)
+			}
+
+			cfg, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{
+				cfg.ServerAddress,
+				cfg.Log.Level,
+				strings.Join(cfg.WebSocket.AllowedOrigins, ","),
+				strconv.FormatBool(cfg.Security.RequireEncryption),
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	for _, key := range envVars {
+		t.Setenv(key, "")
+	}
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.json", `{"default_room": "lab"}`))
+
+	cfg, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DefaultRoom != "lab" {
+		t.Fatalf("default_room = %q, want the value from CONFIG_FILE", cfg.DefaultRoom)
+	}
+}
+
+func TestLoadFileRejectsUnknownFields(t *testing.T) {
+	for _, file := range []struct{ name, data string }{
+		{"config.yaml", "server_adress: 127.0.0.1:1000\n"},
+		{"config.json", `{"server_adress": "127.0.0.1:1000"}`},
+		{"config.toml", ""},
+	} {
+		if _, err := LoadFile(writeFile(t, file.name, file.data)); err == nil {
+			t.Fatalf("%s accepted", file.name)
+		}
+	}
+}
+
+// validConfig returns a configuration that passes Validate without any file
+// on disk besides its static directory.
+func validConfig(t *testing.T) *Config {
+	t.Helper()
+	cfg := Default()
+	cfg.StaticDir = t.TempDir()
+	cfg.TLS.Mode = TLSModeDisabled
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig(t).Validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	tests := []struct {
+		field  string
+		modify func(c *Config)
+	}{
+		{"server_address", func(c *Config) { c.ServerAddress = "localhost" }},
+		{"server_address", func(c *Config) { c.ServerAddress = "localhost:70000" }},
+		{"media_dir", func(c *Config) { c.MediaDir = "" }},
+		{"static_dir", func(c *Config) { c.StaticDir = filepath.Join(c.StaticDir, "missing") }},
+		{"static_dir", func(c *Config) { c.StaticDir = writeFile(t, "index.html", "") }},
+		{"default_room", func(c *Config) { c.DefaultRoom = "" }},
+		{"default_file_path", func(c *Config) { c.DefaultFilePath = "" }},
+		{"tls.cert_file", func(c *Config) {
+			c.TLS = TLSConfig{Mode: TLSModeFiles, CertFile: filepath.Join(c.StaticDir, "cert.pem"), KeyFile: writeFile(t, "key.pem", "")}
+		}},
+		{"tls.key_file", func(c *Config) { c.TLS = TLSConfig{Mode: TLSModeFiles, CertFile: writeFile(t, "cert.pem", "")} }},
+		{"tls.cert_file", func(c *Config) { c.TLS = TLSConfig{Mode: TLSModeSelfSigned, KeyFile: "key.pem"} }},
+		{"tls.key_file", func(c *Config) { c.TLS = TLSConfig{Mode: TLSModeSelfSigned, CertFile: "cert.pem"} }},
+		{"tls.mode", func(c *Config) { c.TLS.Mode = "auto" }},
+		{"webrtc.ice_servers[0].urls", func(c *Config) { c.WebRTC.ICEServers = []ICEServer{{}} }},
+		{"webrtc.ice_servers[0].urls", func(c *Config) { c.WebRTC.ICEServers = parseICEServers("http://stun.example") }},
+		{"media.ffmpeg_path", func(c *Config) { c.Media.FFmpegPath = "" }},
+		{"media.ffprobe_path", func(c *Config) { c.Media.FFprobePath = "" }},
+		{"media.video_preset", func(c *Config) { c.Media.VideoPreset = "" }},
+		{"media.video_only_preset", func(c *Config) { c.Media.VideoOnlyPreset = "" }},
+		{"media.video_bitrate", func(c *Config) { c.Media.VideoBitrate = "fast" }},
+		{"media.video_only_buf_size", func(c *Config) { c.Media.VideoOnlyBufSize = "10G" }},
+		{"media.keyframe_interval", func(c *Config) { c.Media.KeyframeInterval = 0 }},
+		{"media.opus_bitrate", func(c *Config) { c.Media.OpusBitrate = 600000 }},
+		{"websocket.read_buffer_size", func(c *Config) { c.WebSocket.ReadBufferSize = 0 }},
+		{"websocket.write_buffer_size", func(c *Config) { c.WebSocket.WriteBufferSize = -1 }},
+		{"websocket.allowed_origins[1]", func(c *Config) { c.WebSocket.AllowedOrigins = []string{"*", "https://vr.example.com/app"} }},
+		{"websocket.max_handshake_message", func(c *Config) { c.WebSocket.MaxHandshakeMessage = 0 }},
+		{"websocket.max_text_message", func(c *Config) { c.WebSocket.MaxTextMessage = 0 }},
+		{"websocket.max_binary_message", func(c *Config) { c.WebSocket.MaxBinaryMessage = 0 }},
+		{"websocket.compression_level", func(c *Config) { c.WebSocket.CompressionLevel = 10 }},
+		{"websocket.max_connections_per_ip", func(c *Config) { c.WebSocket.MaxConnectionsPerIP = -1 }},
+		{"websocket.trusted_proxies[0]", func(c *Config) { c.WebSocket.TrustedProxies = []string{"proxy.internal"} }},
+		{"websocket.send_queue_size", func(c *Config) { c.WebSocket.SendQueueSize = 0 }},
+		{"websocket.write_timeout", func(c *Config) { c.WebSocket.WriteTimeout = 0 }},
+		{"websocket.ping_interval", func(c *Config) { c.WebSocket.PingInterval = 0 }},
+		{"websocket.idle_timeout", func(c *Config) { c.WebSocket.IdleTimeout = c.WebSocket.PingInterval }},
+		{"websocket.resume_grace", func(c *Config) { c.WebSocket.ResumeGrace = Duration(-time.Second) }},
+		{"websocket.resume_replay", func(c *Config) { c.WebSocket.ResumeReplay = -1 }},
+		{"rooms.max_peers", func(c *Config) { c.Rooms.MaxPeers = -1 }},
+		{"rooms.linger", func(c *Config) { c.Rooms.Linger = Duration(-time.Second) }},
+		{"auth.secret", func(c *Config) { c.Auth.Secret = "too-short" }},
+		{"rate_limit.client.rate", func(c *Config) { c.RateLimit.Client.Rate = -1 }},
+		{"rate_limit.client.burst", func(c *Config) { c.RateLimit.Client.Burst = 0 }},
+		{"rate_limit.client.policy", func(c *Config) { c.RateLimit.Client.Policy = "block" }},
+		{"rate_limit.client.policy", func(c *Config) { c.RateLimit.Client.Policy = RateLimitCoalesce }},
+		{"rate_limit.types.gyro.policy", func(c *Config) { c.RateLimit.Types["gyro"] = RateLimit{Rate: 1, Burst: 1} }},
+		{"security.identity_key_dir", func(c *Config) { c.Security.IdentityKeyDir = "" }},
+		{"security.identity_rotation", func(c *Config) { c.Security.IdentityRotation = Duration(-time.Hour) }},
+		{"security.identity_overlap", func(c *Config) { c.Security.IdentityOverlap = c.Security.IdentityRotation }},
+		{"security.identity_overlap", func(c *Config) { c.Security.IdentityOverlap = Duration(-time.Hour) }},
+		{"security.rekey_after_messages", func(c *Config) { c.Security.RekeyAfterMessages = -1 }},
+		{"security.rekey_interval", func(c *Config) { c.Security.RekeyInterval = Duration(-time.Minute) }},
+		{"security.rekey_grace", func(c *Config) { c.Security.RekeyGrace = 0 }},
+		{"shutdown.timeout", func(c *Config) { c.Shutdown.Timeout = 0 }},
+		{"shutdown.process_grace", func(c *Config) { c.Shutdown.ProcessGrace = c.Shutdown.Timeout }},
+		{"log.level", func(c *Config) { c.Log.Level = "verbose" }},
+		{"log.format", func(c *Config) { c.Log.Format = "xml" }},
+		{"shared_memory_size", func(c *Config) { c.SharedMemorySize = 512 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			cfg := validConfig(t)
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if err == nil {
+				t.Fatal("invalid config accepted")
+			}
+			var fields []string
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				field, _, _ := strings.Cut(e.Error(), ": ")
+				fields = append(fields, field)
+			}
+			if !slices.Contains(fields, tt.field) {
+				t.Fatalf("rejected %v, want %s: %v", fields, tt.field, err)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := validConfig(t)
+	cfg.MediaDir = ""
+	cfg.Log.Format = "xml"
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) || len(joined.Unwrap()) != 2 {
+		t.Fatalf("got %v, want both problems", err)
+	}
+}
+
+func TestReloaded(t *testing.T) {
+	tests := []struct {
+		field  string
+		modify func(c *Config)
+	}{
+		{"server_address", func(c *Config) { c.ServerAddress = "127.0.0.1:9000" }},
+		{"static_dir", func(c *Config) { c.StaticDir = "public" }},
+		{"tls", func(c *Config) { c.TLS.CertFile = "other.pem" }},
+		{"security.identity_key_dir", func(c *Config) { c.Security.IdentityKeyDir = "other-keys" }},
+		{"log.format", func(c *Config) { c.Log.Format = "json" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			running, next := Default(), Default()
+			tt.modify(next)
+			next.Log.Level = "debug"
+
+			merged, restart := running.Reloaded(next)
+			if !slices.Equal(restart, []string{tt.field}) {
+				t.Fatalf("restart = %v, want [%s]", restart, tt.field)
+			}
+			if changed := Diff(running, merged); !slices.Equal(changed, []string{"log.level"}) {
+				t.Fatalf("applied %v, want only the reloadable log.level", changed)
+			}
+		})
+	}
+}
+
+// TestReload checks that Reload rebuilds the configuration from the file
+// Load read, so an edited file is picked up and its restart-only fields held
+// back.
+func TestReload(t *testing.T) {
+	for _, key := range envVars {
+		t.Setenv(key, "")
+	}
+	path := writeFile(t, "config.yaml", "server_address: 127.0.0.1:1000\n")
+	running, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path, "-static-dir", "public"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("server_address: 127.0.0.1:2000\nstatic_dir: www\nrooms:\n  max_peers: 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	next, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.StaticDir != "public" {
+		t.Fatalf("static_dir = %q, want the -static-dir flag to still win", next.StaticDir)
+	}
+
+	merged, restart := running.Reloaded(next)
+	if !slices.Equal(restart, []string{"server_address"}) {
+		t.Fatalf("restart = %v, want [server_address]", restart)
+	}
+	if changed := Diff(running, merged); !slices.Equal(changed, []string{"rooms.max_peers"}) {
+		t.Fatalf("applied %v, want [rooms.max_peers]", changed)
+	}
+}
@@ -3,15 +3,49 @@ package crypto
 import (
     "crypto/aes"
     "crypto/cipher"
+    "crypto/rand"
     "encoding/base64"
+    "encoding/binary"
     "fmt"
 )
 
+// Frame directions, bound into the additional data of every frame so a
+// frame cannot be reflected back to its sender under the shared key.
+const (
+    DirectionClientToServer byte = 1
+    DirectionServerToClient byte = 2
+)
+
+// SeqSize is the length of the big-endian sequence number prefixing a frame.
+const SeqSize = 8
+
+// AESCipher encrypts with one AES-GCM key and decrypts with another. The
+// RSA handshake uses the same key both ways; the ECDH handshake derives one
+// per direction.
 type AESCipher struct {
-    gcm cipher.AEAD
+    openGCM cipher.AEAD // decrypts
+    sealGCM cipher.AEAD // encrypts
 }
 
 func NewAESCipher(key []byte) (*AESCipher, error) {
+    return NewDirectionalAESCipher(key, key)
+}
+
+// NewDirectionalAESCipher returns a cipher that encrypts with encryptKey and
+// decrypts with decryptKey.
+func NewDirectionalAESCipher(encryptKey, decryptKey []byte) (*AESCipher, error) {
+    openGCM, err := newGCM(decryptKey)
+    if err != nil {
+        return nil, err
+    }
+    sealGCM, err := newGCM(encryptKey)
+    if err != nil {
+        return nil, err
+    }
+    return &AESCipher{openGCM: openGCM, sealGCM: sealGCM}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
     block, err := aes.NewCipher(key)
     if err != nil {
         return nil, fmt.Errorf("failed to create AES cipher: %w", err)
@@ -22,7 +56,27 @@ func NewAESCipher(key []byte) (*AESCipher, error) {
         return nil, fmt.Errorf("failed to create GCM: %w", err)
     }
     
-    return &AESCipher{gcm: gcm}, nil
+    return gcm, nil
+}
+
+// Encrypt seals plaintext under a fresh random nonce and returns
+// base64(nonce || ciphertext), the format Decrypt accepts.
+func (a *AESCipher) Encrypt(plaintext []byte) (string, error) {
+    data, err := a.EncryptBinary(plaintext)
+    if err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// EncryptBinary seals plaintext under a fresh random nonce and returns
+// nonce || ciphertext, the format DecryptBinary accepts.
+func (a *AESCipher) EncryptBinary(plaintext []byte) ([]byte, error) {
+    nonce := make([]byte, a.sealGCM.NonceSize(), a.sealGCM.NonceSize()+len(plaintext)+a.sealGCM.Overhead())
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, fmt.Errorf("failed to generate nonce: %w", err)
+    }
+    return a.sealGCM.Seal(nonce, nonce, plaintext, nil), nil
 }
 
 func (a *AESCipher) Decrypt(encryptedData string) ([]byte, error) {
@@ -31,13 +85,13 @@ func (a *AESCipher) Decrypt(encryptedData string) ([]byte, error) {
         return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
     }
     
-    nonceSize := a.gcm.NonceSize()
+    nonceSize := a.openGCM.NonceSize()
     if len(ciphertext) < nonceSize {
         return nil, fmt.Errorf("ciphertext too short")
     }
     
     nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-    plaintext, err := a.gcm.Open(nil, nonce, ciphertext, nil)
+    plaintext, err := a.openGCM.Open(nil, nonce, ciphertext, nil)
     if err != nil {
         return nil, fmt.Errorf("failed to decrypt: %w", err)
     }
@@ -46,16 +100,54 @@ func (a *AESCipher) Decrypt(encryptedData string) ([]byte, error) {
 }
 
 func (a *AESCipher) DecryptBinary(data []byte) ([]byte, error) {
-    nonceSize := a.gcm.NonceSize()
+    nonceSize := a.openGCM.NonceSize()
     if len(data) < nonceSize {
         return nil, fmt.Errorf("binary data too short")
     }
     
     nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-    plaintext, err := a.gcm.Open(nil, nonce, ciphertext, nil)
+    plaintext, err := a.openGCM.Open(nil, nonce, ciphertext, nil)
     if err != nil {
         return nil, fmt.Errorf("failed to decrypt binary data: %w", err)
     }
     
     return plaintext, nil
-}
\ No newline at end of file
+}
+
+// EncryptFrame seals plaintext as seq || nonce || ciphertext. The direction,
+// seq and peerID are authenticated as additional data.
+func (a *AESCipher) EncryptFrame(direction byte, seq uint64, peerID string, plaintext []byte) ([]byte, error) {
+    nonceSize := a.sealGCM.NonceSize()
+    frame := make([]byte, SeqSize+nonceSize, SeqSize+nonceSize+len(plaintext)+a.sealGCM.Overhead())
+    binary.BigEndian.PutUint64(frame, seq)
+    nonce := frame[SeqSize:]
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, fmt.Errorf("failed to generate nonce: %w", err)
+    }
+    return a.sealGCM.Seal(frame, nonce, plaintext, frameAAD(direction, seq, peerID)), nil
+}
+
+// DecryptFrame opens a frame produced by EncryptFrame and returns its
+// sequence number. Callers must check the sequence number for replays.
+func (a *AESCipher) DecryptFrame(direction byte, peerID string, frame []byte) (uint64, []byte, error) {
+    nonceSize := a.openGCM.NonceSize()
+    if len(frame) < SeqSize+nonceSize+a.openGCM.Overhead() {
+        return 0, nil, fmt.Errorf("frame too short")
+    }
+
+    seq := binary.BigEndian.Uint64(frame)
+    nonce, ciphertext := frame[SeqSize:SeqSize+nonceSize], frame[SeqSize+nonceSize:]
+    plaintext, err := a.openGCM.Open(nil, nonce, ciphertext, frameAAD(direction, seq, peerID))
+    if err != nil {
+        return 0, nil, fmt.Errorf("failed to decrypt frame: %w", err)
+    }
+    return seq, plaintext, nil
+}
+
+// frameAAD returns direction || seq || peerID.
+func frameAAD(direction byte, seq uint64, peerID string) []byte {
+    aad := make([]byte, 1+SeqSize, 1+SeqSize+len(peerID))
+    aad[0] = direction
+    binary.BigEndian.PutUint64(aad[1:], seq)
+    return append(aad, peerID...)
+}
@@ -0,0 +1,134 @@
+package crypto
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+)
+
+func testKey(fill byte) []byte {
+    return bytes.Repeat([]byte{fill}, 32)
+}
+
+// testCiphers returns the client's and the server's side of a session with
+// a key per direction, as the ECDH handshake sets up.
+func testCiphers(t *testing.T) (client, server *AESCipher) {
+    t.Helper()
+    c2s, s2c := testKey(1), testKey(2)
+    client, err := NewDirectionalAESCipher(c2s, s2c)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server, err = NewDirectionalAESCipher(s2c, c2s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return client, server
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+    client, server := testCiphers(t)
+    frame, err := client.EncryptFrame(DirectionClientToServer, 7, "peer", []byte("hello"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    seq, plaintext, err := server.DecryptFrame(DirectionClientToServer, "peer", frame)
+    if err != nil {
+        t.Fatalf("DecryptFrame: %v", err)
+    }
+    if seq != 7 || string(plaintext) != "hello" {
+        t.Fatalf("DecryptFrame = %d, %q, want 7, %q", seq, plaintext, "hello")
+    }
+}
+
+func TestFrameRejected(t *testing.T) {
+    client, server := testCiphers(t)
+    shared, err := NewAESCipher(testKey(3))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name      string
+        seal      *AESCipher
+        open      *AESCipher
+        sealDir   byte
+        openDir   byte
+        openPeer  string
+        tamperSeq bool
+    }{
+        {
+            name:     "wrong peer ID",
+            seal:     client,
+            open:     server,
+            sealDir:  DirectionClientToServer,
+            openDir:  DirectionClientToServer,
+            openPeer: "other",
+        },
+        {
+            name:      "sequence number changed",
+            seal:      client,
+            open:      server,
+            sealDir:   DirectionClientToServer,
+            openDir:   DirectionClientToServer,
+            openPeer:  "peer",
+            tamperSeq: true,
+        },
+        {
+            // Under a single shared key only the direction in the AAD
+            // stops a frame being reflected back to its sender
+            name:     "reflected with a shared key",
+            seal:     shared,
+            open:     shared,
+            sealDir:  DirectionServerToClient,
+            openDir:  DirectionClientToServer,
+            openPeer: "peer",
+        },
+        {
+            name:     "reflected with per-direction keys",
+            seal:     server,
+            open:     server,
+            sealDir:  DirectionServerToClient,
+            openDir:  DirectionServerToClient,
+            openPeer: "peer",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            frame, err := tt.seal.EncryptFrame(tt.sealDir, 1, "peer", []byte("gyro"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if tt.tamperSeq {
+                binary.BigEndian.PutUint64(frame, 2)
+            }
+            if _, _, err := tt.open.DecryptFrame(tt.openDir, tt.openPeer, frame); err == nil {
+                t.Fatal("DecryptFrame accepted the frame")
+            }
+        })
+    }
+}
+
+func TestFrameTooShort(t *testing.T) {
+    _, server := testCiphers(t)
+    if _, _, err := server.DecryptFrame(DirectionClientToServer, "peer", make([]byte, SeqSize)); err == nil {
+        t.Fatal("DecryptFrame accepted a truncated frame")
+    }
+}
+
+func TestRekeyKeys(t *testing.T) {
+    c2s, s2c, err := RekeyKeys(testKey(4))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Equal(c2s, s2c) {
+        t.Fatal("RekeyKeys returned the same key for both directions")
+    }
+    again, _, err := RekeyKeys(testKey(4))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(c2s, again) {
+        t.Fatal("RekeyKeys is not deterministic")
+    }
+}
@@ -0,0 +1,130 @@
+package crypto
+
+import (
+    "crypto/ecdh"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "sync"
+
+    "golang.org/x/crypto/hkdf"
+)
+
+// Handshake versions advertised in the init message. Clients that predate
+// the version field only know HandshakeRSA.
+const (
+    HandshakeRSA  = 1
+    HandshakeECDH = 2
+)
+
+// Curves offered for the ECDH handshake, named as in WebCrypto.
+const (
+    CurveX25519 = "X25519"
+    CurveP256   = "P-256"
+)
+
+var curves = map[string]ecdh.Curve{
+    CurveX25519: ecdh.X25519(),
+    CurveP256:   ecdh.P256(),
+}
+
+// HKDF info strings for the two directional session keys.
+const (
+    infoClientToServer = "vr-distributed client-to-server"
+    infoServerToClient = "vr-distributed server-to-client"
+
+    infoRekeyClientToServer = "vr-distributed rekey client-to-server"
+    infoRekeyServerToClient = "vr-distributed rekey server-to-client"
+)
+
+// ECDHHandshake holds the ephemeral server keys offered to one client, one
+// per supported curve. It can complete a single key exchange, after which
+// the private keys are dropped.
+type ECDHHandshake struct {
+    mutex sync.Mutex
+    keys  map[string]*ecdh.PrivateKey
+}
+
+func NewECDHHandshake() (*ECDHHandshake, error) {
+    keys := make(map[string]*ecdh.PrivateKey, len(curves))
+    for name, curve := range curves {
+        key, err := curve.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, fmt.Errorf("failed to generate %s key: %w", name, err)
+        }
+        keys[name] = key
+    }
+    return &ECDHHandshake{keys: keys}, nil
+}
+
+// PublicKeys returns the base64 raw public key for each curve: 32 bytes for
+// X25519 and an uncompressed point for P-256, as WebCrypto exports them.
+func (h *ECDHHandshake) PublicKeys() map[string]string {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    public := make(map[string]string, len(h.keys))
+    for name, key := range h.keys {
+        public[name] = base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+    }
+    return public
+}
+
+// DeriveKeys completes the exchange with the client's public key on curve
+// and returns the AES-256 keys for each direction. They are derived with
+// HKDF-SHA256 from the shared secret, salted with the hash of both public
+// keys. The handshake cannot be used again afterwards.
+func (h *ECDHHandshake) DeriveKeys(curve string, clientPublic []byte) (clientToServer, serverToClient []byte, err error) {
+    h.mutex.Lock()
+    serverKey, ok := h.keys[curve]
+    h.keys = nil
+    h.mutex.Unlock()
+    if !ok {
+        return nil, nil, fmt.Errorf("unsupported or already used curve %q", curve)
+    }
+
+    peerKey, err := curves[curve].NewPublicKey(clientPublic)
+    if err != nil {
+        return nil, nil, fmt.Errorf("invalid %s public key: %w", curve, err)
+    }
+    secret, err := serverKey.ECDH(peerKey)
+    if err != nil {
+        return nil, nil, fmt.Errorf("ECDH failed: %w", err)
+    }
+
+    transcript := sha256.New()
+    transcript.Write(serverKey.PublicKey().Bytes())
+    transcript.Write(clientPublic)
+    salt := transcript.Sum(nil)
+
+    if clientToServer, err = deriveKey(secret, salt, infoClientToServer); err != nil {
+        return nil, nil, err
+    }
+    if serverToClient, err = deriveKey(secret, salt, infoServerToClient); err != nil {
+        return nil, nil, err
+    }
+    return clientToServer, serverToClient, nil
+}
+
+// RekeyKeys derives the AES-256 keys for each direction from a key offered
+// in a rekey message, with HKDF-SHA256, so a rotated session keeps separate
+// keys like one set up by ECDH.
+func RekeyKeys(key []byte) (clientToServer, serverToClient []byte, err error) {
+    if clientToServer, err = deriveKey(key, nil, infoRekeyClientToServer); err != nil {
+        return nil, nil, err
+    }
+    if serverToClient, err = deriveKey(key, nil, infoRekeyServerToClient); err != nil {
+        return nil, nil, err
+    }
+    return clientToServer, serverToClient, nil
+}
+
+func deriveKey(secret, salt []byte, info string) ([]byte, error) {
+    key := make([]byte, 32)
+    if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+        return nil, fmt.Errorf("failed to derive session key: %w", err)
+    }
+    return key, nil
+}
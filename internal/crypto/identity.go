@@ -0,0 +1,290 @@
+package crypto
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    identityFilePrefix = "identity-"
+    identityPEMType    = "PRIVATE KEY"
+    identityCreatedHdr = "Created"
+)
+
+// IdentityKey is an ECDSA P-256 key the server signs its handshakes with.
+// Clients pin its Fingerprint, the SHA-256 of the DER public key.
+type IdentityKey struct {
+    ID          string
+    Fingerprint string
+    CreatedAt   time.Time
+    PublicKey   string // base64 DER SubjectPublicKeyInfo, as WebCrypto imports "spki"
+
+    key *ecdsa.PrivateKey
+}
+
+// HandshakeSignature is one identity key's signature over a handshake
+// transcript.
+type HandshakeSignature struct {
+    KeyID     string
+    PublicKey string
+    Signature string // base64 r || s, as WebCrypto verifies ECDSA
+}
+
+// identityKeys holds the persisted identity keys, newest first. The newest
+// one is current; older ones stay in use until their overlap has passed so
+// pinned clients can learn the new key.
+var identityKeys struct {
+    mutex sync.RWMutex
+    dir   string
+    keys  []*IdentityKey
+}
+
+// LoadIdentity loads the identity keys persisted in dir, generating the
+// first one if there is none and rotating if the current key is older than
+// rotation. A rotation of zero never rotates.
+func LoadIdentity(dir string, rotation, overlap time.Duration) error {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return fmt.Errorf("failed to create identity key directory: %w", err)
+    }
+    paths, err := filepath.Glob(filepath.Join(dir, identityFilePrefix+"*.pem"))
+    if err != nil {
+        return err
+    }
+
+    var keys []*IdentityKey
+    for _, path := range paths {
+        key, err := readIdentityKey(path)
+        if err != nil {
+            return err
+        }
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+    identityKeys.mutex.Lock()
+    identityKeys.dir, identityKeys.keys = dir, keys
+    identityKeys.mutex.Unlock()
+
+    if len(keys) == 0 {
+        return RotateIdentity(overlap)
+    }
+    _, err = RotateIdentityIfDue(rotation, overlap)
+    return err
+}
+
+// RotateIdentityIfDue rotates the identity key once the current one is
+// older than rotation, and retires previous keys whose overlap has passed.
+// It reports whether a new key was generated.
+func RotateIdentityIfDue(rotation, overlap time.Duration) (bool, error) {
+    identityKeys.mutex.RLock()
+    due := len(identityKeys.keys) == 0 ||
+        rotation > 0 && time.Since(identityKeys.keys[0].CreatedAt) >= rotation
+    identityKeys.mutex.RUnlock()
+
+    if due {
+        return true, RotateIdentity(overlap)
+    }
+    return false, retireIdentityKeys(overlap)
+}
+
+// RotateIdentity generates and persists a new current identity key. The
+// previous key keeps signing handshakes for overlap.
+func RotateIdentity(overlap time.Duration) error {
+    private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return fmt.Errorf("failed to generate identity key: %w", err)
+    }
+    key, err := newIdentityKey(private, time.Now().UTC().Truncate(time.Second))
+    if err != nil {
+        return err
+    }
+    der, err := x509.MarshalPKCS8PrivateKey(private)
+    if err != nil {
+        return fmt.Errorf("failed to marshal identity key: %w", err)
+    }
+
+    identityKeys.mutex.Lock()
+    dir := identityKeys.dir
+    identityKeys.mutex.Unlock()
+
+    data := pem.EncodeToMemory(&pem.Block{
+        Type:    identityPEMType,
+        Headers: map[string]string{identityCreatedHdr: key.CreatedAt.Format(time.RFC3339)},
+        Bytes:   der,
+    })
+    if err := os.WriteFile(identityKeyPath(dir, key.ID), data, 0600); err != nil {
+        return fmt.Errorf("failed to write identity key: %w", err)
+    }
+
+    identityKeys.mutex.Lock()
+    identityKeys.keys = append([]*IdentityKey{key}, identityKeys.keys...)
+    identityKeys.mutex.Unlock()
+    return retireIdentityKeys(overlap)
+}
+
+// retireIdentityKeys drops and deletes every previous key whose successor
+// has been current for longer than overlap.
+func retireIdentityKeys(overlap time.Duration) error {
+    identityKeys.mutex.Lock()
+    defer identityKeys.mutex.Unlock()
+
+    keys := identityKeys.keys
+    for i := 1; i < len(keys); i++ {
+        if time.Since(keys[i-1].CreatedAt) < overlap {
+            continue
+        }
+        for _, retired := range keys[i:] {
+            if err := os.Remove(identityKeyPath(identityKeys.dir, retired.ID)); err != nil && !os.IsNotExist(err) {
+                return fmt.Errorf("failed to delete retired identity key: %w", err)
+            }
+        }
+        identityKeys.keys = keys[:i]
+        break
+    }
+    return nil
+}
+
+// IdentityKeys returns the keys currently signing handshakes, newest first.
+func IdentityKeys() []IdentityKey {
+    identityKeys.mutex.RLock()
+    defer identityKeys.mutex.RUnlock()
+
+    keys := make([]IdentityKey, len(identityKeys.keys))
+    for i, key := range identityKeys.keys {
+        keys[i] = *key
+    }
+    return keys
+}
+
+// SignHandshake signs the transcript built for the identity keys in use
+// with each of them, current key first. The transcript covers the signing
+// keys, so a signature cannot be added to or dropped from a signed init.
+func SignHandshake(transcript func(signers []HandshakeSignature) []byte) ([]HandshakeSignature, error) {
+    identityKeys.mutex.RLock()
+    keys := identityKeys.keys
+    identityKeys.mutex.RUnlock()
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("no identity key loaded")
+    }
+
+    signatures := make([]HandshakeSignature, 0, len(keys))
+    for _, key := range keys {
+        signatures = append(signatures, HandshakeSignature{KeyID: key.ID, PublicKey: key.PublicKey})
+    }
+    digest := sha256.Sum256(transcript(signatures))
+    for i, key := range keys {
+        r, s, err := ecdsa.Sign(rand.Reader, key.key, digest[:])
+        if err != nil {
+            return nil, fmt.Errorf("failed to sign handshake with key %s: %w", key.ID, err)
+        }
+        signature := make([]byte, 64)
+        r.FillBytes(signature[:32])
+        s.FillBytes(signature[32:])
+        signatures[i].Signature = base64.StdEncoding.EncodeToString(signature)
+    }
+    return signatures, nil
+}
+
+// HandshakeTranscript encodes the fields of an init message that the
+// identity signature covers. Every field is prefixed with its length as a
+// 4-byte big-endian integer, the ECDH keys are ordered by curve name and
+// the signers' key IDs and public keys by key ID.
+func HandshakeTranscript(version int, peerID, room string, ecdhKeys map[string]string, rsaPublicKey string, signers []HandshakeSignature) []byte {
+    curveNames := make([]string, 0, len(ecdhKeys))
+    for name := range ecdhKeys {
+        curveNames = append(curveNames, name)
+    }
+    sort.Strings(curveNames)
+
+    fields := []string{"vr-distributed handshake", fmt.Sprint(version), peerID, room}
+    for _, name := range curveNames {
+        fields = append(fields, name, ecdhKeys[name])
+    }
+    fields = append(fields, rsaPublicKey)
+
+    signers = append([]HandshakeSignature(nil), signers...)
+    sort.Slice(signers, func(i, j int) bool { return signers[i].KeyID < signers[j].KeyID })
+    for _, signer := range signers {
+        fields = append(fields, signer.KeyID, signer.PublicKey)
+    }
+
+    var transcript []byte
+    for _, field := range fields {
+        transcript = binary.BigEndian.AppendUint32(transcript, uint32(len(field)))
+        transcript = append(transcript, field...)
+    }
+    return transcript
+}
+
+func readIdentityKey(path string) (*IdentityKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read identity key: %w", err)
+    }
+    block, _ := pem.Decode(data)
+    if block == nil || block.Type != identityPEMType {
+        return nil, fmt.Errorf("no private key found in %s", path)
+    }
+    parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse identity key %s: %w", path, err)
+    }
+    private, ok := parsed.(*ecdsa.PrivateKey)
+    if !ok || private.Curve != elliptic.P256() {
+        return nil, fmt.Errorf("identity key %s is not an ECDSA P-256 key", path)
+    }
+
+    createdAt, err := time.Parse(time.RFC3339, block.Headers[identityCreatedHdr])
+    if err != nil {
+        // Keys written by hand carry no header, fall back to the file time
+        info, statErr := os.Stat(path)
+        if statErr != nil {
+            return nil, statErr
+        }
+        createdAt = info.ModTime().UTC()
+    }
+    return newIdentityKey(private, createdAt)
+}
+
+func newIdentityKey(private *ecdsa.PrivateKey, createdAt time.Time) (*IdentityKey, error) {
+    der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+    if err != nil {
+        return nil, fmt.Errorf("failed to marshal identity public key: %w", err)
+    }
+    sum := sha256.Sum256(der)
+    return &IdentityKey{
+        ID:          hex.EncodeToString(sum[:8]),
+        Fingerprint: Fingerprint(sum[:]),
+        CreatedAt:   createdAt,
+        PublicKey:   base64.StdEncoding.EncodeToString(der),
+        key:         private,
+    }, nil
+}
+
+// Fingerprint formats a SHA-256 digest as colon-separated uppercase hex,
+// the form clients pin.
+func Fingerprint(sum []byte) string {
+    hexParts := make([]string, len(sum))
+    for i, b := range sum {
+        hexParts[i] = fmt.Sprintf("%02X", b)
+    }
+    return strings.Join(hexParts, ":")
+}
+
+func identityKeyPath(dir, id string) string {
+    return filepath.Join(dir, identityFilePrefix+id+".pem")
+}
@@ -0,0 +1,103 @@
+package crypto
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "math/big"
+    "testing"
+    "time"
+)
+
+// verifyHandshake reports whether signature verifies over transcript, as
+// the client checks it.
+func verifyHandshake(t *testing.T, signature HandshakeSignature, transcript []byte) bool {
+    t.Helper()
+    der, err := base64.StdEncoding.DecodeString(signature.PublicKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    parsed, err := x509.ParsePKIXPublicKey(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    raw, err := base64.StdEncoding.DecodeString(signature.Signature)
+    if err != nil || len(raw) != 64 {
+        t.Fatalf("malformed signature %q", signature.Signature)
+    }
+    digest := sha256.Sum256(transcript)
+    r, s := new(big.Int).SetBytes(raw[:32]), new(big.Int).SetBytes(raw[32:])
+    return ecdsa.Verify(parsed.(*ecdsa.PublicKey), digest[:], r, s)
+}
+
+func testTranscript(signers []HandshakeSignature) []byte {
+    return HandshakeTranscript(HandshakeECDH, "peer", "room", map[string]string{CurveX25519: "x", CurveP256: "p"}, "", signers)
+}
+
+func TestSignHandshake(t *testing.T) {
+    if err := LoadIdentity(t.TempDir(), 0, time.Hour); err != nil {
+        t.Fatal(err)
+    }
+    if err := RotateIdentity(time.Hour); err != nil {
+        t.Fatal(err)
+    }
+
+    signatures, err := SignHandshake(testTranscript)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(signatures) != 2 {
+        t.Fatalf("got %d signatures, want one per key in use", len(signatures))
+    }
+    for _, signature := range signatures {
+        if !verifyHandshake(t, signature, testTranscript(signatures)) {
+            t.Fatalf("signature from key %s does not verify", signature.KeyID)
+        }
+    }
+    if verifyHandshake(t, signatures[0], testTranscript(signatures[:1])) {
+        t.Fatal("signature still verifies after the other signer was dropped")
+    }
+}
+
+// TestSignHandshakeAppendedSigner checks that a signature appended to a
+// relayed init cannot ride along with the genuine ones: the genuine
+// signatures stop verifying once the extra signer is in the transcript.
+func TestSignHandshakeAppendedSigner(t *testing.T) {
+    if err := LoadIdentity(t.TempDir(), 0, time.Hour); err != nil {
+        t.Fatal(err)
+    }
+    genuine, err := SignHandshake(testTranscript)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    attacker, err := newIdentityKey(private, time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+    signers := append(genuine, HandshakeSignature{KeyID: attacker.ID, PublicKey: attacker.PublicKey})
+    transcript := testTranscript(signers)
+    digest := sha256.Sum256(transcript)
+    r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+    if err != nil {
+        t.Fatal(err)
+    }
+    raw := make([]byte, 64)
+    r.FillBytes(raw[:32])
+    s.FillBytes(raw[32:])
+    signers[len(signers)-1].Signature = base64.StdEncoding.EncodeToString(raw)
+
+    if verifyHandshake(t, genuine[0], transcript) {
+        t.Fatal("genuine signature verifies next to an appended signer")
+    }
+    if !verifyHandshake(t, signers[len(signers)-1], transcript) {
+        t.Fatal("attacker signature does not verify over its own transcript")
+    }
+}
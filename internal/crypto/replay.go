@@ -0,0 +1,57 @@
+package crypto
+
+import (
+    "errors"
+    "sync"
+)
+
+// ReplayWindowSize is how far behind the highest sequence number seen a
+// frame may arrive and still be accepted. Browsers encrypt asynchronously,
+// so frames can leave slightly out of order.
+const ReplayWindowSize = 64
+
+var (
+    ErrReplayed    = errors.New("frame replayed")
+    ErrOutOfWindow = errors.New("frame sequence number outside the replay window")
+)
+
+// ReplayWindow is a sliding window over received sequence numbers that
+// rejects duplicates and frames too old to tell apart from replays.
+// Sequence numbers start at 1. The zero value is ready to use.
+type ReplayWindow struct {
+    mutex   sync.Mutex
+    highest uint64
+    seen    uint64 // bit i set: highest-i was received
+}
+
+// Accept records seq and reports whether it is new. Only call it for frames
+// that authenticated, so forged frames cannot move the window.
+func (w *ReplayWindow) Accept(seq uint64) error {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    if seq == 0 {
+        return ErrOutOfWindow
+    }
+    if seq > w.highest {
+        shift := seq - w.highest
+        if shift >= ReplayWindowSize {
+            w.seen = 0
+        } else {
+            w.seen <<= shift
+        }
+        w.seen |= 1
+        w.highest = seq
+        return nil
+    }
+
+    offset := w.highest - seq
+    if offset >= ReplayWindowSize {
+        return ErrOutOfWindow
+    }
+    if w.seen&(1<<offset) != 0 {
+        return ErrReplayed
+    }
+    w.seen |= 1 << offset
+    return nil
+}
@@ -0,0 +1,75 @@
+package crypto
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+    tests := []struct {
+        name string
+        seqs []uint64
+        want []error
+    }{
+        {
+            name: "in order",
+            seqs: []uint64{1, 2, 3},
+            want: []error{nil, nil, nil},
+        },
+        {
+            name: "zero",
+            seqs: []uint64{0},
+            want: []error{ErrOutOfWindow},
+        },
+        {
+            name: "duplicate of highest",
+            seqs: []uint64{1, 2, 2},
+            want: []error{nil, nil, ErrReplayed},
+        },
+        {
+            name: "duplicate behind highest",
+            seqs: []uint64{1, 2, 3, 1},
+            want: []error{nil, nil, nil, ErrReplayed},
+        },
+        {
+            name: "reordered within window",
+            seqs: []uint64{1, 4, 3, 2, 5},
+            want: []error{nil, nil, nil, nil, nil},
+        },
+        {
+            name: "reordered then duplicated",
+            seqs: []uint64{1, 4, 3, 3},
+            want: []error{nil, nil, nil, ErrReplayed},
+        },
+        {
+            name: "oldest still in window",
+            seqs: []uint64{100, 100 - ReplayWindowSize + 1},
+            want: []error{nil, nil},
+        },
+        {
+            name: "just out of window",
+            seqs: []uint64{100, 100 - ReplayWindowSize},
+            want: []error{nil, ErrOutOfWindow},
+        },
+        {
+            name: "jump past window forgets old frames",
+            seqs: []uint64{1, 2, 2 + ReplayWindowSize, 2},
+            want: []error{nil, nil, nil, ErrOutOfWindow},
+        },
+        {
+            name: "slide keeps frames still in window",
+            seqs: []uint64{10, 20, 10, 15},
+            want: []error{nil, nil, ErrReplayed, nil},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var w ReplayWindow
+            for i, seq := range tt.seqs {
+                if err := w.Accept(seq); !errors.Is(err, tt.want[i]) {
+                    t.Fatalf("Accept(%d) (frame %d) = %v, want %v", seq, i, err, tt.want[i])
+                }
+            }
+        })
+    }
+}
@@ -14,6 +14,8 @@ var (
     publicKeyPEM string
 )
 
+// InitializeRSA generates the key for the legacy RSA key transport. It is
+// not persisted: clients authenticate it through the signed init message.
 func InitializeRSA() error {
     key, err := rsa.GenerateKey(rand.Reader, 2048)
     if err != nil {
@@ -34,6 +36,14 @@ func InitializeRSA() error {
     return nil
 }
 
+// IsInitialized reports whether InitializeRSA has generated the legacy key
+// transport key and LoadIdentity has loaded an identity key.
+func IsInitialized() bool {
+    identityKeys.mutex.RLock()
+    defer identityKeys.mutex.RUnlock()
+    return privateKey != nil && len(identityKeys.keys) > 0
+}
+
 func GetPublicKeyPEM() string {
     return publicKeyPEM
 }
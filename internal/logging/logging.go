@@ -0,0 +1,108 @@
+// Package logging configures the process-wide log/slog logger and provides
+// rate limiting for log lines on hot paths.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var level = new(slog.LevelVar)
+
+// Setup installs a slog handler writing to stderr in the given format as the
+// default logger. Messages from the standard log package go through it too.
+func Setup(levelName, format string) error {
+	return SetupWriter(os.Stderr, levelName, format)
+}
+
+func SetupWriter(w io.Writer, levelName, format string) error {
+	if err := SetLevel(levelName); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format {
+	case FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLevel changes the minimum level of the default logger at runtime.
+func SetLevel(levelName string) error {
+	parsed, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	level.Set(parsed)
+	return nil
+}
+
+// ParseLevel accepts debug, info, warn and error, case-insensitively.
+func ParseLevel(levelName string) (slog.Level, error) {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(strings.ToLower(levelName))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", levelName)
+	}
+	return parsed, nil
+}
+
+// Limiter lets at most one log line through per interval and counts the
+// lines it suppressed in between. The zero value is not usable; use Every.
+type Limiter struct {
+	interval   time.Duration
+	mutex      sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func Every(interval time.Duration) *Limiter {
+	return &Limiter{interval: interval}
+}
+
+// Allow reports whether a line may be logged now and, if so, how many were
+// suppressed since the last one.
+func (l *Limiter) Allow() (bool, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.last) < l.interval {
+		l.suppressed++
+		return false, 0
+	}
+	suppressed := l.suppressed
+	l.last, l.suppressed = now, 0
+	return true, suppressed
+}
+
+// Log writes the record through logger if the limiter allows it, adding a
+// "suppressed" attribute when earlier lines were dropped.
+func (l *Limiter) Log(logger *slog.Logger, lvl slog.Level, msg string, args ...any) {
+	ok, suppressed := l.Allow()
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	logger.Log(context.Background(), lvl, msg, args...)
+}
@@ -3,39 +3,43 @@ package media
 import (
     "fmt"
     "io"
-    "log"
+    "log/slog"
     "os"
     "os/exec"
+    "strconv"
+    "strings"
+
+    "VR-Distributed/internal/config"
 )
 
 func CreateVideoStream(mediaFile string) (io.ReadCloser, func(), error) {
     // Check if file exists
-    log.Printf("Checking if file exists")
     if _, err := os.Stat(mediaFile); os.IsNotExist(err) {
-        log.Printf("File does not exist")
         return nil, nil, fmt.Errorf("media file does not exist: %s", mediaFile)
     }
     
-    log.Printf("Creating video stream")
+    slog.Debug("Creating video stream", "path", mediaFile)
+    cfg := config.Current().Media
+    keyint := strconv.Itoa(cfg.KeyframeInterval)
     // Use FFmpeg to read the file and output raw video data
-    ffmpegCmd := exec.Command("ffmpeg",
+    ffmpegCmd := exec.Command(cfg.FFmpegPath,
         "-re",
         "-i", mediaFile,
         "-c:v", "libx264",
-        "-preset", "veryfast",
+        "-preset", cfg.VideoOnlyPreset,
         "-tune", "zerolatency",
         "-pix_fmt", "yuv420p",
-        "-g", "30",
-        "-keyint_min", "30",
+        "-g", keyint,
+        "-keyint_min", keyint,
         "-sc_threshold", "0",
-        "-b:v", "4M",       // increased
-        "-maxrate", "8M",
-        "-bufsize", "10M",
+        "-b:v", cfg.VideoOnlyBitrate,
+        "-maxrate", cfg.VideoOnlyMaxRate,
+        "-bufsize", cfg.VideoOnlyBufSize,
         "-f", "h264",
         "pipe:1",
     )
 
-    log.Printf("Running ffmpeg")
+    slog.Debug("Running ffmpeg", "args", ffmpegCmd.Args)
     // Get stdout pipe for video data
     videoOut, err := ffmpegCmd.StdoutPipe()
     if err != nil {
@@ -50,10 +54,10 @@ func CreateVideoStream(mediaFile string) (io.ReadCloser, func(), error) {
     // Create a cleanup function
     cleanup := func() {
         if err := ffmpegCmd.Process.Kill(); err != nil {
-            log.Printf("Error killing FFmpeg process: %v", err)
+            slog.Warn("Error killing FFmpeg process", "error", err)
         }
         if err := ffmpegCmd.Wait(); err != nil {
-            log.Printf("FFmpeg finished with error: %v", err)
+            slog.Debug("FFmpeg finished with error", "error", err)
         }
     }
     return videoOut, cleanup, nil
@@ -64,7 +68,7 @@ func CreateAudioStream(mediaFile string) (io.ReadCloser, func(), error) {
         return nil, nil, fmt.Errorf("media file does not exist: %s", mediaFile)
     }
 
-    cmd := exec.Command("ffmpeg",
+    cmd := exec.Command(config.Current().Media.FFmpegPath,
         "-re",
         "-i", mediaFile,
         "-vn",
@@ -92,7 +96,7 @@ func CreateAudioStream(mediaFile string) (io.ReadCloser, func(), error) {
         _ = cmd.Process.Kill()
         _ = cmd.Wait()
     }
-    log.Printf("Finished encoding audio")
+    slog.Debug("Started ffmpeg audio encoding", "path", mediaFile)
     return audioOut, cleanup, nil
 }
 
@@ -108,28 +112,30 @@ func CreateMediaStreams(mediaFile string) (videoOut, audioOut io.ReadCloser, cle
         return nil, nil, nil, fmt.Errorf("failed to create audio pipe: %w", err)
     }
 
-    cmd := exec.Command("ffmpeg",
+    cfg := config.Current().Media
+    keyint := strconv.Itoa(cfg.KeyframeInterval)
+    cmd := exec.Command(cfg.FFmpegPath,
         "-re",
         "-i", mediaFile,
         "-c:v", "libx264",
-        "-preset", "ultrafast",
+        "-preset", cfg.VideoPreset,
         "-tune", "zerolatency",
         "-pix_fmt", "yuv420p",
         "-profile:v", "baseline",
         "-level", "3.1",
-        "-g", "30",
-        "-keyint_min", "30",
+        "-g", keyint,
+        "-keyint_min", keyint,
         "-sc_threshold", "0",
-        "-b:v", "1M",
-        "-maxrate", "1M",
-        "-bufsize", "2M",
+        "-b:v", cfg.VideoBitrate,
+        "-maxrate", cfg.VideoMaxRate,
+        "-bufsize", cfg.VideoBufSize,
         "-f", "h264",
         "pipe:1", // stdout for video
 
         "-c:a", "libopus",
         "-ar", "48000",
         "-ac", "2",
-        "-b:a", "128k",
+        "-b:a", cfg.AudioBitrate,
         "-f", "opus",
         "pipe:2", // fd 3 in Go
     )
@@ -164,7 +170,7 @@ func ValidateMediaFile(mediaFile string) error {
     }
     
     // Check both video and audio streams
-    ffprobeCmd := exec.Command("ffprobe",
+    ffprobeCmd := exec.Command(config.Current().Media.FFprobePath,
         "-v", "error",
         "-show_entries", "stream=codec_type",
         "-of", "csv=p=0",
@@ -176,6 +182,6 @@ func ValidateMediaFile(mediaFile string) error {
         return fmt.Errorf("failed to probe media file: %w", err)
     }
     
-    log.Printf("Media streams found: %s", string(output))
+    slog.Info("Media streams found", "path", mediaFile, "streams", strings.Fields(string(output)))
     return nil
 }
\ No newline at end of file
@@ -0,0 +1,19 @@
+package media
+
+import (
+	"VR-Distributed/internal/metrics"
+)
+
+var (
+	framesRead = metrics.NewCounter("vr_frames_read_total",
+		"Frames read from VR process stdout.")
+	framesWritten = metrics.NewCounter("vr_frames_written_total",
+		"Frames written to WebRTC video tracks.")
+	framesInvalidMagic = metrics.NewCounter("vr_frames_invalid_magic_total",
+		"Frame headers from the VR process with an invalid magic number.")
+	opusEncodeErrors = metrics.NewCounter("vr_opus_encode_errors_total",
+		"PCM frames the Opus encoder failed to encode.")
+	frameSize = metrics.NewHistogram("vr_frame_size_bytes",
+		"Size of frames read from the VR process.",
+		metrics.ExponentialBuckets(1024, 4, 8))
+)
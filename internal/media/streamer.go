@@ -1,13 +1,16 @@
 package media
 
 import (
-	"VR-Distributed/internal/shared"
+	"VR-Distributed/internal/config"
+	"VR-Distributed/internal/logging"
+	"VR-Distributed/internal/session"
 	"VR-Distributed/internal/webrtc"
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -31,9 +34,6 @@ type FrameHeader struct {
 	PixelFormat uint32
 }
 
-var handWriter = &shared.SharedMemoryWriter{}
-var isrunning bool = true
-
 func parseHeader(data []byte) (*FrameHeader, error) {
 	if len(data) < 24 {
 		return nil, fmt.Errorf("invalid header length")
@@ -56,21 +56,75 @@ type StreamerInterface interface {
 	GetPausedMutex() *sync.RWMutex
 	GetStreamingMutex() *sync.RWMutex
 	SendError(string)
+	GetSession() *session.Session
 	webrtc.MediaInterface
 }
 
 type VRProcess struct {
 	Cmd    *exec.Cmd
+	Stdin  io.WriteCloser
 	Stdout io.ReadCloser
 	Stderr io.ReadCloser
+	AudioCmd *exec.Cmd
 	AudioOut io.ReadCloser
 	AudioErr io.ReadCloser
+
+	done   chan struct{} // closed once Cmd has exited
+	logger *slog.Logger
+}
+
+// Stop asks the VR process to exit by closing its stdin and interrupting it,
+// waits up to grace for it to do so and then kills it along with its audio
+// capture, and closes its output pipes. It is safe to call more than once.
+func (vr *VRProcess) Stop(grace time.Duration) error {
+	if vr.Stdin != nil {
+		vr.Stdin.Close()
+	}
+	if vr.done != nil {
+		// Interrupt is not supported on Windows; the kill below covers it
+		vr.Cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-vr.done:
+		case <-time.After(grace):
+			vr.logger.Warn("VR process did not exit in time, killing it", "grace", grace)
+		}
+	}
+
+	var err error
+	for _, cmd := range []*exec.Cmd{vr.Cmd, vr.AudioCmd} {
+		if cmd == nil || cmd.Process == nil {
+			continue
+		}
+		if kerr := cmd.Process.Kill(); kerr != nil && !errors.Is(kerr, os.ErrProcessDone) && err == nil {
+			err = kerr
+		}
+	}
+	if vr.AudioCmd != nil && vr.AudioCmd.Process != nil {
+		vr.AudioCmd.Wait()
+	}
+	if vr.done != nil {
+		for _, pipe := range []io.ReadCloser{vr.Stdout, vr.Stderr} {
+			if pipe != nil {
+				pipe.Close()
+			}
+		}
+	}
+	return err
+}
+
+// cleanupProcess adapts the cleanup funcs returned by the ffmpeg helpers to
+// session.Process.
+type cleanupProcess func()
+
+func (cleanup cleanupProcess) Stop(grace time.Duration) error {
+	cleanup()
+	return nil
 }
 
 func StartStreaming(client StreamerInterface, filePath string) error {
-	log.Printf("Starting video streaming")
+	client.Logger().Info("Starting streaming", "path", filePath)
 	if client.IsStreaming() {
-		log.Printf("Already streaming")
+		client.Logger().Warn("Already streaming")
 		return fmt.Errorf("already streaming")
 	}
 	// client.SetStreaming(true)
@@ -91,7 +145,7 @@ func StartStreaming(client StreamerInterface, filePath string) error {
 	case ".mp4", ".mkv", ".webp": // add more if you want to
 		// Start Video and Audio streaming
 		go func() {
-			log.Println("got to case")
+			client.Logger().Debug("Streaming video file with audio")
 			defer func() {
 				client.SetStreaming(false)
 			}()
@@ -106,7 +160,7 @@ func StartStreaming(client StreamerInterface, filePath string) error {
 		    }()
 
 		    if err := StreamVideoFile(client, filePath); err != nil {
-		        log.Printf("Error streaming video: %v", err)
+		        client.Logger().Error("Error streaming video", "error", err)
 		        client.SendError(fmt.Sprintf("Failed to stream video: %v", err))
 		    }
 		}()*/
@@ -122,20 +176,18 @@ func StartStreaming(client StreamerInterface, filePath string) error {
 			}
 		}()
 	}
-	log.Printf("Done start_vr")
+	client.Logger().Debug("Done start_vr")
 	return nil
 }
 
+// StopStreaming flags the client's stream as stopped; the streaming loops
+// exit on their next frame. SetStreaming takes the streaming mutex itself.
 func StopStreaming(client StreamerInterface) {
-	mutex := client.GetStreamingMutex()
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	client.SetStreaming(false)
 }
 
 func StartStreamingFromVR(client StreamerInterface, exePath, room string) error {
-	log.Println("Starting VR streaming")
+	client.Logger().Info("Starting VR streaming", "path", exePath)
 
 	if client.IsStreaming() {
 		return fmt.Errorf("already streaming")
@@ -153,19 +205,19 @@ func StartStreamingFromVR(client StreamerInterface, exePath, room string) error
 			client.SendError(fmt.Sprintf("Failed to start VR process: %v", err))
 			return
 		}
-		defer vr.Cmd.Process.Kill()
+		defer client.GetSession().StopProcess(time.Duration(config.Current().Shutdown.ProcessGrace))
 
 		if err := StreamVRVideo(client, vr); err != nil {
 			client.SendError(fmt.Sprintf("VR streaming error: %v", err))
 		}
 	}()
 	/*go func() {
-		log.Println("Starting Mediapipe process")
+		client.Logger().Info("Starting Mediapipe process")
 		//start mediapipe process
-		mediapipe, err := StartMediapipeProcess(room)
+		mediapipe, err := StartMediapipeProcess(client, room)
 		if err != nil {
 			client.SendError(fmt.Sprintf("Failed to start Mediapipe process: %v", err))
-			log.Printf("Failed to start Mediapipe process: %v", err)
+			client.Logger().Error("Failed to start Mediapipe process", "error", err)
 			return
 		}
 		defer mediapipe.Cmd.Process.Kill()
@@ -173,9 +225,10 @@ func StartStreamingFromVR(client StreamerInterface, exePath, room string) error
 
 	return nil
 }
-func StartMediapipeProcess(room string) (*VRProcess, error) {
+func StartMediapipeProcess(client StreamerInterface, room string) (*VRProcess, error) {
 	dir, _ := os.Getwd()
-	log.Printf("[MEDIAPIPE]Starting Mediapipe process in directory: %s", dir)
+	logger := client.Logger().With("process", "mediapipe")
+	logger.Info("Starting Mediapipe process", "dir", dir)
 	mediapipe := exec.Command(".venv/Scripts/python.exe", "-u", "./execs/Mediapipe.py", "--room", room)
 	//venv := filepath.Join(dir, ".venv", "Scripts")
 
@@ -185,7 +238,7 @@ func StartMediapipeProcess(room string) (*VRProcess, error) {
 	// 	fmt.Sprintf("PATH=%s", filepath.Join(dir, ".venv", "Scripts")),
 	// )
 
-	log.Printf("[MediapipeProcess] Process env: %s", mediapipe.Env)
+	logger.Debug("Mediapipe process env", "env", mediapipe.Env)
 	stdoutm, err := mediapipe.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -199,27 +252,27 @@ func StartMediapipeProcess(room string) (*VRProcess, error) {
 	if err := mediapipe.Start(); err != nil {
 		return nil, err
 	}
-	log.Printf("[MediapipeProcess] Started process: %s", mediapipe.Path)
+	logger.Info("Started Mediapipe process", "path", mediapipe.Path)
 	// Test Python executable first
 	testCmd := exec.Command(".venv/Scripts/python.exe", "-m", "pip", "list")
 	testCmd.Dir = dir
 	if output, err := testCmd.CombinedOutput(); err != nil {
-		log.Printf("[MEDIAPIPE ERROR] Python test failed: %v, output: %s", err, string(output))
+		logger.Error("Python test failed", "error", err, "output", string(output))
 		return nil, fmt.Errorf("python test failed: %v", err)
 	} else {
-		log.Printf("[MEDIAPIPE] Python test successful: %s", string(output))
+		logger.Debug("Python test successful", "output", string(output))
 	}
 
 	go func() {
-		log.Printf("[MediapipeProcess] Started reading")
+		logger.Debug("Started reading Mediapipe stdout")
 		scanner := bufio.NewScanner(stdoutm)
 		for scanner.Scan() {
 			line := scanner.Text()
-			log.Printf("[MediapipeProcess STDOUT] %s\n", line)
-			handWriter.WriteStdin([]byte(line+"\n"), isrunning, 1)
+			logger.Debug("Mediapipe stdout", "line", line)
+			client.GetSession().WriteHand([]byte(line + "\n"))
 		}
 		if err := scanner.Err(); err != nil {
-			log.Printf("Mediapipe stdout read error: %v", err)
+			logger.Warn("Mediapipe stdout read error", "error", err)
 		}
 	}()
 	go func() {
@@ -229,11 +282,11 @@ func StartMediapipeProcess(room string) (*VRProcess, error) {
 			if err != nil {
 				break
 			}
-			log.Printf("[MediapipeProcess STDOUT] %s", string(buf[:n]))
+			logger.Debug("Mediapipe stdout", "output", string(buf[:n]))
 		}
 	}()
 
-	return &VRProcess{Cmd: mediapipe, Stdout: stdoutm, Stderr: stderrm}, nil
+	return &VRProcess{Cmd: mediapipe, Stdout: stdoutm, Stderr: stderrm, logger: logger}, nil
 
 }
 func StartVRProcess(client StreamerInterface, exePath, room string) (*VRProcess, error) {
@@ -243,8 +296,8 @@ func StartVRProcess(client StreamerInterface, exePath, room string) (*VRProcess,
 	if err != nil {
 		return nil, err
 	}
-	log.Println("VR stdin pipe created")
-	shared.InitSharedStdin(stdin) // Store the stdin for gyro data
+	logger := client.Logger().With("process", "vr")
+	logger.Debug("VR stdin pipe created")
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -259,12 +312,21 @@ func StartVRProcess(client StreamerInterface, exePath, room string) (*VRProcess,
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
-	log.Printf("[VRProcess] Started process: %s", exePath)
+	logger.Info("Started VR process", "path", exePath, "pid", cmd.Process.Pid)
+	vr := &VRProcess{Cmd: cmd, Stdin: stdin, Stdout: stdout, Stderr: stderr, done: make(chan struct{}), logger: logger}
+	// cmd.Wait would close stdout as soon as the process exits, dropping the
+	// frames StreamVRVideo has not read yet, so only the process is reaped
+	// here and Stop closes the pipes
+	go func() {
+		cmd.Process.Wait()
+		close(vr.done)
+	}()
 
 	// 🎧 Start FFmpeg audio capture from VAC
-	audioCmd := exec.Command("ffmpeg",
-	    "-f", "dshow",
-	    "-i", "audio=CABLE Output (VB-Audio Virtual Cable)",
+	mediaCfg := config.Current().Media
+	audioCmd := exec.Command(mediaCfg.FFmpegPath,
+	    "-f", mediaCfg.AudioCaptureFormat,
+	    "-i", mediaCfg.AudioCaptureDevice,
 	    "-ar", "48000",
 	    "-ac", "2",
 	    "-flags", "low_delay",
@@ -280,19 +342,30 @@ func StartVRProcess(client StreamerInterface, exePath, room string) (*VRProcess,
 
 	audioOut, err := audioCmd.StdoutPipe()
 	if err != nil {
+		vr.Stop(0)
 		return nil, err
 	}
 
 	audioErr, err := audioCmd.StderrPipe()
 	if err != nil {
+		vr.Stop(0)
 		return nil, err
 	}
 
 	if err := audioCmd.Start(); err != nil {
+		vr.Stop(0)
 		return nil, err
 	}
+	vr.AudioCmd = audioCmd
+	vr.AudioOut = audioOut
+	vr.AudioErr = audioErr
+
+	// Route this client's gyro/hand data into its own VR process
+	sess := client.GetSession()
+	sess.AttachStdin(stdin)
+	sess.AttachProcess(vr)
 
-	log.Println("[AudioCapture] FFmpeg started with VAC input")
+	logger.Info("FFmpeg audio capture started", "device", mediaCfg.AudioCaptureDevice)
 	go func() {
 	    buf := make([]byte, 1024)
 	    for {
@@ -300,7 +373,7 @@ func StartVRProcess(client StreamerInterface, exePath, room string) (*VRProcess,
 	        if err != nil {
 	            break
 	        }
-	        log.Printf("[FFmpeg Audio STDERR] %s", string(buf[:n]))
+	        logger.Debug("FFmpeg audio stderr", "output", string(buf[:n]))
 	    }
 	}()
 
@@ -312,17 +385,11 @@ func StartVRProcess(client StreamerInterface, exePath, room string) (*VRProcess,
 			if err != nil {
 				break
 			}
-			log.Printf("[VRProcess STDERR] %s", string(buf[:n]))
+			logger.Info("VR process stderr", "output", string(buf[:n]))
 		}
 	}()
 
-	return &VRProcess{
-		Cmd:      cmd,
-		Stdout:   stdout,
-		Stderr:   stderr,
-		AudioOut: audioOut,
-		AudioErr: audioErr,
-	}, nil
+	return vr, nil
 }
 
 // FrameHeaderSize must match exactly how many bytes your Python FrameHeader uses
@@ -332,15 +399,17 @@ func StartVRProcess(client StreamerInterface, exePath, room string) (*VRProcess,
 // var lastLogTime = time.Now()
 
 func StreamVRVideo(client StreamerInterface, vr *VRProcess) error {
-	log.Println("Starting VR video and audio streaming")
+	client.Logger().Info("Starting VR video and audio streaming")
 
 	r := vr.Stdout
 	a := vr.AudioOut
 	headerBuf := make([]byte, headerSize)
+	invalidMagicLog := logging.Every(5 * time.Second)
 
 	client.SetStreaming(true)
 
 	// Start audio goroutine
+	opusBitrate := config.Current().Media.OpusBitrate
 	go func() {
 	    const (
 	        sampleRate    = 48000
@@ -352,14 +421,15 @@ func StreamVRVideo(client StreamerInterface, vr *VRProcess) error {
 
 	    encoder, err := gopus.NewEncoder(sampleRate, channels, gopus.Audio)
 	    if err != nil {
-	        log.Printf("Failed to create Opus encoder: %v", err)
+	        client.Logger().Error("Failed to create Opus encoder", "error", err)
 	        client.SendError("Opus encoder init failed")
 	        return
 	    }
 
 	    // Optional encoder tuning
-	    encoder.SetBitrate(64000)
+	    encoder.SetBitrate(opusBitrate)
 	    encoder.SetApplication(gopus.Audio)
+	    opusErrorLog := logging.Every(5 * time.Second)
 	    rawBuf := make([]byte, pcmBytes)
 	    pcmBuf := make([]int16, frameSize*channels)
 
@@ -370,7 +440,7 @@ func StreamVRVideo(client StreamerInterface, vr *VRProcess) error {
 	        _, err := io.ReadFull(a, rawBuf)
 	        if err != nil {
 	            if err != io.EOF {
-	                log.Printf("Audio read failed: %v", err)
+	                client.Logger().Warn("Audio read failed", "error", err)
 	            }
 	            break
 	        }
@@ -383,18 +453,19 @@ func StreamVRVideo(client StreamerInterface, vr *VRProcess) error {
 	        // Encode using the correct maxDataBytes
 	        encodedPkt, err := encoder.Encode(pcmBuf, frameSize, maxDataBytes)
 	        if err != nil {
-	            log.Printf("Opus encoding error: %v", err)
+	            opusEncodeErrors.Inc()
+	            opusErrorLog.Log(client.Logger(), slog.LevelWarn, "Opus encoding error", "error", err)
 	            continue
 	        }
 
 	        err = webrtc.WriteAudioSample(client, encodedPkt, 10)
 	        if err != nil {
-	            log.Printf("Failed to write audio sample: %v", err)
+	            client.Logger().Warn("Failed to write audio sample", "error", err)
 	            break
 	        }
 	    }
 
-	    log.Println("Audio stream ended")
+	    client.Logger().Info("Audio stream ended")
 	}()
 
 
@@ -409,7 +480,12 @@ func StreamVRVideo(client StreamerInterface, vr *VRProcess) error {
 		_, err := io.ReadFull(r, headerBuf)
 		if err != nil {
 			if err == io.EOF {
-				log.Println("Video stream ended (EOF)")
+				client.Logger().Info("Video stream ended (EOF)")
+				break
+			}
+			// Stop closed the pipe while we were still reading
+			if errors.Is(err, os.ErrClosed) {
+				client.Logger().Info("Video stream stopped")
 				break
 			}
 			return fmt.Errorf("error reading video header: %w", err)
@@ -425,11 +501,12 @@ func StreamVRVideo(client StreamerInterface, vr *VRProcess) error {
 		}
 
 		if header.Magic != magicNumber {
-			log.Printf("Invalid magic number: %x", header.Magic)
+			framesInvalidMagic.Inc()
+			invalidMagicLog.Log(client.Logger(), slog.LevelWarn, "Invalid magic number", "magic", fmt.Sprintf("%x", header.Magic))
 			continue
 		}
 		if header.FrameSize == 0 {
-			log.Println("Skipping empty frame")
+			client.Logger().Debug("Skipping empty frame")
 			continue
 		}
 
@@ -438,27 +515,30 @@ func StreamVRVideo(client StreamerInterface, vr *VRProcess) error {
 		if err != nil {
 			return fmt.Errorf("error reading frame data: %w", err)
 		}
+		framesRead.Inc()
+		frameSize.Observe(float64(header.FrameSize))
 		if header.PixelFormat == 2 {
 			// Pass H.264 data directly to WebRTC
 			err = webrtc.WriteVideoSample(client, frameBuf, 5) // 5ms was used because it gave ~50-60 fps video stream without any hiccups 
 			if err != nil {
 				return fmt.Errorf("WebRTC write failed: %w", err)
 			}
+			framesWritten.Inc()
 		} else {
-			log.Printf("Unsupported pixel format: %d", header.PixelFormat)
+			client.Logger().Warn("Unsupported pixel format", "pixel_format", header.PixelFormat)
 		}
 		// FPS Logging
 		frameCount++
 		now := time.Now()
 		if now.Sub(lastLogTime) >= time.Second {
 			fps := frameCount
-			log.Printf("Pipe FPS: %d", fps)
+			client.Logger().Debug("Pipe FPS", "fps", fps)
 			frameCount = 0
 			lastLogTime = now
 		}
 	}
 
-	log.Println("Video stream ended")
+	client.Logger().Info("Video stream ended")
 	client.SetStreaming(false)
 	return nil
 }
@@ -479,13 +559,15 @@ func findAnnexBStartCode(buf []byte) int {
 }
 
 func StreamAudioFile(client StreamerInterface, mediaFile string) error {
-	log.Printf("Starting to stream audio file: %s", mediaFile)
+	client.Logger().Info("Starting to stream audio file", "path", mediaFile)
 
 	audioReader, cleanup, err := CreateAudioStream(mediaFile)
 	if err != nil {
 		return err
 	}
 	defer cleanup()
+	detach := client.GetSession().AttachProcess(cleanupProcess(cleanup))
+	defer detach()
 
 	buffer := make([]byte, 1024*32) // 4KB buffer for audio
 	for client.IsStreaming() {
@@ -495,7 +577,7 @@ func StreamAudioFile(client StreamerInterface, mediaFile string) error {
 		n, err := audioReader.Read(buffer)
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("End of audio stream reached")
+				client.Logger().Info("End of audio stream reached")
 				break
 			}
 			return fmt.Errorf("error reading audio data: %w", err)
@@ -511,29 +593,30 @@ func StreamAudioFile(client StreamerInterface, mediaFile string) error {
 }
 
 func StreamVideoWithAudio(client StreamerInterface, mediaFile string) error {
-	log.Println("Starting the stream")
+	client.Logger().Info("Starting the stream", "path", mediaFile)
 	videoReader, audioReader, cleanup, err := CreateMediaStreams(mediaFile)
 	if err != nil {
 		return err
 
 	}
 	if client.IsStreaming() {
+		cleanup()
 		return fmt.Errorf("already streaming")
 	}
 	client.SetStreaming(true)
 
 	defer cleanup()
+	detach := client.GetSession().AttachProcess(cleanupProcess(cleanup))
+	defer detach()
 	videoBuffer, audioBuffer := make([]byte, 1024*32), make([]byte, 1024*4)
 	for client.IsStreaming() {
 		if client.IsPaused() {
 	    		continue
 	    	}
-		log.Println("isStreaming was changed correctly")
 		nv, errv := videoReader.Read(videoBuffer)
-		log.Println("Reached videoReader")
 		if errv != nil {
 			if errv == io.EOF {
-				log.Printf("End of Video stream reached")
+				client.Logger().Info("End of video stream reached")
 				break
 			}
 			return fmt.Errorf("error reading video data: %w", errv)
@@ -543,12 +626,10 @@ func StreamVideoWithAudio(client StreamerInterface, mediaFile string) error {
 				return err
 			}
 		}
-		log.Println("Reached audio part")
 		na, erra := audioReader.Read(audioBuffer)
-		log.Println("Reached audioReader")
 		if erra != nil {
 			if erra == io.EOF {
-				log.Printf("End of Video stream reached")
+				client.Logger().Info("End of video stream reached")
 				break
 			}
 			return fmt.Errorf("error reading video data: %w", erra)
@@ -563,12 +644,14 @@ func StreamVideoWithAudio(client StreamerInterface, mediaFile string) error {
 }
 
 func StreamVideoFile(client StreamerInterface, mediaFile string) error {
-	log.Printf("Starting StreamVideoFile")
+	client.Logger().Info("Starting StreamVideoFile", "path", mediaFile)
 	videoReader, cleanup, err := CreateVideoStream(mediaFile)
 	if err != nil {
 		return err
 	}
 	defer cleanup()
+	detach := client.GetSession().AttachProcess(cleanupProcess(cleanup))
+	defer detach()
 
 	buf := make([]byte, 0, 65536)
 	tmp := make([]byte, 4096)
@@ -580,7 +663,7 @@ func StreamVideoFile(client StreamerInterface, mediaFile string) error {
 		n, err := videoReader.Read(tmp)
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("End of video stream reached")
+				client.Logger().Info("End of video stream reached")
 				break
 			}
 			return fmt.Errorf("error reading video data: %w", err)
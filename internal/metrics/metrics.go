@@ -0,0 +1,315 @@
+// Package metrics implements the small subset of Prometheus metric types the
+// server needs and renders them in the text exposition format, without
+// pulling in the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds every registered metric in registration order.
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+// Default is the registry the New* constructors register with.
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write renders all metrics in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) {
+	r.mutex.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mutex.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the Default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.Write(w)
+	})
+}
+
+// Counter is a monotonically increasing integer.
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+type counterMetric struct {
+	name, help string
+	counter    Counter
+}
+
+func NewCounter(name, help string) *Counter {
+	m := &counterMetric{name: name, help: help}
+	Default.register(m)
+	return &m.counter
+}
+
+func (m *counterMetric) write(w io.Writer) {
+	writeHeader(w, m.name, m.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", m.name, m.counter.Value())
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	name, help string
+	labels     []string
+	mutex      sync.RWMutex
+	counters   map[string]*Counter
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{name: name, help: help, labels: labels, counters: make(map[string]*Counter)}
+	Default.register(v)
+	return v
+}
+
+// WithLabelValues returns the counter for the given label values, which must
+// be passed in the order the labels were declared.
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	key := strings.Join(values, "\xff")
+	v.mutex.RLock()
+	counter, ok := v.counters[key]
+	v.mutex.RUnlock()
+	if ok {
+		return counter
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if counter, ok = v.counters[key]; !ok {
+		counter = &Counter{}
+		v.counters[key] = counter
+	}
+	return counter
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	for _, key := range sortedKeys(v.counters) {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, labelString(v.labels, strings.Split(key, "\xff")), v.counters[key].Value())
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	buckets []float64
+	mutex   sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *Histogram) writeSamples(w io.Writer, name string, labels, values []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	bucketLabels := append(append([]string{}, labels...), "le")
+	for i, bound := range h.buckets {
+		le := append(append([]string{}, values...), formatFloat(bound))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(bucketLabels, le), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(bucketLabels, append(append([]string{}, values...), "+Inf")), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labelString(labels, values), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labelString(labels, values), h.count)
+}
+
+type histogramMetric struct {
+	name, help string
+	histogram  *Histogram
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds,
+// which must be sorted in increasing order.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	m := &histogramMetric{name: name, help: help, histogram: newHistogram(buckets)}
+	Default.register(m)
+	return m.histogram
+}
+
+func (m *histogramMetric) write(w io.Writer) {
+	writeHeader(w, m.name, m.help, "histogram")
+	m.histogram.writeSamples(w, m.name, nil, nil)
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+	mutex      sync.RWMutex
+	histograms map[string]*Histogram
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{name: name, help: help, buckets: buckets, labels: labels, histograms: make(map[string]*Histogram)}
+	Default.register(v)
+	return v
+}
+
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	key := strings.Join(values, "\xff")
+	v.mutex.RLock()
+	histogram, ok := v.histograms[key]
+	v.mutex.RUnlock()
+	if ok {
+		return histogram
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if histogram, ok = v.histograms[key]; !ok {
+		histogram = newHistogram(v.buckets)
+		v.histograms[key] = histogram
+	}
+	return histogram
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	writeHeader(w, v.name, v.help, "histogram")
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	for _, key := range sortedKeys(v.histograms) {
+		v.histograms[key].writeSamples(w, v.name, v.labels, strings.Split(key, "\xff"))
+	}
+}
+
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn at scrape time.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+type gaugeVecFunc struct {
+	name, help, label string
+	fn                func() map[string]float64
+}
+
+// NewGaugeVecFunc registers a gauge with a single label whose values are
+// computed by fn at scrape time, keyed by label value. fn must only return
+// a bounded set of label values.
+func NewGaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	Default.register(&gaugeVecFunc{name: name, help: help, label: label, fn: fn})
+}
+
+func (g *gaugeVecFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	values := g.fn()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelString([]string{g.label}, []string{key}), formatFloat(values[key]))
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ExponentialBuckets returns count bucket bounds starting at start and
+// multiplying by factor each step.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
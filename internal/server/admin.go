@@ -0,0 +1,124 @@
+package server
+
+import (
+	"VR-Distributed/internal/websocket"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const adminAPIPrefix = "/admin/api/"
+
+// handleAdminAPI serves the admin REST API:
+//
+//	GET    /admin/api/rooms                                list rooms and their peers
+//	GET    /admin/api/rooms/{room}                         show one room
+//	DELETE /admin/api/rooms/{room}                         close the room
+//	DELETE /admin/api/rooms/{room}/peers/{peer}            kick the peer
+//	POST   /admin/api/rooms/{room}/peers/{peer}/pause      pause its stream
+//	POST   /admin/api/rooms/{room}/peers/{peer}/resume     resume its stream
+//	POST   /admin/api/rooms/{room}/peers/{peer}/stop       stop its stream
+//	GET    /admin/api/identity                             list the identity keys
+//	POST   /admin/api/identity/rotate                      rotate the identity key
+//
+// DELETE requests accept an optional {"reason": "..."} body that is shown to
+// the affected clients.
+func (s *Server) handleAdminAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminAPIPrefix), "/"), "/")
+	if parts[0] == "identity" && (len(parts) == 1 || len(parts) == 2 && parts[1] == "rotate") {
+		s.handleIdentity(w, r, len(parts) == 2)
+		return
+	}
+	if parts[0] != "rooms" {
+		writeAdminError(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, websocket.ListRooms())
+
+	case len(parts) == 2:
+		roomID := parts[1]
+		switch r.Method {
+		case http.MethodGet:
+			room, err := websocket.GetRoom(roomID)
+			if err != nil {
+				writeAdminResult(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, room)
+		case http.MethodDelete:
+			writeAdminResult(w, r, websocket.CloseRoom(roomID, readReason(r)))
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+
+	case len(parts) == 4 && parts[2] == "peers":
+		if !allowMethod(w, r, http.MethodDelete) {
+			return
+		}
+		writeAdminResult(w, r, websocket.KickPeer(parts[1], parts[3], readReason(r)))
+
+	case len(parts) == 5 && parts[2] == "peers":
+		action := map[string]func(roomID, peerID string) error{
+			"pause":  websocket.PauseStream,
+			"resume": websocket.ResumeStream,
+			"stop":   websocket.StopStream,
+		}[parts[4]]
+		if action == nil {
+			writeAdminError(w, http.StatusNotFound, "unknown action "+parts[4])
+			return
+		}
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		writeAdminResult(w, r, action(parts[1], parts[3]))
+
+	default:
+		writeAdminError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// readReason returns the optional reason from a JSON request body.
+func readReason(r *http.Request) string {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.Body != nil {
+		json.NewDecoder(http.MaxBytesReader(nil, r.Body, 4096)).Decode(&body)
+	}
+	return body.Reason
+}
+
+func writeAdminResult(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case err == nil:
+		slog.Info("Admin action", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case errors.Is(err, websocket.ErrNotFound):
+		writeAdminError(w, http.StatusNotFound, err.Error())
+	default:
+		slog.Warn("Admin action failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
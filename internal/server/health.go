@@ -0,0 +1,107 @@
+package server
+
+import (
+	"VR-Distributed/internal/config"
+	"VR-Distributed/internal/crypto"
+	"VR-Distributed/internal/webrtc"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+)
+
+// healthStatus is the body returned by /healthz and /readyz.
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// handleHealthz reports that the process is alive and serving HTTP.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// handleReadyz reports whether the server can accept new sessions: keys and
+// WebRTC are initialised, ffmpeg/ffprobe can be found and the media
+// directory is readable. It fails while the server is shutting down.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	cfg := config.Current()
+	checks := map[string]string{
+		"rsa_keys":  "ok",
+		"webrtc":    "ok",
+		"ffmpeg":    "ok",
+		"ffprobe":   "ok",
+		"media_dir": "ok",
+	}
+	ready := true
+	fail := func(check, reason string) {
+		checks[check] = reason
+		ready = false
+	}
+
+	if s.draining.Load() {
+		fail("shutdown", "server is shutting down")
+	}
+	if !crypto.IsInitialized() {
+		fail("rsa_keys", "RSA or identity keys not initialized")
+	}
+	if !webrtc.IsInitialized() {
+		fail("webrtc", "WebRTC API not initialized")
+	}
+	if _, err := exec.LookPath(cfg.Media.FFmpegPath); err != nil {
+		fail("ffmpeg", err.Error())
+	}
+	if _, err := exec.LookPath(cfg.Media.FFprobePath); err != nil {
+		fail("ffprobe", err.Error())
+	}
+	if _, err := os.ReadDir(cfg.MediaDir); err != nil {
+		fail("media_dir", err.Error())
+	}
+
+	status := healthStatus{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	if !ready {
+		status.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+// versionInfo is the body returned by /version.
+type versionInfo struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	info := versionInfo{GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info.Module = build.Main.Path
+		info.Version = build.Main.Version
+		info.GoVersion = build.GoVersion
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.time":
+				info.Time = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"VR-Distributed/internal/config"
+	"VR-Distributed/internal/crypto"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// identityCheckInterval is how often the identity key age is checked, so
+// changes to security.identity_rotation apply without a restart.
+const identityCheckInterval = time.Minute
+
+// IdentityKeyInfo is the admin view of an identity key.
+type IdentityKeyInfo struct {
+	KeyID       string    `json:"key_id"`
+	Fingerprint string    `json:"sha256"`
+	CreatedAt   time.Time `json:"created_at"`
+	Current     bool      `json:"current"`
+}
+
+// watchIdentityRotation rotates the identity key on the configured schedule
+// and retires previous keys once their overlap has passed.
+func (s *Server) watchIdentityRotation() {
+	go func() {
+		ticker := time.NewTicker(identityCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			security := config.Current().Security
+			rotated, err := crypto.RotateIdentityIfDue(time.Duration(security.IdentityRotation), time.Duration(security.IdentityOverlap))
+			if err != nil {
+				slog.Error("Identity key rotation failed", "error", err)
+				continue
+			}
+			if rotated {
+				logCurrentIdentity("Rotated server identity key")
+			}
+		}
+	}()
+}
+
+// handleIdentity serves GET /admin/api/identity, listing the keys signing
+// handshakes, and POST /admin/api/identity/rotate, rotating immediately.
+func (s *Server) handleIdentity(w http.ResponseWriter, r *http.Request, rotate bool) {
+	if rotate {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err := crypto.RotateIdentity(time.Duration(config.Current().Security.IdentityOverlap))
+		if err == nil {
+			logCurrentIdentity("Rotated server identity key by admin request")
+		}
+		writeAdminResult(w, r, err)
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	keys := crypto.IdentityKeys()
+	infos := make([]IdentityKeyInfo, len(keys))
+	for i, key := range keys {
+		infos[i] = IdentityKeyInfo{KeyID: key.ID, Fingerprint: key.Fingerprint, CreatedAt: key.CreatedAt, Current: i == 0}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func logCurrentIdentity(msg string) {
+	if keys := crypto.IdentityKeys(); len(keys) > 0 {
+		slog.Info(msg, "key_id", keys[0].ID, "sha256", keys[0].Fingerprint, "previous_keys", len(keys)-1)
+	}
+}
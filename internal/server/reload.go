@@ -0,0 +1,123 @@
+package server
+
+import (
+	"VR-Distributed/internal/config"
+	"VR-Distributed/internal/logging"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ReloadResult describes what a configuration reload changed.
+type ReloadResult struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+var reloadMutex sync.Mutex
+
+// Reload re-reads the configuration and applies every change that is safe
+// while clients are connected. Fields that need a restart keep their running
+// values and are reported in the result.
+func (s *Server) Reload() (*ReloadResult, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	next, err := config.Reload()
+	if err != nil {
+		return nil, err
+	}
+	if err := next.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	running := config.Current()
+	merged, restart := running.Reloaded(next)
+	result := &ReloadResult{
+		Changed:         append([]string{}, config.Diff(running, merged)...),
+		RestartRequired: append([]string{}, restart...),
+	}
+	config.Store(merged)
+	if err := logging.SetLevel(merged.Log.Level); err != nil {
+		slog.Error("Failed to apply log level", "error", err)
+	}
+
+	if len(result.Changed) > 0 {
+		slog.Info("Configuration reloaded", "applied", result.Changed)
+	} else {
+		slog.Info("Configuration reloaded, nothing changed")
+	}
+	if len(restart) > 0 {
+		slog.Warn("Configuration fields changed but require a restart", "fields", restart)
+	}
+	return result, nil
+}
+
+// watchReload reloads the configuration whenever the process receives SIGHUP.
+func (s *Server) watchReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			slog.Info("Received SIGHUP, reloading configuration")
+			if _, err := s.Reload(); err != nil {
+				slog.Error("Configuration reload failed, keeping current configuration", "error", err)
+			}
+		}
+	}()
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := s.Reload()
+	if err != nil {
+		slog.Error("Configuration reload failed, keeping current configuration", "error", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// requireAdmin guards admin endpoints with the configured bearer token, or
+// restricts them to loopback clients when no token is configured. With TLS
+// disabled the server runs behind a proxy whose requests all come from
+// loopback, so the token is required.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.Current()
+		token := cfg.Admin.Token
+		if token == "" && cfg.TLS.Mode == config.TLSModeDisabled {
+			http.Error(w, "admin.token is required when tls.mode is disabled", http.StatusForbidden)
+			return
+		}
+		if token == "" {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		} else {
+			// A bare token without the Bearer scheme is refused; the scheme
+			// itself is case-insensitive
+			scheme, given, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
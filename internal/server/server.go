@@ -1,24 +1,39 @@
 package server
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"VR-Distributed/internal/config"
+	"VR-Distributed/internal/metrics"
 	"VR-Distributed/internal/websocket"
 )
 
 type Server struct {
-	cfg *config.Config
+	cfg        *config.Config
+	httpServer *http.Server
+	draining   atomic.Bool
 }
 
 func New(cfg *config.Config) *Server {
 	return &Server{cfg: cfg}
 }
 
+// Start serves until the listener fails or the process receives SIGINT or
+// SIGTERM, in which case it drains all sessions and returns nil once the
+// shutdown has finished.
 func (s *Server) Start() error {
+	mux := http.NewServeMux()
+
 	// Serve static frontend files with proper MIME types
-	http.Handle("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch filepath.Ext(r.URL.Path) {
 		case ".css":
 			w.Header().Set("Content-Type", "text/css")
@@ -27,19 +42,101 @@ func (s *Server) Start() error {
 		case ".html":
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		}
-		http.StripPrefix("/static/", http.FileServer(http.Dir("static"))).ServeHTTP(w, r)
+		http.StripPrefix("/static/", http.FileServer(http.Dir(s.cfg.StaticDir))).ServeHTTP(w, r)
 	}))
 
-	http.HandleFunc("/video", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "static/stream.html")
+	mux.HandleFunc("/video", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(s.cfg.StaticDir, "stream.html"))
 	})
 
-	http.HandleFunc("/ws/webrtc/", websocket.HandleWebSocket)
+	mux.HandleFunc("/ws/webrtc/", websocket.HandleWebSocket)
+	mux.HandleFunc("/admin/reload", requireAdmin(s.handleReload))
+	mux.HandleFunc(adminAPIPrefix, requireAdmin(s.handleAdminAPI))
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/version", handleVersion)
+	mux.Handle("/metrics", metrics.Handler())
+
+	s.watchReload()
+	s.watchIdentityRotation()
+
+	s.httpServer = &http.Server{
+		Addr:    s.cfg.ServerAddress,
+		Handler: mux,
+	}
+
+	tlsCfg := s.cfg.TLS
+	if tlsCfg.Mode == config.TLSModeSelfSigned {
+		if err := ensureSelfSigned(tlsCfg.CertFile, tlsCfg.KeyFile); err != nil {
+			return err
+		}
+	}
+	if tlsCfg.Mode != config.TLSModeDisabled {
+		if fingerprint, err := certificateFingerprint(tlsCfg.CertFile); err == nil {
+			slog.Info("TLS certificate fingerprint", "sha256", fingerprint)
+		} else {
+			slog.Warn("Failed to compute TLS certificate fingerprint", "error", err)
+		}
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsCfg.Mode == config.TLSModeDisabled {
+			slog.Warn("Starting plain HTTP server, TLS must be terminated at a proxy", "addr", s.cfg.ServerAddress)
+			if s.cfg.Admin.Token == "" {
+				slog.Warn("Admin endpoints are disabled until admin.token is set")
+			}
+			serveErr <- s.httpServer.ListenAndServe()
+			return
+		}
+		slog.Info("Starting HTTPS server", "addr", s.cfg.ServerAddress)
+		serveErr <- s.httpServer.ListenAndServeTLS(tlsCfg.CertFile, tlsCfg.KeyFile)
+	}()
 
-	// Use HTTPS
-	certPath := "cert.pem"
-	keyPath := "key.pem"
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		slog.Info("Received signal, shutting down", "signal", sig.String())
+	}
+
+	// A second signal skips the drain
+	go func() {
+		sig := <-signals
+		slog.Warn("Received signal again, exiting immediately", "signal", sig.String())
+		os.Exit(1)
+	}()
+
+	timeout := time.Duration(config.Current().Shutdown.Timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+// Shutdown stops accepting connections, sends server_shutdown to every
+// client and closes their peer connections and VR processes. It gives up
+// when ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+
+	var errs []error
+	if s.httpServer != nil {
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := websocket.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
 
-	log.Printf("Starting HTTPS server on %s", s.cfg.ServerAddress)
-	return http.ListenAndServeTLS(s.cfg.ServerAddress, certPath, keyPath, nil)
+	if err := errors.Join(errs...); err != nil {
+		slog.Error("Shutdown did not complete cleanly", "error", err)
+		return err
+	}
+	slog.Info("Shutdown complete")
+	return nil
 }
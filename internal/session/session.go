@@ -0,0 +1,166 @@
+package session
+
+import (
+	"VR-Distributed/internal/shared"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Process is a child process owned by a session, such as the VR executable
+// together with its audio capture. Stop gives it up to grace to exit on its
+// own before killing it.
+type Process interface {
+	Stop(grace time.Duration) error
+}
+
+// Session holds everything a single headset drives on the server: its VR
+// process, the stdin sink feeding gyro/hand data into that process and the
+// shared-memory file backing it. Each websocket client owns exactly one.
+type Session struct {
+	id        string
+	mutex     sync.Mutex
+	writer    *shared.SharedMemoryWriter
+	processes []*attachedProcess
+	running   bool
+
+	// stdinMutex keeps lines written to the VR stdin whole. It is held
+	// during the pipe write, which blocks while the process is not reading,
+	// so it must never be taken while holding mutex.
+	stdinMutex sync.Mutex
+}
+
+// attachedProcess gives each attached process an identity of its own, so it
+// can be detached even when the Process itself is not comparable.
+type attachedProcess struct {
+	Process
+}
+
+func New() *Session {
+	return &Session{
+		id:      newID(),
+		writer:  &shared.SharedMemoryWriter{},
+		running: true,
+	}
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to generate session id: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Open maps the session's shared-memory file. Calling it again while the
+// file is mapped is a no-op.
+func (s *Session) Open(size int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.writer.IsOpen() {
+		return nil
+	}
+	return s.writer.NewSharedMemoryWriter(fmt.Sprintf("gyro_%s.dat", s.id), size)
+}
+
+// AttachStdin routes gyro and hand data written to this session into stdin.
+func (s *Session) AttachStdin(stdin io.WriteCloser) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.writer.InitSharedStdin(stdin)
+}
+
+// AttachProcess records a process started for this session so it is
+// stopped together with the session. Calling the returned detach func
+// forgets the process, for one that ends before the session does.
+func (s *Session) AttachProcess(process Process) (detach func()) {
+	attached := &attachedProcess{process}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.processes = append(s.processes, attached)
+
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.processes = slices.DeleteFunc(s.processes, func(p *attachedProcess) bool { return p == attached })
+	}
+}
+
+func (s *Session) IsRunning() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.running
+}
+
+func (s *Session) SetRunning(running bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.running = running
+}
+
+func (s *Session) WriteGyro(data interface{}) error {
+	return s.write(data, 0)
+}
+
+func (s *Session) WriteHand(data interface{}) error {
+	return s.write(data, 1)
+}
+
+// write sends data to the VR process stdin. The writer is copied under
+// mutex and written to after releasing it, so a process that stops reading
+// blocks its writers but not StopProcess or Close, whose stopping the
+// process fails the pending write.
+func (s *Session) write(data interface{}, datatype int) error {
+	s.mutex.Lock()
+	if !s.writer.IsOpen() {
+		s.mutex.Unlock()
+		return fmt.Errorf("session %s has no VR process", s.id)
+	}
+	writer, running := *s.writer, s.running
+	s.mutex.Unlock()
+
+	s.stdinMutex.Lock()
+	defer s.stdinMutex.Unlock()
+	return writer.WriteStdin(data, running, datatype)
+}
+
+// StopProcess stops the session's processes, if any, and detaches the VR
+// stdin. The shared-memory file stays mapped.
+func (s *Session) StopProcess(grace time.Duration) error {
+	s.mutex.Lock()
+	processes := s.processes
+	s.processes = nil
+	s.writer.InitSharedStdin(nil)
+	s.mutex.Unlock()
+
+	var err error
+	for _, process := range processes {
+		if perr := process.Stop(grace); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// Close stops the session's processes and removes the shared-memory file.
+func (s *Session) Close(grace time.Duration) error {
+	err := s.StopProcess(grace)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.writer.IsOpen() {
+		if cerr := s.writer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
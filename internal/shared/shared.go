@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 
@@ -12,24 +11,23 @@ import (
 )
 
 type SharedMemoryWriter struct {
-	file *os.File
-	data mmap.MMap
-	size int
+	file  *os.File
+	data  mmap.MMap
+	size  int
+	stdin io.WriteCloser
 }
 
-var shared_stdin io.WriteCloser
-
-func InitSharedStdin(stdin io.WriteCloser) {
-	shared_stdin = stdin
+// InitSharedStdin sets the VR process stdin this writer forwards data to.
+func (s *SharedMemoryWriter) InitSharedStdin(stdin io.WriteCloser) {
+	s.stdin = stdin
 }
 
-
-func WriteStdinGyroData(jsondat []byte, isrunning bool) error {
+func WriteStdinGyroData(stdin io.Writer, jsondat []byte, isrunning bool) error {
 	/*payload := map[string]interface{}{
 		"type":    "Gyro",
 		"payload": json.RawMessage(jsondat),
 	}*/
-	if shared_stdin == nil {
+	if stdin == nil {
 		return fmt.Errorf("gyro_stdin is not initialized")
 	}
 	// jsondat, errj := json.Marshal(payload)
@@ -37,9 +35,8 @@ func WriteStdinGyroData(jsondat []byte, isrunning bool) error {
 		return fmt.Errorf("failed to create payload")
 	} */
 	jsondat = append(jsondat, '\n') // Ensure newline for proper parsing
-	_, err := shared_stdin.Write(jsondat)
+	_, err := stdin.Write(jsondat)
 	if err != nil {
-		log.Printf("Failed to write gyro data to stdin: %v", err)
 		return fmt.Errorf("failed to write gyro data to stdin: %w", err)
 	}
 	//log.Printf("Wrote gyro data to stdin: %s", json)
@@ -81,12 +78,12 @@ in cpp this is handled by the file handdat_thread.cpp for more refference
 	  ]
 	}
 */
-func WriteStdinHandData(jsondat []byte, isrunning bool) error {
+func WriteStdinHandData(stdin io.Writer, jsondat []byte, isrunning bool) error {
 	payload := map[string]interface{}{
 		"type":    "Hand",
 		"payload": json.RawMessage(jsondat),
 	}
-	if shared_stdin == nil {
+	if stdin == nil {
 		return fmt.Errorf("mediapipe_stdin is not initialized")
 	}
 	jsondat, errj := json.Marshal(payload)
@@ -94,9 +91,8 @@ func WriteStdinHandData(jsondat []byte, isrunning bool) error {
 		return fmt.Errorf("failed to create payload")
 	}
 	jsondat = append(jsondat, '\n') // Ensure newline for proper parsing
-	_, err := shared_stdin.Write(jsondat)
+	_, err := stdin.Write(jsondat)
 	if err != nil {
-		log.Printf("Failed to write gyro data to stdin: %v", err)
 		return fmt.Errorf("failed to write gyro data to stdin: %w", err)
 	}
 	//log.Printf("Wrote hand data to stdin: %s", json)
@@ -113,6 +109,9 @@ func WriteStdinHandData(jsondat []byte, isrunning bool) error {
 func (sharedPointer *SharedMemoryWriter) NewSharedMemoryWriter(filename string, size int) error {
 	basePath, _ := os.Getwd()
 	fullPath := filepath.Join(basePath, "Shared", filename)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
 
 	// Ensure file exists and has the desired size
 	file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE, 0644)
@@ -131,9 +130,10 @@ func (sharedPointer *SharedMemoryWriter) NewSharedMemoryWriter(filename string,
 		return err
 	}
 	*sharedPointer = SharedMemoryWriter{
-		file: file,
-		data: data,
-		size: size,
+		file:  file,
+		data:  data,
+		size:  size,
+		stdin: sharedPointer.stdin,
 	}
 	return nil
 }
@@ -166,13 +166,13 @@ func (s *SharedMemoryWriter) WriteStdin(obj interface{}, isrunning bool, datatyp
 	jsonData = append(jsonData, '\n') // Ensure newline for proper parsing
 	switch datatype {
 	case 0: //case 0 for gyro
-		if err := WriteStdinGyroData(jsonData, isrunning); err != nil {
+		if err := WriteStdinGyroData(s.stdin, jsonData, isrunning); err != nil {
 			return fmt.Errorf("failed to write gyro data to stdin: %w", err)
 		}
 		return nil
 
 	case 1: //case 1 for hand data
-		if err := WriteStdinHandData(jsonData, isrunning); err != nil {
+		if err := WriteStdinHandData(s.stdin, jsonData, isrunning); err != nil {
 			return fmt.Errorf("failed to write hand data to stdin: %w", err)
 		}
 		return nil
@@ -182,11 +182,20 @@ func (s *SharedMemoryWriter) WriteStdin(obj interface{}, isrunning bool, datatyp
 	}
 }
 
+// IsOpen reports whether the shared-memory file is currently mapped.
+func (s *SharedMemoryWriter) IsOpen() bool {
+	return s.file != nil
+}
+
 func (s *SharedMemoryWriter) Close() error {
+	if s.file == nil {
+		return nil
+	}
 	if err := s.data.Unmap(); err != nil {
 		return err
 	}
 	err := s.file.Close()
 	os.Remove(s.file.Name())
+	s.file, s.data, s.size = nil, nil, 0
 	return err
 }
@@ -1,7 +1,7 @@
 package webrtc
 
 import (
-    "log"
+    "log/slog"
     "github.com/pion/webrtc/v3"
 )
 
@@ -41,6 +41,11 @@ func Initialize() error {
     }
     
     api = webrtc.NewAPI(webrtc.WithMediaEngine(mediaAPI))
-    log.Println("WebRTC codecs initialized successfully")
+    slog.Info("WebRTC codecs initialized successfully")
     return nil
 }
+
+// IsInitialized reports whether Initialize has set up the WebRTC API.
+func IsInitialized() bool {
+    return api != nil
+}
@@ -2,20 +2,28 @@ package webrtc
 
 import (
     "io"
-    "log"
+    "log/slog"
     "sync"
     "time"
     "fmt"
     "github.com/pion/webrtc/v3"
+    "VR-Distributed/internal/logging"
     "github.com/pion/webrtc/v3/pkg/media"
 )
 
+// sampleErrorLog rate limits sample write failures, which can happen on
+// every frame once a track breaks.
+var sampleErrorLog = logging.Every(5 * time.Second)
+
 type MediaInterface interface {
+    Logger() *slog.Logger
     GetVideoTrack() *webrtc.TrackLocalStaticSample
     GetAudioTrack() *webrtc.TrackLocalStaticSample
     IsStreaming() bool
     SetStreaming(bool)
     GetStreamingMutex() *sync.RWMutex
+    // Viewers returns the clients that get a copy of the client's samples.
+    Viewers() []MediaInterface
 }
 
 func WriteVideoSample(client MediaInterface, data []byte, duration time.Duration) error {
@@ -31,14 +39,20 @@ func WriteVideoSample(client MediaInterface, data []byte, duration time.Duration
         Duration: duration * time.Millisecond, 
     }
     
-    if err := videoTrack.WriteSample(sample); err != nil {
+    start := time.Now()
+    err := videoTrack.WriteSample(sample)
+    sampleWriteSeconds.WithLabelValues("video").Observe(time.Since(start).Seconds())
+    if err != nil {
         if err == io.ErrClosedPipe {
-            log.Printf("Video track closed, stopping stream")
+            client.Logger().Info("Video track closed, stopping stream")
             client.SetStreaming(false)
             return nil
         }
+        sampleErrorLog.Log(client.Logger(), slog.LevelWarn, "Failed to write video sample", "error", err)
         return fmt.Errorf("failed to write video sample: %w", err)
     }
+    trackBytesSent.WithLabelValues("video").Add(uint64(len(data)))
+    fanOut(client, "video", sample)
     
     return nil
 }
@@ -49,7 +63,6 @@ func WriteAudioSample(client MediaInterface, data []byte, duration time.Duration
     }
     audioTrack := client.GetAudioTrack()
     if audioTrack == nil {
-        log.Printf("audio track not available")
         return fmt.Errorf("audio track not available")
     }
     
@@ -58,14 +71,42 @@ func WriteAudioSample(client MediaInterface, data []byte, duration time.Duration
         Duration: duration * time.Millisecond, // 10ms audio frames
     }
     
-    if err := audioTrack.WriteSample(sample); err != nil {
+    start := time.Now()
+    err := audioTrack.WriteSample(sample)
+    sampleWriteSeconds.WithLabelValues("audio").Observe(time.Since(start).Seconds())
+    if err != nil {
         if err == io.ErrClosedPipe {
-            log.Printf("Audio track closed, stopping stream")
+            client.Logger().Info("Audio track closed, stopping stream")
             client.SetStreaming(false)
             return nil
         }
+        sampleErrorLog.Log(client.Logger(), slog.LevelWarn, "Failed to write audio sample", "error", err)
         return fmt.Errorf("failed to write audio sample: %w", err)
     }
+    trackBytesSent.WithLabelValues("audio").Add(uint64(len(data)))
+    fanOut(client, "audio", sample)
     
     return nil
+}
+
+// fanOut writes a sample the client streamed to the same kind of track of
+// each of its viewers. A viewer whose track fails is skipped; it does not
+// hold up the client's stream.
+func fanOut(client MediaInterface, kind string, sample media.Sample) {
+    for _, viewer := range client.Viewers() {
+        track := viewer.GetVideoTrack()
+        if kind == "audio" {
+            track = viewer.GetAudioTrack()
+        }
+        if track == nil {
+            continue
+        }
+        if err := track.WriteSample(sample); err != nil {
+            if err != io.ErrClosedPipe {
+                sampleErrorLog.Log(viewer.Logger(), slog.LevelWarn, "Failed to write viewer sample", "kind", kind, "error", err)
+            }
+            continue
+        }
+        trackBytesSent.WithLabelValues(kind).Add(uint64(len(sample.Data)))
+    }
 }
\ No newline at end of file
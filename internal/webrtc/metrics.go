@@ -0,0 +1,13 @@
+package webrtc
+
+import (
+    "VR-Distributed/internal/metrics"
+)
+
+var (
+    trackBytesSent = metrics.NewCounterVec("vr_track_bytes_sent_total",
+        "Bytes written to WebRTC tracks, by track kind.", "kind")
+    sampleWriteSeconds = metrics.NewHistogramVec("vr_sample_write_seconds",
+        "Time taken to write a sample to a WebRTC track, by track kind.",
+        metrics.ExponentialBuckets(0.0001, 4, 8), "kind")
+)
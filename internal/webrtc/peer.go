@@ -2,10 +2,11 @@ package webrtc
 
 import (
     "fmt"
-    "log"
+    "log/slog"
     "time"
 
     "github.com/pion/webrtc/v3"
+    "VR-Distributed/internal/config"
     "VR-Distributed/pkg/types"
 )
 
@@ -18,6 +19,7 @@ type PeerInterface interface {
     SetAudioTrack(*webrtc.TrackLocalStaticSample)
     SendMessage(types.Message) error
     GetPeerID() string
+    Logger() *slog.Logger
 }
 
 // Global or package-level MediaEngine to register codecs once
@@ -54,16 +56,23 @@ func GetAPI() *webrtc.API {
     return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine))
 }
 
-func SetupPeerConnection(client PeerInterface) error {
-    config := webrtc.Configuration{
-        ICEServers: []webrtc.ICEServer{
-            {
-                URLs: []string{"stun:stun.l.google.com:19302"},
-            },
-        },
+func iceServers(servers []config.ICEServer) []webrtc.ICEServer {
+    result := make([]webrtc.ICEServer, 0, len(servers))
+    for _, server := range servers {
+        iceServer := webrtc.ICEServer{URLs: server.URLs}
+        if server.Username != "" {
+            iceServer.Username = server.Username
+            iceServer.Credential = server.Credential
+        }
+        result = append(result, iceServer)
     }
+    return result
+}
 
-    peerConnection, err := GetAPI().NewPeerConnection(config)
+func SetupPeerConnection(client PeerInterface) error {
+    peerConnection, err := GetAPI().NewPeerConnection(webrtc.Configuration{
+        ICEServers: iceServers(config.Current().WebRTC.ICEServers),
+    })
     if err != nil {
         return fmt.Errorf("failed to create peer connection: %w", err)
     }
@@ -171,7 +180,7 @@ func SetupPeerConnection(client PeerInterface) error {
 
     // Set up connection state change handling
     peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-        log.Printf("Peer connection state changed: %s", state.String())
+        client.Logger().Info("Peer connection state changed", "state", state.String())
 
         if state == webrtc.PeerConnectionStateConnected {
             client.SendMessage(types.Message{
@@ -0,0 +1,214 @@
+package websocket
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/pkg/types"
+)
+
+// ErrNotFound is returned by the admin operations when the room or peer
+// does not exist.
+var ErrNotFound = errors.New("not found")
+
+// PeerInfo is the admin view of a connected client.
+type PeerInfo struct {
+    PeerID              string    `json:"peer_id"`
+    Name                string    `json:"name"`
+    Session             string    `json:"session"`
+    Roles               []string  `json:"roles"`
+    RoomRole            string    `json:"room_role"`
+    RemoteAddr          string    `json:"remote_addr"`
+    Streaming           bool      `json:"streaming"`
+    Paused              bool      `json:"paused"`
+    PeerConnectionState string    `json:"peer_connection_state"`
+    ConnectedSince      time.Time `json:"connected_since"`
+    Keyed               bool      `json:"keyed"`
+    ReplayRejected      uint64    `json:"replay_rejected"`
+    SendQueued          int       `json:"send_queued"`
+    LastPing            time.Time `json:"last_ping"`
+    RTTMillis           float64   `json:"rtt_ms"`
+    Latency             string    `json:"latency"`
+    Detached            bool      `json:"detached"`
+}
+
+// RoomInfo is the admin view of a room and its clients.
+type RoomInfo struct {
+    ID          string     `json:"id"`
+    Title       string     `json:"title"`
+    Owner       string     `json:"owner"`
+    CreatedAt   time.Time  `json:"created_at"`
+    HasPassword bool       `json:"has_password"`
+    Clients     []PeerInfo `json:"clients"`
+}
+
+func (c *Client) info() PeerInfo {
+    state := "none"
+    if pc := c.GetPeerConnection(); pc != nil {
+        state = pc.ConnectionState().String()
+    }
+    return PeerInfo{
+        PeerID:              c.peerID,
+        Name:                c.GetName(),
+        Session:             c.session.ID(),
+        Roles:               c.Roles(),
+        RoomRole:            c.RoomRole(),
+        RemoteAddr:          c.RemoteAddr(),
+        Streaming:           c.IsStreaming(),
+        Paused:              c.IsPaused(),
+        PeerConnectionState: state,
+        ConnectedSince:      c.connectedAt,
+        Keyed:               c.IsKeyed(),
+        ReplayRejected:      c.ReplayRejected(),
+        SendQueued:          c.sendQueue.Queued(),
+        LastPing:            c.LastPing(),
+        RTTMillis:           float64(c.RTT()) / float64(time.Millisecond),
+        Latency:             latencyClass(c.RTT()),
+        Detached:            c.IsDetached(),
+    }
+}
+
+func (r *Room) info() RoomInfo {
+    clients := r.Clients()
+    sort.Slice(clients, func(i, j int) bool { return clients[i].peerID < clients[j].peerID })
+
+    info := RoomInfo{
+        ID:          r.GetID(),
+        Title:       r.GetTitle(),
+        Owner:       r.GetOwner(),
+        CreatedAt:   r.GetCreatedAt(),
+        HasPassword: r.HasPassword(),
+        Clients:     make([]PeerInfo, 0, len(clients)),
+    }
+    for _, client := range clients {
+        info.Clients = append(info.Clients, client.info())
+    }
+    return info
+}
+
+// ListRooms returns every room with its clients, sorted by room ID.
+func ListRooms() []RoomInfo {
+    roomsMutex.RLock()
+    ids := make([]string, 0, len(rooms))
+    for id := range rooms {
+        ids = append(ids, id)
+    }
+    roomsMutex.RUnlock()
+    sort.Strings(ids)
+
+    infos := make([]RoomInfo, 0, len(ids))
+    for _, id := range ids {
+        if room := findRoom(id); room != nil {
+            infos = append(infos, room.info())
+        }
+    }
+    return infos
+}
+
+// GetRoom returns a single room with its clients.
+func GetRoom(roomID string) (RoomInfo, error) {
+    room := findRoom(roomID)
+    if room == nil {
+        return RoomInfo{}, fmt.Errorf("room %s: %w", roomID, ErrNotFound)
+    }
+    return room.info(), nil
+}
+
+// KickPeer tells the peer it was removed and disconnects it. Its stream,
+// peer connection and VR process are stopped as on a normal disconnect.
+func KickPeer(roomID, peerID, reason string) error {
+    client, err := findClient(roomID, peerID)
+    if err != nil {
+        return err
+    }
+    if reason == "" {
+        reason = "Removed by an administrator"
+    }
+    client.Logger().Info("Kicking peer", "reason", reason)
+    disconnect(client, types.Message{Type: "kicked", Message: reason}, websocket.ClosePolicyViolation)
+    return nil
+}
+
+// PauseStream pauses the peer's stream without stopping its VR process.
+func PauseStream(roomID, peerID string) error {
+    return setPaused(roomID, peerID, true)
+}
+
+// ResumeStream resumes a stream paused by PauseStream or by the client.
+func ResumeStream(roomID, peerID string) error {
+    return setPaused(roomID, peerID, false)
+}
+
+func setPaused(roomID, peerID string, paused bool) error {
+    client, err := findClient(roomID, peerID)
+    if err != nil {
+        return err
+    }
+    client.SetPaused(paused)
+    status := map[bool]string{true: "Stream paused by an administrator", false: "Stream resumed by an administrator"}[paused]
+    client.Logger().Info("Stream pause changed by admin", "paused", paused)
+    return client.SendMessage(types.Message{Type: "status", Message: status})
+}
+
+// StopStream stops the peer's stream as if it had sent stop_stream.
+func StopStream(roomID, peerID string) error {
+    client, err := findClient(roomID, peerID)
+    if err != nil {
+        return err
+    }
+    return handleStopStream(client)
+}
+
+// CloseRoom removes the room and disconnects all of its clients. A client
+// connecting to the same room ID afterwards gets a fresh room.
+func CloseRoom(roomID, reason string) error {
+    roomsMutex.Lock()
+    room, exists := rooms[roomID]
+    delete(rooms, roomID)
+    if exists {
+        room.markClosed()
+    }
+    roomsMutex.Unlock()
+    if !exists {
+        return fmt.Errorf("room %s: %w", roomID, ErrNotFound)
+    }
+
+    if reason == "" {
+        reason = "Room closed by an administrator"
+    }
+    clients := room.Clients()
+    for _, client := range clients {
+        disconnect(client, types.Message{Type: "room_closed", Message: reason}, websocket.CloseNormalClosure)
+    }
+    return nil
+}
+
+// disconnect sends msg to the client, then a close frame with code and the
+// message type as reason, and closes it. The read loop in HandleWebSocket,
+// or Close for a detached client, does the room cleanup.
+func disconnect(client *Client, msg types.Message, code int) {
+    client.SendMessage(msg)
+    client.sendClose(code, msg.Type)
+    client.Close()
+}
+
+func findRoom(roomID string) *Room {
+    roomsMutex.RLock()
+    defer roomsMutex.RUnlock()
+    return rooms[roomID]
+}
+
+func findClient(roomID, peerID string) (*Client, error) {
+    room := findRoom(roomID)
+    if room == nil {
+        return nil, fmt.Errorf("room %s: %w", roomID, ErrNotFound)
+    }
+    client, exists := room.GetClient(peerID)
+    if !exists {
+        return nil, fmt.Errorf("peer %s in room %s: %w", peerID, roomID, ErrNotFound)
+    }
+    return client, nil
+}
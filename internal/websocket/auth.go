@@ -0,0 +1,141 @@
+package websocket
+
+import (
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/internal/auth"
+    "VR-Distributed/internal/config"
+)
+
+// Browsers cannot set headers on a WebSocket request, so they offer the
+// token as a "bearer.<token>" subprotocol, the room password as a
+// "password.<base64url>" one and a resume token as "resume.<token>", next
+// to subprotocol, which is the one the server selects. Native clients send
+// the password and resume token in passwordHeader and resumeHeader.
+const (
+    subprotocol               = "vr-distributed"
+    tokenSubprotocolPrefix    = "bearer."
+    passwordSubprotocolPrefix = "password."
+    resumeSubprotocolPrefix   = "resume."
+    passwordHeader            = "X-Room-Password"
+    resumeHeader              = "X-Resume-Token"
+)
+
+// anonymousRoles are granted to every client when auth is disabled.
+var anonymousRoles = []string{auth.RoleHost, auth.RoleController}
+
+// identity is who a connection request authenticated as.
+type identity struct {
+    peerID string
+    roomID string
+    roles  []string
+}
+
+// authError rejects a connection request before the upgrade.
+type authError struct {
+    status int
+    err    error
+}
+
+func (e *authError) Error() string {
+    return e.err.Error()
+}
+
+func rejectAuth(status int, reason, format string, args ...interface{}) *authError {
+    authFailures.WithLabelValues(reason).Inc()
+    return &authError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// authenticate resolves the peer ID, room and roles of a connection request.
+// With auth.secret set the request must carry a valid token for the room,
+// and the peer ID is the token subject. Without it every client is
+// anonymous and picks its own peer ID.
+func authenticate(r *http.Request, cfg *config.Config) (identity, *authError) {
+    query := r.URL.Query()
+    id := identity{peerID: query.Get("peer_id"), roomID: query.Get("room"), roles: anonymousRoles}
+    if id.roomID == "" {
+        id.roomID = cfg.DefaultRoom
+    }
+
+    if cfg.Auth.Secret == "" {
+        if id.peerID == "" {
+            id.peerID = fmt.Sprintf("peer_%d", time.Now().UnixNano())
+        }
+        return id, nil
+    }
+
+    token := requestToken(r)
+    if token == "" {
+        return id, rejectAuth(http.StatusUnauthorized, "missing", "no token in request")
+    }
+    claims, err := auth.Verify(token, []byte(cfg.Auth.Secret), time.Now())
+    if err != nil {
+        reason := "invalid"
+        switch {
+        case errors.Is(err, auth.ErrExpired):
+            reason = "expired"
+        case errors.Is(err, auth.ErrNotYetValid):
+            reason = "not_yet_valid"
+        }
+        return id, rejectAuth(http.StatusUnauthorized, reason, "%v", err)
+    }
+    if id.peerID != "" && id.peerID != claims.Subject {
+        return id, rejectAuth(http.StatusForbidden, "peer_mismatch", "token is for peer %s, not %s", claims.Subject, id.peerID)
+    }
+    if !claims.AllowsRoom(id.roomID) {
+        return id, rejectAuth(http.StatusForbidden, "room_forbidden", "token for peer %s does not allow room %s", claims.Subject, id.roomID)
+    }
+
+    id.peerID, id.roles = claims.Subject, claims.Roles
+    return id, nil
+}
+
+// requestToken returns the token from the token query parameter or a
+// bearer subprotocol.
+func requestToken(r *http.Request) string {
+    if token := r.URL.Query().Get("token"); token != "" {
+        return token
+    }
+    return subprotocolValue(r, tokenSubprotocolPrefix)
+}
+
+// requestPassword returns the room password from passwordHeader or a
+// password subprotocol. It is never taken from the query, which ends up in
+// access logs.
+func requestPassword(r *http.Request) string {
+    if password := r.Header.Get(passwordHeader); password != "" {
+        return password
+    }
+    password, err := base64.RawURLEncoding.DecodeString(subprotocolValue(r, passwordSubprotocolPrefix))
+    if err != nil {
+        return ""
+    }
+    return string(password)
+}
+
+// requestResumeToken returns the resume token from resumeHeader or a resume
+// subprotocol. Like the password it is kept out of the query, since it lets
+// whoever holds it take over the session.
+func requestResumeToken(r *http.Request) string {
+    if token := r.Header.Get(resumeHeader); token != "" {
+        return token
+    }
+    return subprotocolValue(r, resumeSubprotocolPrefix)
+}
+
+// subprotocolValue returns what follows prefix in the first subprotocol the
+// request offers with it, or "".
+func subprotocolValue(r *http.Request, prefix string) string {
+    for _, protocol := range websocket.Subprotocols(r) {
+        if value, ok := strings.CutPrefix(protocol, prefix); ok {
+            return value
+        }
+    }
+    return ""
+}
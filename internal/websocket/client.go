@@ -1,24 +1,107 @@
 package websocket
 
 import (
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/json"
+    "log/slog"
     "sync"
+    "sync/atomic"
     "time"
     "fmt"
+    "slices"
     "github.com/gorilla/websocket"
     "github.com/pion/webrtc/v3"
+    "VR-Distributed/internal/config"
     "VR-Distributed/internal/crypto"
+    "VR-Distributed/internal/logging"
+    "VR-Distributed/internal/session"
     "VR-Distributed/pkg/types"
 )
 
+// securityState tracks the key exchange on a client's channel. Clients start
+// awaiting the key and become keyed once the key exchange succeeds.
+type securityState int
+
+const (
+    stateAwaitingKey securityState = iota
+    stateKeyed
+)
+
+func (s securityState) String() string {
+    switch s {
+    case stateAwaitingKey:
+        return "awaiting_key"
+    case stateKeyed:
+        return "keyed"
+    }
+    return "unknown"
+}
+
 type Client struct {
     conn         *websocket.Conn
     peerID       string
     room         string
-    lastPing     time.Time
+    remoteAddr   string
+    name         string   // display name, shown to the other peers
+    roles        []string // granted by the auth token
+    joinedRoom   atomic.Pointer[Room] // set once the room accepted it
+    connectedAt  time.Time
+    lastPing     atomic.Int64 // unix nanoseconds of the last pong
+    rtt          atomic.Int64 // round trip of the last ping
     mutex        sync.RWMutex
+    closeOnce    sync.Once
+    closed       atomic.Bool
+    sendQueue    sendQueue
+    overflowOnce sync.Once
+    logger       *slog.Logger
+    handLog      *logging.Limiter // hot-path logs, rate limited
+    stdinLog     *logging.Limiter
+    rateLog      *logging.Limiter
+    rateLimiter  rateLimiter
+    endOnce      sync.Once
+
+    // State the client's room last heard of in peer_joined or presence
+    presence      types.PeerState
+    presenceMutex sync.Mutex
+
+    // Resumption. A detached client has lost its connection but keeps its
+    // session until it reattaches with its resume token or graceTimer
+    // expires. attachMutex guards the writer channels, remoteAddr and the
+    // detached state, and attachChange signals its changes; conn is swapped
+    // under mutex too.
+    attachMutex  sync.Mutex
+    attachChange *sync.Cond
+    attachments  int // reattaches so far
+    writerStop   chan struct{}
+    writerDone   chan struct{}
+    detached     bool
+    graceTimer   *time.Timer
+    expire       func()
+    resumeToken  string   // guarded by resumeTokensMutex
+    sentFrames   [][]byte // last sealed frames up to sendSeq, guarded by mutex
     
     // Crypto
-    aesCipher    *crypto.AESCipher
+    handshake      *crypto.ECDHHandshake
+    aesCipher      *crypto.AESCipher
+    replay         *crypto.ReplayWindow
+    security       securityState
+    securityMutex  sync.RWMutex
+    sendSeq        uint64 // last sequence number sent, guarded by mutex
+    replayRejected atomic.Uint64
+
+    // Session key rotation. The previous key still opens frames until
+    // previousUntil; a key the server offered is pending until rekey_ack.
+    keyedAt        time.Time
+    keyFrames      atomic.Uint64 // frames sealed or opened with aesCipher
+    previousCipher *crypto.AESCipher
+    previousUntil  time.Time
+    pendingKey     []byte
+    pendingCipher  *crypto.AESCipher
+    pendingSince   time.Time
+
+    // VR process, stdin and shared memory owned by this client
+    session      *session.Session
     
     // WebRTC
     peerConnection *webrtc.PeerConnection
@@ -30,30 +113,173 @@ type Client struct {
     pausedMutex    sync.RWMutex // I may remove it later at the end of the project depending on how we end up using this
 }
 
+// NewClient wraps conn and starts the goroutine writing its send queue.
 func NewClient(conn *websocket.Conn, peerID, room string) *Client {
-    return &Client{
-        conn:     conn,
-        peerID:   peerID,
-        room:     room,
-        lastPing: time.Now(),
+    sess := session.New()
+    client := &Client{
+        conn:        conn,
+        peerID:      peerID,
+        room:        room,
+        remoteAddr:  conn.RemoteAddr().String(),
+        connectedAt: time.Now(),
+        session:     sess,
+        logger:      slog.With("peer_id", peerID, "room", room, "session", sess.ID()),
+        handLog:     logging.Every(5 * time.Second),
+        stdinLog:    logging.Every(5 * time.Second),
+        rateLog:     logging.Every(5 * time.Second),
+        sendQueue:   newSendQueue(config.Current().WebSocket.SendQueueSize),
     }
+    client.attachChange = sync.NewCond(&client.attachMutex)
+    client.lastPing.Store(client.connectedAt.UnixNano())
+    conn.SetPongHandler(client.handlePong)
+    client.extendReadDeadline()
+    client.startWriter(nil)
+    return client
+}
+
+// Logger returns a logger carrying the client's peer_id, room and session.
+func (c *Client) Logger() *slog.Logger {
+    return c.logger
+}
+
+// Roles returns the roles granted to the client by its auth token.
+func (c *Client) Roles() []string {
+    return c.roles
 }
 
+// HasRole reports whether the client's auth token grants role.
+func (c *Client) HasRole(role string) bool {
+    return slices.Contains(c.roles, role)
+}
+
+// BeginHandshake generates the ephemeral ECDH keys offered in the init
+// message.
+func (c *Client) BeginHandshake() (*crypto.ECDHHandshake, error) {
+    handshake, err := crypto.NewECDHHandshake()
+    if err != nil {
+        return nil, err
+    }
+    c.securityMutex.Lock()
+    defer c.securityMutex.Unlock()
+    c.handshake = handshake
+    return handshake, nil
+}
+
+// SetupAESCipher installs a session key used in both directions, as
+// negotiated by the RSA handshake, and moves the client to the keyed state.
 func (c *Client) SetupAESCipher(key []byte) error {
     cipher, err := crypto.NewAESCipher(key)
     if err != nil {
         return err
     }
-    c.aesCipher = cipher
+    c.installCipher(cipher, "rsa")
+    return nil
+}
+
+// SetupSessionKeys completes the ECDH handshake with the client's public key
+// and moves the client to the keyed state.
+func (c *Client) SetupSessionKeys(curve string, clientPublic []byte) error {
+    c.securityMutex.Lock()
+    handshake := c.handshake
+    c.handshake = nil
+    c.securityMutex.Unlock()
+    if handshake == nil {
+        return fmt.Errorf("no ECDH handshake in progress")
+    }
+
+    clientToServer, serverToClient, err := handshake.DeriveKeys(curve, clientPublic)
+    if err != nil {
+        return err
+    }
+    cipher, err := crypto.NewDirectionalAESCipher(serverToClient, clientToServer)
+    if err != nil {
+        return err
+    }
+    c.installCipher(cipher, "ecdh-"+curve)
     return nil
 }
 
+func (c *Client) installCipher(cipher *crypto.AESCipher, method string) {
+    c.securityMutex.Lock()
+    defer c.securityMutex.Unlock()
+    c.keyedAt = time.Now()
+    c.keyFrames.Store(0)
+    if c.security == stateKeyed {
+        // Sequence numbers and the replay window carry on across a rekey
+        c.previousCipher = c.aesCipher
+        c.previousUntil = time.Now().Add(time.Duration(config.Current().Security.RekeyGrace))
+        c.aesCipher = cipher
+        c.pendingKey, c.pendingCipher = nil, nil
+        c.logger.Info("Session key rotated")
+        return
+    }
+    c.aesCipher = cipher
+    c.replay = &crypto.ReplayWindow{}
+    c.handshake = nil
+    c.security = stateKeyed
+    c.logger.Info("Key exchange complete", "method", method, "security", c.security.String())
+}
+
+func (c *Client) IsKeyed() bool {
+    c.securityMutex.RLock()
+    defer c.securityMutex.RUnlock()
+    return c.security == stateKeyed
+}
+
+func (c *Client) getAESCipher() *crypto.AESCipher {
+    c.securityMutex.RLock()
+    defer c.securityMutex.RUnlock()
+    return c.aesCipher
+}
+
+// SendMessage queues msg to be sent as JSON, in an encrypted binary frame
+// once the client is keyed. It only fails if the client is closed or its
+// send queue is full.
 func (c *Client) SendMessage(msg types.Message) error {
+    return c.enqueue(outbound{msg: msg})
+}
+
+// sendPlaintext queues msg to be sent as a JSON text frame even if the
+// client is keyed. Only the key exchange acknowledgement needs it, since the
+// client cannot know the server has its key before receiving it.
+func (c *Client) sendPlaintext(msg types.Message) error {
+    return c.enqueue(outbound{msg: msg, plaintext: true})
+}
+
+// writeMessage writes msg to the socket. Only the writer goroutine calls it.
+func (c *Client) writeMessage(msg types.Message, aesCipher *crypto.AESCipher) error {
     c.mutex.Lock()
     defer c.mutex.Unlock()
-    
+
     msg.Timestamp = time.Now().UnixNano()
-    return c.conn.WriteJSON(msg)
+    // Ciphertext does not compress, so only plaintext frames are deflated
+    // when the client negotiated compression
+    c.conn.EnableWriteCompression(aesCipher == nil)
+    if aesCipher == nil {
+        return c.conn.WriteJSON(msg)
+    }
+
+    data, err := json.Marshal(msg)
+    if err != nil {
+        return fmt.Errorf("failed to marshal %s message: %w", msg.Type, err)
+    }
+    c.sendSeq++
+    frame, err := aesCipher.EncryptFrame(crypto.DirectionServerToClient, c.sendSeq, c.peerID, data)
+    if err != nil {
+        return fmt.Errorf("failed to encrypt %s message: %w", msg.Type, err)
+    }
+    c.keyFrames.Add(1)
+    c.recordFrame(frame)
+    return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// writeFrame writes an already sealed frame, resent to a reattached client.
+func (c *Client) writeFrame(frame []byte, deadline time.Time) error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.conn.SetWriteDeadline(deadline)
+    c.conn.EnableWriteCompression(false)
+    return c.conn.WriteMessage(websocket.BinaryMessage, frame)
 }
 
 func (c *Client) SendError(errorMsg string) {
@@ -64,6 +290,15 @@ func (c *Client) SendError(errorMsg string) {
     c.SendMessage(msg)
 }
 
+// SendErrorCode sends an error reply with a machine-readable code.
+func (c *Client) SendErrorCode(code, errorMsg string) {
+    c.SendMessage(types.Message{
+        Type:    "error",
+        Code:    code,
+        Message: errorMsg,
+    })
+}
+
 func (c *Client) GetPeerID() string {
     return c.peerID
 }
@@ -72,12 +307,56 @@ func (c *Client) GetRoom() string {
     return c.room
 }
 
+// RemoteAddr returns the address of the client's current connection.
+func (c *Client) RemoteAddr() string {
+    c.attachMutex.Lock()
+    defer c.attachMutex.Unlock()
+    return c.remoteAddr
+}
+
+func (c *Client) GetSession() *session.Session {
+    return c.session
+}
+
+// Close stops streaming, closes the peer connection, stops the session's VR
+// process, writes what is left in the send queue and closes the socket. A
+// detached client has no read loop to clean up after it, so its session is
+// ended right away instead of at the end of its grace period. Only the
+// first call has any effect.
 func (c *Client) Close() error {
-    if c.peerConnection != nil {
-        c.peerConnection.Close()
-    }
-    return c.conn.Close()
+    c.closeOnce.Do(func() {
+        c.closed.Store(true)
+        c.attachMutex.Lock()
+        var expire func()
+        if c.detached {
+            c.detached = false
+            c.graceTimer.Stop()
+            expire = c.expire
+        }
+        writerDone := c.writerDone
+        c.attachChange.Broadcast()
+        c.attachMutex.Unlock()
+
+        c.rateLimiter.stop()
+        c.SetStreaming(false)
+        if c.peerConnection != nil {
+            c.peerConnection.Close()
+        }
+        c.session.Close(time.Duration(config.Current().Shutdown.ProcessGrace))
+        close(c.sendQueue.done)
+        <-writerDone
+        if expire != nil {
+            go expire()
+        }
+    })
+    return nil
 }
+
+// IsClosed reports whether Close has been called.
+func (c *Client) IsClosed() bool {
+    return c.closed.Load()
+}
+
 func (c *Client) GetPeerConnection() *webrtc.PeerConnection {
     return c.peerConnection
 }
@@ -114,20 +393,24 @@ func (c *Client) IsPaused() bool {
     return c.isPaused
 }
 
+// SetPaused pauses or resumes the client's stream and tells its room.
 func (c *Client) SetPaused(paused bool) {
     c.pausedMutex.Lock()
-    defer c.pausedMutex.Unlock()
     c.isPaused = paused
+    c.pausedMutex.Unlock()
+    c.announcePresence()
 }
 
 func (c *Client) GetPausedMutex() *sync.RWMutex {
     return &c.pausedMutex
 }
 
+// SetStreaming flags whether the client is streaming and tells its room.
 func (c *Client) SetStreaming(streaming bool) {
     c.streamingMutex.Lock()
-    defer c.streamingMutex.Unlock()
     c.isStreaming = streaming
+    c.streamingMutex.Unlock()
+    c.announcePresence()
 }
 
 func (c *Client) GetStreamingMutex() *sync.RWMutex {
@@ -135,15 +418,150 @@ func (c *Client) GetStreamingMutex() *sync.RWMutex {
 }
 
 func (c *Client) DecryptData(encryptedData string) ([]byte, error) {
-    if c.aesCipher == nil {
+    aesCipher := c.getAESCipher()
+    if aesCipher == nil {
         return nil, fmt.Errorf("decryption not initialized")
     }
-    return c.aesCipher.Decrypt(encryptedData)
+    plaintext, err := aesCipher.Decrypt(encryptedData)
+    if err != nil {
+        decryptionFailures.Inc()
+    }
+    return plaintext, err
 }
 
+// DecryptBinaryData opens a client frame and rejects it if its sequence
+// number was already seen or has fallen out of the replay window. Around a
+// rekey the frame may be sealed with the pending or the previous key.
 func (c *Client) DecryptBinaryData(data []byte) ([]byte, error) {
-    if c.aesCipher == nil {
+    c.securityMutex.RLock()
+    ciphers := []*crypto.AESCipher{c.aesCipher}
+    if c.pendingCipher != nil {
+        ciphers = append(ciphers, c.pendingCipher)
+    }
+    if c.previousCipher != nil && time.Now().Before(c.previousUntil) {
+        ciphers = append(ciphers, c.previousCipher)
+    }
+    replay := c.replay
+    c.securityMutex.RUnlock()
+    if ciphers[0] == nil {
         return nil, fmt.Errorf("decryption not initialized")
     }
-    return c.aesCipher.DecryptBinary(data)
+
+    var (
+        seq       uint64
+        plaintext []byte
+        err       error
+    )
+    for _, aesCipher := range ciphers {
+        if seq, plaintext, err = aesCipher.DecryptFrame(crypto.DirectionClientToServer, c.peerID, data); err == nil {
+            break
+        }
+    }
+    if err != nil {
+        decryptionFailures.Inc()
+        return nil, err
+    }
+    if err := replay.Accept(seq); err != nil {
+        c.replayRejected.Add(1)
+        replayRejected.WithLabelValues(replayReason(err)).Inc()
+        return nil, fmt.Errorf("sequence number %d: %w", seq, err)
+    }
+    c.keyFrames.Add(1)
+    return plaintext, nil
+}
+
+// rekeyIfDue offers the client a new session key once the current one has
+// protected security.rekey_after_messages frames or is older than
+// security.rekey_interval. The server keeps sealing with the current key
+// until the client answers rekey_ack under the new one. It is checked by
+// the writer after every frame and ping, so a client that only receives is
+// rekeyed too.
+func (c *Client) rekeyIfDue() error {
+    security := config.Current().Security
+
+    c.securityMutex.Lock()
+    if c.security != stateKeyed {
+        c.securityMutex.Unlock()
+        return nil
+    }
+    if c.pendingKey != nil {
+        if time.Since(c.pendingSince) >= time.Duration(security.RekeyGrace) {
+            // Try again after another full interval rather than on every frame
+            c.logger.Warn("Client did not acknowledge rekey, keeping current key")
+            c.pendingKey, c.pendingCipher = nil, nil
+            c.keyedAt = time.Now()
+            c.keyFrames.Store(0)
+        }
+        c.securityMutex.Unlock()
+        return nil
+    }
+    due := security.RekeyAfterMessages > 0 && c.keyFrames.Load() >= uint64(security.RekeyAfterMessages) ||
+        security.RekeyInterval > 0 && time.Since(c.keyedAt) >= time.Duration(security.RekeyInterval)
+    if !due {
+        c.securityMutex.Unlock()
+        return nil
+    }
+
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        c.securityMutex.Unlock()
+        return fmt.Errorf("failed to generate session key: %w", err)
+    }
+    cipher, err := rekeyCipher(key)
+    if err != nil {
+        c.securityMutex.Unlock()
+        return err
+    }
+    c.pendingKey, c.pendingCipher, c.pendingSince = key, cipher, time.Now()
+    c.securityMutex.Unlock()
+
+    c.logger.Debug("Offering new session key")
+    return c.SendMessage(types.Message{Type: "rekey", Key: base64.StdEncoding.EncodeToString(key)})
+}
+
+// rekeyPending reports whether the server offered a key the client has not
+// acknowledged yet.
+func (c *Client) rekeyPending() bool {
+    c.securityMutex.RLock()
+    defer c.securityMutex.RUnlock()
+    return c.pendingKey != nil
+}
+
+// completeRekey installs the key offered by rekeyIfDue once the client has
+// acknowledged it.
+func (c *Client) completeRekey() error {
+    c.securityMutex.Lock()
+    key := c.pendingKey
+    c.securityMutex.Unlock()
+    if key == nil {
+        return messageErrorf(ErrCodeInvalidState, "rekey_ack without a pending rekey")
+    }
+    return c.installRekey(key)
+}
+
+// installRekey replaces the session keys with those derived from a key
+// offered in a rekey message.
+func (c *Client) installRekey(key []byte) error {
+    cipher, err := rekeyCipher(key)
+    if err != nil {
+        return err
+    }
+    c.installCipher(cipher, "rekey")
+    return nil
+}
+
+// rekeyCipher returns the server's side of the per-direction keys derived
+// from a rekey key.
+func rekeyCipher(key []byte) (*crypto.AESCipher, error) {
+    clientToServer, serverToClient, err := crypto.RekeyKeys(key)
+    if err != nil {
+        return nil, err
+    }
+    return crypto.NewDirectionalAESCipher(serverToClient, clientToServer)
+}
+
+// ReplayRejected returns how many of the client's frames were rejected as
+// replays.
+func (c *Client) ReplayRejected() uint64 {
+    return c.replayRejected.Load()
 }
\ No newline at end of file
@@ -0,0 +1,197 @@
+package websocket
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+
+    "VR-Distributed/internal/auth"
+    "VR-Distributed/internal/config"
+)
+
+// Error codes sent in the code field of error replies.
+const (
+    ErrCodeBadRequest           = "bad_request"
+    ErrCodeUnknownType          = "unknown_type"
+    ErrCodeInvalidPayload       = "invalid_payload"
+    ErrCodeEncryptionRequired   = "encryption_required"
+    ErrCodeKeyExchangeRequired  = "key_exchange_required"
+    ErrCodeInvalidState         = "invalid_state"
+    ErrCodeHandshakeUnsupported = "handshake_unsupported"
+    ErrCodeDecryptionFailed     = "decryption_failed"
+    ErrCodeReplayed             = "replayed"
+    ErrCodeNotFound             = "not_found"
+    ErrCodeForbidden            = "forbidden"
+    ErrCodeRateLimited          = "rate_limited"
+    ErrCodeRoomFull             = "room_full"
+    ErrCodeRoomClosed           = "room_closed"
+    ErrCodeRoomPassword         = "room_password"
+    ErrCodeTerminated           = "terminated"
+    ErrCodeInternal             = "internal_error"
+)
+
+// MessageError is a failure to handle a client message. Code is sent to the
+// client in the error reply so it can react without parsing the text.
+type MessageError struct {
+    Code string
+    Err  error
+}
+
+func (e *MessageError) Error() string {
+    return e.Err.Error()
+}
+
+func (e *MessageError) Unwrap() error {
+    return e.Err
+}
+
+func messageErrorf(code, format string, args ...interface{}) error {
+    return &MessageError{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// errorCode returns the code of err, or ErrCodeInternal if it is neither a
+// MessageError, ErrNotFound nor a room join error.
+func errorCode(err error) string {
+    var msgErr *MessageError
+    if errors.As(err, &msgErr) {
+        return msgErr.Code
+    }
+    switch {
+    case errors.Is(err, ErrNotFound):
+        return ErrCodeNotFound
+    case errors.Is(err, ErrRoomFull):
+        return ErrCodeRoomFull
+    case errors.Is(err, ErrRoomClosed):
+        return ErrCodeRoomClosed
+    case errors.Is(err, ErrRoomPassword):
+        return ErrCodeRoomPassword
+    }
+    return ErrCodeInternal
+}
+
+type messageFlags uint8
+
+const (
+    // flagEncrypted only accepts the type in an AES-GCM encrypted binary frame.
+    flagEncrypted messageFlags = 1 << iota
+    // flagHandshake marks the key exchange, which is only accepted in
+    // plaintext while the client awaits its key.
+    flagHandshake
+    // flagHost is only accepted from the room's host: the type starts or
+    // stops the VR process or hands over control of it.
+    flagHost
+    // flagControl is only accepted from the room's controller: the type
+    // drives the VR process.
+    flagControl
+)
+
+type messageHandler struct {
+    flags  messageFlags
+    handle func(client *Client, room *Room, data []byte) error
+}
+
+var messageHandlers = make(map[string]*messageHandler)
+
+// validator is implemented by payloads that check their fields after decoding.
+type validator interface {
+    Validate() error
+}
+
+// registerMessage registers handle for msgType. Each message is decoded into
+// a fresh P, validated if P implements validator, and then passed to handle.
+// It must only be called from init functions.
+func registerMessage[P any](msgType string, flags messageFlags, handle func(client *Client, room *Room, payload *P) error) {
+    if _, exists := messageHandlers[msgType]; exists {
+        panic(fmt.Sprintf("websocket: message type %q registered twice", msgType))
+    }
+    messageHandlers[msgType] = &messageHandler{
+        flags: flags,
+        handle: func(client *Client, room *Room, data []byte) error {
+            payload := new(P)
+            if err := json.Unmarshal(data, payload); err != nil {
+                return messageErrorf(ErrCodeInvalidPayload, "invalid %s payload: %v", msgType, err)
+            }
+            if v, ok := any(payload).(validator); ok {
+                if err := v.Validate(); err != nil {
+                    return messageErrorf(ErrCodeInvalidPayload, "invalid %s payload: %v", msgType, err)
+                }
+            }
+            return handle(client, room, payload)
+        },
+    }
+}
+
+// dispatch routes a decoded frame to the handler registered for its type.
+// encrypted reports whether the frame arrived AES-GCM encrypted.
+func dispatch(client *Client, room *Room, data []byte, encrypted bool) error {
+    var envelope struct {
+        Type string `json:"type"`
+    }
+    if err := json.Unmarshal(data, &envelope); err != nil {
+        return messageErrorf(ErrCodeBadRequest, "invalid JSON format: %v", err)
+    }
+    messagesReceived.WithLabelValues(messageTypeLabel(envelope.Type)).Inc()
+
+    handler, ok := messageHandlers[envelope.Type]
+    if !ok {
+        return messageErrorf(ErrCodeUnknownType, "unknown message type %q", envelope.Type)
+    }
+    authorize := func() error {
+        if err := checkSecurity(client, envelope.Type, handler.flags, encrypted); err != nil {
+            return err
+        }
+        return checkRoles(client, room, envelope.Type, handler.flags)
+    }
+    if err := authorize(); err != nil {
+        return err
+    }
+    // A message held back by the rate limit is checked again when it is
+    // handled, as its sender may have lost its role in the meantime
+    deferred := func(data []byte) error {
+        if err := authorize(); err != nil {
+            return err
+        }
+        return handler.handle(client, room, data)
+    }
+    if !client.allowType(envelope.Type, data, deferred) {
+        return nil
+    }
+    return handler.handle(client, room, data)
+}
+
+// checkRoles rejects types the client's role in room does not allow it to
+// send. The roles a client can take are limited by its auth token.
+func checkRoles(client *Client, room *Room, msgType string, flags messageFlags) error {
+    host, controller := room.roles()
+    switch {
+    case flags&flagHost != 0 && client.GetPeerID() != host:
+        return messageErrorf(ErrCodeForbidden, "%s can only be sent by the room %s", msgType, auth.RoleHost)
+    case flags&flagControl != 0 && client.GetPeerID() != controller:
+        return messageErrorf(ErrCodeForbidden, "%s can only be sent by the room %s", msgType, auth.RoleController)
+    }
+    return nil
+}
+
+// checkSecurity enforces the client's security state machine. The key
+// exchange is accepted once, before the client is keyed. Sensitive types,
+// or every other type when security.require_encryption is set, must then
+// arrive encrypted.
+func checkSecurity(client *Client, msgType string, flags messageFlags, encrypted bool) error {
+    keyed := client.IsKeyed()
+    if flags&flagHandshake != 0 {
+        if keyed {
+            return messageErrorf(ErrCodeInvalidState, "%s received after the key exchange completed", msgType)
+        }
+        return nil
+    }
+    if encrypted {
+        return nil
+    }
+    if flags&flagEncrypted == 0 && !config.Current().Security.RequireEncryption {
+        return nil
+    }
+    if !keyed {
+        return messageErrorf(ErrCodeKeyExchangeRequired, "%s requires the key exchange to complete first", msgType)
+    }
+    return messageErrorf(ErrCodeEncryptionRequired, "%s must be sent encrypted", msgType)
+}
@@ -0,0 +1,31 @@
+package websocket
+
+import (
+    "testing"
+
+    "VR-Distributed/internal/auth"
+)
+
+// TestTerminateHostOnly checks that a controller who is not the host cannot
+// stop the host's VR process for the whole room.
+func TestTerminateHostOnly(t *testing.T) {
+    host := newTestClient(t, "host", auth.RoleHost)
+    controller := newTestClient(t, "controller", auth.RoleController)
+    room := NewRoom("terminate-test", "host", "", "")
+    for _, client := range []*Client{host, controller} {
+        if err := room.AddClient(client, ""); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := room.TransferControl("controller"); err != nil {
+        t.Fatal(err)
+    }
+
+    flags := messageHandlers["terminate"].flags
+    if err := checkRoles(controller, room, "terminate", flags); err == nil {
+        t.Fatal("terminate accepted from the controller")
+    }
+    if err := checkRoles(host, room, "terminate", flags); err != nil {
+        t.Fatalf("terminate refused from the host: %v", err)
+    }
+}
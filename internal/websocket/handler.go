@@ -1,123 +1,289 @@
 package websocket
 
 import (
+    "errors"
     "fmt"
-    "log"
+    "log/slog"
     "net/http"
     "sync"
     "time"
     
     "github.com/gorilla/websocket"
+    "VR-Distributed/internal/config"
     "VR-Distributed/internal/crypto"
     "VR-Distributed/internal/webrtc"
     "VR-Distributed/pkg/types"
 )
 
 var (
-    upgrader = websocket.Upgrader{
-        CheckOrigin: func(r *http.Request) bool { return true },
-        ReadBufferSize:  1024,
-        WriteBufferSize: 1024,
-    }
-    
     rooms      = make(map[string]*Room)
     roomsMutex = sync.RWMutex{}
 )
 
+func newUpgrader(cfg *config.Config) *websocket.Upgrader {
+    return &websocket.Upgrader{
+        CheckOrigin: func(r *http.Request) bool {
+            return originAllowed(r, cfg.WebSocket.AllowedOrigins)
+        },
+        Subprotocols:      []string{subprotocol},
+        ReadBufferSize:    cfg.WebSocket.ReadBufferSize,
+        WriteBufferSize:   cfg.WebSocket.WriteBufferSize,
+        EnableCompression: cfg.WebSocket.Compression,
+    }
+}
+
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-    conn, err := upgrader.Upgrade(w, r, nil)
+    cfg := config.Current()
+    if !originAllowed(r, cfg.WebSocket.AllowedOrigins) {
+        connectionRejections.WithLabelValues("origin").Inc()
+        slog.Warn("WebSocket origin not allowed", "remote_addr", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+        http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+        return
+    }
+    ip := remoteIP(r, cfg.WebSocket.TrustedProxies)
+    if !acquireConnection(ip, cfg.WebSocket.MaxConnectionsPerIP) {
+        connectionRejections.WithLabelValues("ip_limit").Inc()
+        slog.Warn("Too many WebSocket connections from address", "remote_addr", r.RemoteAddr, "ip", ip, "limit", cfg.WebSocket.MaxConnectionsPerIP)
+        http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+        return
+    }
+    defer releaseConnection(ip)
+
+    id, authErr := authenticate(r, cfg)
+    if authErr != nil {
+        slog.Warn("WebSocket authentication failed", "remote_addr", r.RemoteAddr, "error", authErr)
+        http.Error(w, http.StatusText(authErr.status), authErr.status)
+        return
+    }
+
+    conn, err := newUpgrader(cfg).Upgrade(w, r, nil)
     if err != nil {
-        log.Println("WebSocket upgrade error:", err)
+        slog.Warn("WebSocket upgrade error", "remote_addr", r.RemoteAddr, "error", err)
         return
     }
     defer conn.Close()
+    if err := conn.SetCompressionLevel(cfg.WebSocket.CompressionLevel); err != nil {
+        slog.Warn("Invalid WebSocket compression level", "error", err)
+    }
 
-    peerID := r.URL.Query().Get("peer_id")
-    roomID := r.URL.Query().Get("room")
-    
-    if peerID == "" {
-        peerID = fmt.Sprintf("peer_%d", time.Now().UnixNano())
+    client, room := resumeSession(conn, r, id, cfg)
+    if client == nil {
+        if client, room = startSession(conn, r, id, cfg); client == nil {
+            return
+        }
     }
-    if roomID == "" {
-        roomID = "default"
+
+    err = serve(client, room, cfg)
+    grace := time.Duration(config.Current().WebSocket.ResumeGrace)
+    if client.resumable(err) && client.detach(grace, func() { endSession(client, room) }) {
+        client.Logger().Info("Client detached, awaiting resume", "grace", grace)
+        client.announcePresence()
+        return
     }
+    endSession(client, room)
+}
 
+// startSession sets up a new client on conn, adds it to its room and sends
+// the signed init message. It returns nil if the client could not be set up
+// or was refused by the room.
+func startSession(conn *websocket.Conn, r *http.Request, id identity, cfg *config.Config) (*Client, *Room) {
+    peerID, roomID := id.peerID, id.roomID
+    query := r.URL.Query()
     client := NewClient(conn, peerID, roomID)
-    
+    client.roles = id.roles
+    client.name = displayName(query.Get("name"), peerID)
+
+    // A detached session of the same peer that is reconnecting without its
+    // resume token is replaced
+    if room := findRoom(roomID); room != nil {
+        if previous, exists := room.GetClient(peerID); exists && previous.IsDetached() {
+            previous.Logger().Info("Replacing detached session")
+            endSession(previous, room)
+        }
+    }
+
     // Setup WebRTC
     if err := webrtc.SetupPeerConnection(client); err != nil {
-        log.Printf("Failed to setup WebRTC: %v", err)
-        return
+        client.Logger().Error("Failed to setup WebRTC", "error", err)
+        client.Close()
+        return nil, nil
     }
 
-    room := getOrCreateRoom(roomID)
-    room.AddClient(client)
+    room, err := joinRoom(client, query.Get("title"), requestPassword(r))
+    if err != nil {
+        rejectJoin(client, err)
+        return nil, nil
+    }
 
     // Notify other clients about new peer
+    state := client.markPresence()
     room.BroadcastMessage(types.Message{
         Type:   "peer_joined",
         PeerID: peerID,
+        Peer:   &state,
     }, peerID)
 
-    // Send RSA public key
+    // Offer the ECDH handshake, and the RSA public key for old clients if
+    // enabled
+    handshake, err := client.BeginHandshake()
+    if err != nil {
+        client.Logger().Error("Failed to generate handshake keys", "error", err)
+        endSession(client, room)
+        return nil, nil
+    }
+    host, controller := room.roles()
     initMsg := types.Message{
-        Type:         "init",
-        RSAPublicKey: crypto.GetPublicKeyPEM(),
-        PeerID:       peerID,
-        Room:         roomID,
+        Type:           "init",
+        Version:        crypto.HandshakeECDH,
+        ECDHPublicKeys: handshake.PublicKeys(),
+        PeerID:         peerID,
+        Room:           roomID,
+        Host:           host,
+        Controller:     controller,
+    }
+    if cfg.Security.RSAKeyExchange {
+        initMsg.RSAPublicKey = crypto.GetPublicKeyPEM()
+    }
+    if err := signInit(&initMsg); err != nil {
+        client.Logger().Error("Failed to sign init message", "error", err)
+        endSession(client, room)
+        return nil, nil
     }
     if err := client.SendMessage(initMsg); err != nil {
-        log.Printf("Failed to send init message: %v", err)
-        return
+        client.Logger().Error("Failed to send init message", "error", err)
+        endSession(client, room)
+        return nil, nil
     }
+    // The client became the host of a new or hostless room, which it
+    // learns from init
+    if host == peerID {
+        announceRoles(room, peerID, peerID)
+    }
+    return client, room
+}
 
-    // Message handling loop
+// serve handles the client's messages until its connection fails or it is
+// closed, and returns the read error that ended it.
+func serve(client *Client, room *Room, cfg *config.Config) error {
     for {
-        messageType, data, err := conn.ReadMessage()
+        messageType, data, err := readMessage(client)
         if err != nil {
-            log.Printf("Read error from %s: %v", peerID, err)
-            break
+            if isTimeout(err) {
+                idleTimeouts.Inc()
+                client.Logger().Info("Client idle, closing", "last_ping", client.LastPing(), "idle_timeout", time.Duration(cfg.WebSocket.IdleTimeout))
+            } else {
+                client.Logger().Info("Read error", "error", err)
+            }
+            return err
+        }
+        // Frames already buffered when the client was disconnected are
+        // not handled
+        if client.IsClosed() {
+            return nil
+        }
+        if !client.allowMessage() {
+            continue
         }
 
         switch messageType {
         case websocket.TextMessage:
             if err := HandleJSONMessage(client, data, room); err != nil {
-                log.Printf("Error handling JSON message from %s: %v", peerID, err)
-                client.SendError(fmt.Sprintf("Message handling failed: %v", err))
+                client.Logger().Warn("Error handling JSON message", "error", err)
+                client.SendErrorCode(errorCode(err), fmt.Sprintf("Message handling failed: %v", err))
             }
 
         case websocket.BinaryMessage:
             if err := HandleBinaryMessage(client, data, room); err != nil {
-                log.Printf("Error handling binary message from %s: %v", peerID, err)
-                client.SendError(fmt.Sprintf("Binary message handling failed: %v", err))
+                client.Logger().Warn("Error handling binary message", "error", err)
+                client.SendErrorCode(errorCode(err), fmt.Sprintf("Binary message handling failed: %v", err))
             }
 
         default:
-            log.Printf("Unknown message type from %s: %d", peerID, messageType)
+            client.Logger().Warn("Unknown WebSocket message type", "message_type", messageType)
         }
     }
+}
 
-    // Cleanup
-    client.Close()
-    room.RemoveClient(peerID)
-    
-    // Notify other clients about peer leaving
-    room.BroadcastMessage(types.Message{
-        Type:   "peer_left",
-        PeerID: peerID,
-    }, peerID)
-    
-    log.Printf("Client %s disconnected from room %s", peerID, roomID)
+// endSession closes the client, removes it from its room and tells the
+// other peers it left. Only the first call has any effect.
+func endSession(client *Client, room *Room) {
+    client.endOnce.Do(func() {
+        client.Close()
+        client.forgetResume()
+        rolesChanged := room.RemoveClient(client)
+        
+        // Notify other clients about peer leaving
+        room.BroadcastMessage(types.Message{
+            Type:   "peer_left",
+            PeerID: client.GetPeerID(),
+        }, client.GetPeerID())
+        if rolesChanged {
+            announceRoles(room, client.GetPeerID(), "")
+        }
+        
+        client.Logger().Info("Client disconnected")
+    })
 }
 
-func getOrCreateRoom(roomID string) *Room {
+// getOrCreateRoom returns room roomID, creating it for owner with title and
+// password if it does not exist.
+func getOrCreateRoom(roomID, owner, title, password string) *Room {
     roomsMutex.Lock()
     defer roomsMutex.Unlock()
     
     room, exists := rooms[roomID]
     if !exists {
-        room = NewRoom()
+        room = NewRoom(roomID, owner, title, password)
         rooms[roomID] = room
+        slog.Info("Room created", "room", roomID, "owner", owner, "password", password != "")
     }
     return room
-}
\ No newline at end of file
+}
+
+// joinRoom adds client to its room, creating the room with title and
+// password if needed. A room deleted between the lookup and the join is
+// created again.
+func joinRoom(client *Client, title, password string) (*Room, error) {
+    for attempt := 0; attempt < 3; attempt++ {
+        room := getOrCreateRoom(client.GetRoom(), client.GetPeerID(), title, password)
+        if err := room.AddClient(client, password); !errors.Is(err, ErrRoomClosed) {
+            return room, err
+        }
+    }
+    return nil, ErrRoomClosed
+}
+
+// rejectJoin tells a client why it could not join its room and closes it.
+// It is not keyed yet, so the error goes out in plaintext.
+func rejectJoin(client *Client, err error) {
+    code := errorCode(err)
+    roomRejections.WithLabelValues(code).Inc()
+    client.Logger().Info("Room join refused", "error", err)
+    client.SendErrorCode(code, fmt.Sprintf("Cannot join room %s: %v", client.GetRoom(), err))
+    closeCode := websocket.CloseTryAgainLater
+    if errors.Is(err, ErrRoomPassword) {
+        closeCode = websocket.ClosePolicyViolation
+    }
+    client.sendClose(closeCode, code)
+    client.Close()
+}
+
+// signInit signs the handshake fields of msg with the server identity keys,
+// so clients that pin an identity fingerprint can detect a substituted init.
+func signInit(msg *types.Message) error {
+    signatures, err := crypto.SignHandshake(func(signers []crypto.HandshakeSignature) []byte {
+        return crypto.HandshakeTranscript(msg.Version, msg.PeerID, msg.Room, msg.ECDHPublicKeys, msg.RSAPublicKey, signers)
+    })
+    if err != nil {
+        return err
+    }
+    msg.KeyID = signatures[0].KeyID
+    for _, signature := range signatures {
+        msg.Signatures = append(msg.Signatures, types.HandshakeSignature{
+            KeyID:     signature.KeyID,
+            PublicKey: signature.PublicKey,
+            Signature: signature.Signature,
+        })
+    }
+    return nil
+}
@@ -0,0 +1,59 @@
+package websocket
+
+import (
+    "errors"
+    "net"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/internal/config"
+)
+
+// sendPing writes a ping carrying the current time, so its pong gives the
+// round trip. Only the writer goroutine calls it.
+func (c *Client) sendPing(deadline time.Time) error {
+    payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+    return c.conn.WriteControl(websocket.PingMessage, []byte(payload), deadline)
+}
+
+// handlePong records the round trip of the ping it answers, extends the
+// read deadline and tells the room if the client's latency class changed.
+func (c *Client) handlePong(appData string) error {
+    now := time.Now()
+    c.lastPing.Store(now.UnixNano())
+    if sent, err := strconv.ParseInt(appData, 10, 64); err == nil && sent <= now.UnixNano() {
+        rtt := now.Sub(time.Unix(0, sent))
+        c.rtt.Store(int64(rtt))
+        pingRTT.Observe(rtt.Seconds())
+    }
+    c.extendReadDeadline()
+    c.announcePresence()
+    return nil
+}
+
+// extendReadDeadline gives the client another websocket.idle_timeout to
+// send a message or answer a ping. It is called for every message and pong,
+// so a headset that stops answering hits the deadline and the read loop
+// detaches or ends its session.
+func (c *Client) extendReadDeadline() {
+    c.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Current().WebSocket.IdleTimeout)))
+}
+
+// LastPing returns when the client last answered a ping, or when it
+// connected if it has not yet.
+func (c *Client) LastPing() time.Time {
+    return time.Unix(0, c.lastPing.Load())
+}
+
+// RTT returns the round trip of the last ping, or zero before the first
+// pong.
+func (c *Client) RTT() time.Duration {
+    return time.Duration(c.rtt.Load())
+}
+
+// isTimeout reports whether err is a read deadline expiring.
+func isTimeout(err error) bool {
+    var netErr net.Error
+    return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,171 @@
+package websocket
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/internal/config"
+)
+
+var (
+    ipConnections      = make(map[string]int)
+    ipConnectionsMutex = sync.Mutex{}
+)
+
+// errMessageTooBig ends a connection that sent a message over its size
+// limit. The session ends with it rather than waiting to be resumed.
+var errMessageTooBig = errors.New("message too big")
+
+// originAllowed reports whether r may open a WebSocket from its Origin.
+// The server's own origin is always allowed, as are requests without an
+// Origin header, which only come from native clients.
+func originAllowed(r *http.Request, allowed []string) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+        return true
+    }
+    u, err := url.Parse(origin)
+    if err != nil {
+        return false
+    }
+    if strings.EqualFold(u.Host, r.Host) {
+        return true
+    }
+    for _, allowedOrigin := range allowed {
+        if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+            return true
+        }
+    }
+    return false
+}
+
+// remoteIP returns the IP address r came from, without the port. When r
+// came through one of the trusted proxies, it is the rightmost address in
+// X-Forwarded-For that is not itself a trusted proxy, as the addresses left
+// of it were written by the client and cannot be believed.
+func remoteIP(r *http.Request, trusted []string) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    if !proxyTrusted(host, trusted) {
+        return host
+    }
+    forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i := len(forwarded) - 1; i >= 0; i-- {
+        ip := strings.TrimSpace(forwarded[i])
+        if net.ParseIP(ip) == nil {
+            break
+        }
+        host = ip
+        if !proxyTrusted(ip, trusted) {
+            break
+        }
+    }
+    return host
+}
+
+// proxyTrusted reports whether ip is one of the trusted proxy addresses or
+// falls in one of their CIDR ranges.
+func proxyTrusted(ip string, trusted []string) bool {
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return false
+    }
+    for _, proxy := range trusted {
+        if _, network, err := net.ParseCIDR(proxy); err == nil {
+            if network.Contains(addr) {
+                return true
+            }
+        } else if proxyAddr := net.ParseIP(proxy); proxyAddr != nil && proxyAddr.Equal(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// acquireConnection counts a new connection from ip, unless ip already has
+// limit open. A limit of 0 allows any number.
+func acquireConnection(ip string, limit int) bool {
+    ipConnectionsMutex.Lock()
+    defer ipConnectionsMutex.Unlock()
+
+    if limit > 0 && ipConnections[ip] >= limit {
+        return false
+    }
+    ipConnections[ip]++
+    return true
+}
+
+func releaseConnection(ip string) {
+    ipConnectionsMutex.Lock()
+    defer ipConnectionsMutex.Unlock()
+
+    if ipConnections[ip]--; ipConnections[ip] <= 0 {
+        delete(ipConnections, ip)
+    }
+}
+
+// readLimit returns the class and size limit of a message of messageType.
+// Until the key exchange succeeds every message is held to the handshake
+// limit.
+func readLimit(client *Client, messageType int, cfg *config.WebSocketConfig) (string, int64) {
+    switch {
+    case !client.IsKeyed():
+        return "handshake", cfg.MaxHandshakeMessage
+    case messageType == websocket.BinaryMessage:
+        return "binary", cfg.MaxBinaryMessage
+    default:
+        return "text", cfg.MaxTextMessage
+    }
+}
+
+// readMessage reads the next message from the client. A message larger than
+// its class allows closes the connection with 1009 before it is buffered in
+// full.
+func readMessage(client *Client) (int, []byte, error) {
+    cfg := config.Current().WebSocket
+
+    // The connection-wide limit stops oversized frames from their header;
+    // the class of the message is only known once it starts arriving
+    connClass, connLimit := "handshake", cfg.MaxHandshakeMessage
+    if client.IsKeyed() {
+        connClass, connLimit = "message", max(cfg.MaxTextMessage, cfg.MaxBinaryMessage)
+    }
+    client.conn.SetReadLimit(connLimit)
+    client.extendReadDeadline()
+
+    messageType, reader, err := client.conn.NextReader()
+    if err != nil {
+        return messageType, nil, readLimitError(connClass, connLimit, err)
+    }
+    class, limit := readLimit(client, messageType, &cfg)
+    data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+    if err != nil {
+        return messageType, nil, readLimitError(class, limit, err)
+    }
+    if int64(len(data)) > limit {
+        err := fmt.Errorf("%w: %s message exceeds %d bytes", errMessageTooBig, class, limit)
+        oversizedMessages.WithLabelValues(class).Inc()
+        client.sendClose(websocket.CloseMessageTooBig, fmt.Sprintf("%s message exceeds %d bytes", class, limit))
+        return messageType, nil, err
+    }
+    return messageType, data, nil
+}
+
+// readLimitError counts err if it is gorilla's read limit, which has
+// already closed the connection with 1009.
+func readLimitError(class string, limit int64, err error) error {
+    if !errors.Is(err, websocket.ErrReadLimit) {
+        return err
+    }
+    oversizedMessages.WithLabelValues(class).Inc()
+    return fmt.Errorf("%w: %s message exceeds %d bytes", errMessageTooBig, class, limit)
+}
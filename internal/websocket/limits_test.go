@@ -0,0 +1,180 @@
+package websocket
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+    tests := []struct {
+        name       string
+        remoteAddr string
+        forwarded  []string
+        trusted    []string
+        want       string
+    }{
+        {
+            name:       "direct",
+            remoteAddr: "203.0.113.7:5000",
+            want:       "203.0.113.7",
+        },
+        {
+            name:       "forwarded for by an untrusted peer",
+            remoteAddr: "203.0.113.7:5000",
+            forwarded:  []string{"198.51.100.1"},
+            want:       "203.0.113.7",
+        },
+        {
+            name:       "forwarded for by a peer while another proxy is trusted",
+            remoteAddr: "203.0.113.7:5000",
+            forwarded:  []string{"198.51.100.1"},
+            trusted:    []string{"10.0.0.1"},
+            want:       "203.0.113.7",
+        },
+        {
+            name:       "trusted proxy",
+            remoteAddr: "10.0.0.1:5000",
+            forwarded:  []string{"198.51.100.1"},
+            trusted:    []string{"10.0.0.1"},
+            want:       "198.51.100.1",
+        },
+        {
+            name:       "trusted proxy by CIDR",
+            remoteAddr: "10.1.2.3:5000",
+            forwarded:  []string{"198.51.100.1"},
+            trusted:    []string{"10.0.0.0/8"},
+            want:       "198.51.100.1",
+        },
+        {
+            name:       "spoofed entries left of the proxy's are ignored",
+            remoteAddr: "10.0.0.1:5000",
+            forwarded:  []string{"192.0.2.99, 198.51.100.1"},
+            trusted:    []string{"10.0.0.1"},
+            want:       "198.51.100.1",
+        },
+        {
+            name:       "chain of trusted proxies",
+            remoteAddr: "10.0.0.1:5000",
+            forwarded:  []string{"192.0.2.99, 198.51.100.1, 10.0.0.2"},
+            trusted:    []string{"10.0.0.0/8"},
+            want:       "198.51.100.1",
+        },
+        {
+            name:       "chain split over several headers",
+            remoteAddr: "10.0.0.1:5000",
+            forwarded:  []string{"192.0.2.99", "198.51.100.1", "10.0.0.2"},
+            trusted:    []string{"10.0.0.0/8"},
+            want:       "198.51.100.1",
+        },
+        {
+            name:       "only trusted proxies",
+            remoteAddr: "10.0.0.1:5000",
+            forwarded:  []string{"10.0.0.3, 10.0.0.2"},
+            trusted:    []string{"10.0.0.0/8"},
+            want:       "10.0.0.3",
+        },
+        {
+            name:       "malformed entry stops the walk",
+            remoteAddr: "10.0.0.1:5000",
+            forwarded:  []string{"198.51.100.1, not-an-ip"},
+            trusted:    []string{"10.0.0.1"},
+            want:       "10.0.0.1",
+        },
+        {
+            name:       "trusted proxy without the header",
+            remoteAddr: "10.0.0.1:5000",
+            trusted:    []string{"10.0.0.1"},
+            want:       "10.0.0.1",
+        },
+        {
+            name:       "IPv6",
+            remoteAddr: "[2001:db8::1]:5000",
+            forwarded:  []string{"2001:db8::99"},
+            trusted:    []string{"2001:db8::/64"},
+            want:       "2001:db8::99",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/ws/webrtc/", nil)
+            r.RemoteAddr = tt.remoteAddr
+            for _, value := range tt.forwarded {
+                r.Header.Add("X-Forwarded-For", value)
+            }
+            if got := remoteIP(r, tt.trusted); got != tt.want {
+                t.Fatalf("remoteIP = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestOriginAllowed(t *testing.T) {
+    tests := []struct {
+        name    string
+        origin  string
+        allowed []string
+        want    bool
+    }{
+        {name: "no origin", origin: "", want: true},
+        {name: "own origin", origin: "https://vr.example.com", want: true},
+        {name: "own origin, other case", origin: "https://VR.example.com", want: true},
+        {name: "other origin with an empty list", origin: "https://evil.example", want: false},
+        {name: "other origin not listed", origin: "https://evil.example", allowed: []string{"https://app.example"}, want: false},
+        {name: "listed origin", origin: "https://app.example", allowed: []string{"https://app.example"}, want: true},
+        {name: "listed origin with another scheme", origin: "http://app.example", allowed: []string{"https://app.example"}, want: false},
+        {name: "wildcard", origin: "https://evil.example", allowed: []string{"*"}, want: true},
+        {name: "malformed origin", origin: "://bad", allowed: []string{"https://app.example"}, want: false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "https://vr.example.com/ws/webrtc/", nil)
+            if tt.origin != "" {
+                r.Header.Set("Origin", tt.origin)
+            }
+            if got := originAllowed(r, tt.allowed); got != tt.want {
+                t.Fatalf("originAllowed = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestAcquireConnection(t *testing.T) {
+    const ip = "192.0.2.10"
+    for i := 0; i < 2; i++ {
+        if !acquireConnection(ip, 2) {
+            t.Fatalf("connection %d refused under the limit", i+1)
+        }
+    }
+    if acquireConnection(ip, 2) {
+        t.Fatal("connection over the limit accepted")
+    }
+    if !acquireConnection("192.0.2.11", 2) {
+        t.Fatal("limit shared between addresses")
+    }
+
+    releaseConnection(ip)
+    if !acquireConnection(ip, 2) {
+        t.Fatal("connection refused after one was released")
+    }
+    for i := 0; i < 2; i++ {
+        releaseConnection(ip)
+    }
+    releaseConnection("192.0.2.11")
+
+    ipConnectionsMutex.Lock()
+    remaining := len(ipConnections)
+    ipConnectionsMutex.Unlock()
+    if remaining != 0 {
+        t.Fatalf("%d addresses still counted after every connection was released", remaining)
+    }
+
+    for i := 0; i < 5; i++ {
+        if !acquireConnection(ip, 0) {
+            t.Fatal("connection refused with no limit")
+        }
+    }
+    for i := 0; i < 5; i++ {
+        releaseConnection(ip)
+    }
+}
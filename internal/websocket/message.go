@@ -4,153 +4,281 @@ import (
 	"VR-Distributed/internal/config"
 	"VR-Distributed/internal/crypto"
 	"VR-Distributed/internal/media"
-	"VR-Distributed/internal/shared"
 	"VR-Distributed/internal/webrtc"
 	"VR-Distributed/pkg/types"
-	"encoding/json"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	pionwebrtc "github.com/pion/webrtc/v3"
+	"log/slog"
 	"time"
 )
 
-var stdinWriter = &shared.SharedMemoryWriter{}
-var isrunning bool = true
+func init() {
+	registerMessage("aes_key_exchange", flagHandshake, handleAESKeyExchange)
+	registerMessage("ecdh_key_exchange", flagHandshake, handleECDHKeyExchange)
+	registerMessage("rekey", flagEncrypted, handleRekey)
+	registerMessage("rekey_ack", flagEncrypted, func(client *Client, room *Room, _ *emptyPayload) error {
+		if err := client.completeRekey(); err != nil {
+			return err
+		}
+		rekeys.WithLabelValues("server").Inc()
+		return nil
+	})
+	registerMessage("start_vr", flagEncrypted|flagHost, handleStartVR)
+	registerMessage("stop_stream", flagEncrypted|flagHost, func(client *Client, room *Room, _ *emptyPayload) error {
+		return handleStopStream(client)
+	})
+	registerMessage("webrtc_offer", 0, handleWebRTCOffer)
+	registerMessage("webrtc_answer", 0, handleWebRTCAnswer)
+	registerMessage("webrtc_ice_candidate", 0, handleWebRTCICECandidate)
+	registerMessage("start_handtracking", flagEncrypted|flagControl, func(client *Client, room *Room, _ *emptyPayload) error {
+		client.Logger().Info("Hand tracking has been initialized")
+		return nil
+	})
+	registerMessage("gyro", flagEncrypted|flagControl, handleGyroData)
+	registerMessage("hand", flagEncrypted|flagControl, handleHandData)
+	registerMessage("pause", flagEncrypted|flagControl, handlePause)
+	registerMessage("resume", flagEncrypted|flagControl, handleResume)
+	registerMessage("terminate", flagEncrypted|flagHost, handleTerminate)
+	registerMessage("quality", flagEncrypted|flagControl, handleQuality)
+	registerMessage("toggle_vr_debugging", flagEncrypted|flagHost, handleToggleVRDebugging)
+	registerMessage("transfer_control", flagEncrypted|flagHost, handleTransferControl)
+}
 
-func HandleJSONMessage(client *Client, data []byte, room *Room) error {
-	var msg types.Message
-	if err := json.Unmarshal(data, &msg); err != nil {
-		return fmt.Errorf("invalid JSON format: %w", err)
+type emptyPayload struct{}
+
+type keyExchangePayload struct {
+	EncryptedKey string `json:"encrypted_key"`
+	IV           string `json:"iv"`
+}
+
+func (p *keyExchangePayload) Validate() error {
+	if p.EncryptedKey == "" {
+		return fmt.Errorf("encrypted_key is required")
 	}
+	return nil
+}
 
-	switch msg.Type {
-	case "aes_key_exchange":
-		return handleAESKeyExchange(client, msg)
+type ecdhKeyExchangePayload struct {
+	Curve     string `json:"curve"`
+	PublicKey string `json:"public_key"`
+	publicKey []byte
+}
 
-	case "start_vr":
-		err := stdinWriter.NewSharedMemoryWriter("gyro.dat", 65536) // initialize the gyroWriter on key exchange complete
-		if err != nil {
-			log.Fatal("Failed to initialize gyro shared memory:", err)
-			return err
-		}
-		configStruct := config.Load()
-		go media.StartStreaming(client, configStruct.DefaultFilePath)
-		client.SendMessage(types.Message{
-			Type:    "vr_ready",
-			Message: "VR process started",
-		})
-		log.Printf("VR started for client %s", client.GetPeerID())
-		return nil
+func (p *ecdhKeyExchangePayload) Validate() error {
+	if p.Curve != crypto.CurveX25519 && p.Curve != crypto.CurveP256 {
+		return fmt.Errorf("curve must be %s or %s, got %q", crypto.CurveX25519, crypto.CurveP256, p.Curve)
+	}
+	key, err := base64.StdEncoding.DecodeString(p.PublicKey)
+	if err != nil || len(key) == 0 {
+		return fmt.Errorf("public_key must be a base64 raw public key")
+	}
+	p.publicKey = key
+	return nil
+}
 
-	case "stop_stream":
-		return handleStopStream(client)
+type rekeyPayload struct {
+	Key string `json:"key"`
+	key []byte
+}
 
-	case "webrtc_offer":
-		return handleWebRTCOffer(client, msg, room)
+func (p *rekeyPayload) Validate() error {
+	key, err := base64.StdEncoding.DecodeString(p.Key)
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("key must be a base64 AES-256 key")
+	}
+	p.key = key
+	return nil
+}
 
-	case "webrtc_answer":
-		return handleWebRTCAnswer(client, msg, room)
+// Signalling payloads. Target names the peer to forward them to; empty or
+// the sender's own ID means they are meant for the server.
+type offerPayload struct {
+	Offer  *pionwebrtc.SessionDescription `json:"offer"`
+	Target string                         `json:"target"`
+}
 
-	case "webrtc_ice_candidate":
-		return handleWebRTCICECandidate(client, msg, room)
+func (p *offerPayload) Validate() error {
+	if p.Offer == nil {
+		return fmt.Errorf("offer is required")
+	}
+	return nil
+}
 
-	/*case "encrypted_data":
-		return handleEncryptedData(client, msg, room)*/
-	case "start_handtracking":
-		log.Println("Hand tracking has been initialized")
-		return nil
+type answerPayload struct {
+	Answer *pionwebrtc.SessionDescription `json:"answer"`
+	Target string                         `json:"target"`
+}
 
-	case "gyro":
-		return handleGyroData(client, msg)
+func (p *answerPayload) Validate() error {
+	if p.Answer == nil {
+		return fmt.Errorf("answer is required")
+	}
+	return nil
+}
 
-	case "hand":
-		return handleHandData(client, msg)
+type candidatePayload struct {
+	Candidate *pionwebrtc.ICECandidateInit `json:"candidate"`
+	Target    string                       `json:"target"`
+}
 
-	case "pause":
-		log.Printf("Received pause command from %s", client.GetPeerID())
-		// return handleStopStream(client)
-		client.SetPaused(true)
-		return nil
+func (p *candidatePayload) Validate() error {
+	if p.Candidate == nil {
+		return fmt.Errorf("candidate is required")
+	}
+	return nil
+}
 
-	case "resume":
-		log.Printf("Received resume command from %s", client.GetPeerID())
-		// return handleStartStream(client, msg)
-		client.SetPaused(false)
-		return nil
+type gyroPayload struct {
+	Alpha float64 `json:"alpha"`
+	Beta  float64 `json:"beta"`
+	Gamma float64 `json:"gamma"`
+}
 
-	case "terminate":
-		log.Printf("Received terminate command from %s", client.GetPeerID())
-		client.SetStreaming(false)
-		stdinWriter.Close()
-		return fmt.Errorf("client requested termination")
-	
-	case "quality":
-		if value := msg.Value; value > 0 && value <= 100 {
-			log.Printf("Received quality change from %s: %d", client.GetPeerID(), int(value))
-		}
-		return nil
+type handPayload struct {
+	Hands types.HandTrackingData `json:"hands"`
+}
 
-	case "toggle_vr_debugging":
-		if enabled := msg.Enabled; enabled {
-			log.Printf("VR debugging toggled by %s: %t", client.GetPeerID(), enabled)
-			client.SendMessage(types.Message{
-				Type:    "vr_debugging_status",
-				Message: fmt.Sprintf("VR debugging %s", map[bool]string{true: "enabled", false: "disabled"}[enabled]),
-			})
-		}
-		return nil
+type qualityPayload struct {
+	Value int `json:"value"`
+}
 
-	default:
-		log.Printf("Unhandled JSON message type from %s: %s", client.GetPeerID(), msg.Type)
-		return nil
+func (p *qualityPayload) Validate() error {
+	if p.Value <= 0 || p.Value > 100 {
+		return fmt.Errorf("value must be between 1 and 100, got %d", p.Value)
+	}
+	return nil
+}
+
+type toggleDebuggingPayload struct {
+	Enabled bool `json:"enabled"`
+}
+
+type transferControlPayload struct {
+	Target string `json:"target"`
+}
+
+func (p *transferControlPayload) Validate() error {
+	if p.Target == "" {
+		return fmt.Errorf("target is required")
 	}
+	return nil
+}
+
+// HandleJSONMessage handles a plaintext text frame.
+func HandleJSONMessage(client *Client, data []byte, room *Room) error {
+	return dispatch(client, room, data, false)
 }
 
+// HandleBinaryMessage decrypts a binary frame and handles the JSON inside.
 func HandleBinaryMessage(client *Client, data []byte, room *Room) error {
-	// Decrypt the binary data
+	if !client.IsKeyed() {
+		return messageErrorf(ErrCodeKeyExchangeRequired, "encrypted frame received before the key exchange")
+	}
 	decryptedData, err := client.DecryptBinaryData(data)
-	if err != nil {
-		return fmt.Errorf("binary decryption failed: %w", err)
+	if errors.Is(err, crypto.ErrReplayed) || errors.Is(err, crypto.ErrOutOfWindow) {
+		return messageErrorf(ErrCodeReplayed, "binary frame rejected: %v", err)
+	} else if err != nil {
+		return messageErrorf(ErrCodeDecryptionFailed, "binary decryption failed: %v", err)
 	}
+	return dispatch(client, room, decryptedData, true)
+}
 
-	// Parse decrypted data as JSON
-	/*var controlMsg map[string]interface{}
-	if err := json.Unmarshal(decryptedData, &controlMsg); err != nil {
-		return fmt.Errorf("invalid binary control message: %w", err)
+// handleAESKeyExchange is the legacy RSA handshake: the client picks the AES
+// key and sends it encrypted to the server's RSA key.
+func handleAESKeyExchange(client *Client, room *Room, payload *keyExchangePayload) error {
+	if !config.Current().Security.RSAKeyExchange {
+		return messageErrorf(ErrCodeHandshakeUnsupported, "RSA key exchange is disabled, use ecdh_key_exchange")
+	}
+	key, err := crypto.DecryptAESKey(payload.EncryptedKey)
+	if err != nil {
+		return err
 	}
 
-	msgType, ok := controlMsg["type"].(string)
-	if !ok {
-		return fmt.Errorf("invalid binary control message type")
+	if err := client.SetupAESCipher(key); err != nil {
+		return err
 	}
 
-	return handleControlMessage(client, msgType, controlMsg)*/
-	return HandleJSONMessage(client, decryptedData, room)
+	return completeKeyExchange(client, room)
 }
 
-func handleAESKeyExchange(client *Client, msg types.Message) error {
-	key, err := crypto.DecryptAESKey(msg.EncryptedKey)
-	if err != nil {
+// handleECDHKeyExchange completes the ephemeral ECDH handshake offered in
+// the init message.
+func handleECDHKeyExchange(client *Client, room *Room, payload *ecdhKeyExchangePayload) error {
+	if err := client.SetupSessionKeys(payload.Curve, payload.publicKey); err != nil {
+		return messageErrorf(ErrCodeInvalidPayload, "key exchange failed: %v", err)
+	}
+	return completeKeyExchange(client, room)
+}
+
+// completeKeyExchange acknowledges the key exchange, then sends the
+// client's first resume token and the room's roster under the new key. A
+// client joining while the host streams is told the VR process is ready, so
+// it can connect to the stream.
+func completeKeyExchange(client *Client, room *Room) error {
+	if err := client.sendPlaintext(types.Message{Type: "key_exchange_complete"}); err != nil {
 		return err
 	}
+	if err := client.offerResume("resume_token"); err != nil {
+		return err
+	}
+	if err := client.SendMessage(roomState(room)); err != nil {
+		return err
+	}
+	if host := room.hostClient(); host != nil && host != client && host.IsStreaming() {
+		return client.SendMessage(types.Message{
+			Type:    "vr_ready",
+			Message: "VR process running",
+			From:    host.GetPeerID(),
+		})
+	}
+	return nil
+}
 
-	if err := client.SetupAESCipher(key); err != nil {
+// handleRekey installs a session key offered by the client and acknowledges
+// it under the new key. If the server has offered a key itself, the
+// client's offer is ignored: the client gives way to the server's.
+func handleRekey(client *Client, room *Room, payload *rekeyPayload) error {
+	if client.rekeyPending() {
+		client.Logger().Debug("Ignoring client rekey while a server rekey is pending")
+		return nil
+	}
+	if err := client.installRekey(payload.key); err != nil {
 		return err
 	}
+	rekeys.WithLabelValues("client").Inc()
+	return client.SendMessage(types.Message{Type: "rekey_ack"})
+}
 
-	ack := types.Message{Type: "key_exchange_complete"}
-	return client.SendMessage(ack)
+func handleStartVR(client *Client, room *Room, _ *emptyPayload) error {
+	configStruct := config.Current()
+	err := client.GetSession().Open(configStruct.SharedMemorySize) // initialize the gyroWriter on key exchange complete
+	if err != nil {
+		client.Logger().Error("Failed to initialize gyro shared memory", "error", err)
+		return err
+	}
+	go media.StartStreaming(client, configStruct.DefaultFilePath)
+	// Spectators get the stream too, once they connect to it
+	room.BroadcastMessage(types.Message{
+		Type:    "vr_ready",
+		Message: "VR process started",
+		From:    client.GetPeerID(),
+	}, "")
+	client.Logger().Info("VR started", "path", configStruct.DefaultFilePath)
+	return nil
 }
 
 func handleStartStream(client *Client, msg types.Message) error {
 	mediaFile := msg.Data
-	configStruct := config.Load()
+	configStruct := config.Current()
 	if mediaFile == "" {
 		mediaFile = configStruct.DefaultFilePath // change it to whatever you want
 	}
 
 	go func() {
 		if err := media.StartStreaming(client, mediaFile); err != nil {
-			log.Printf("Failed to start media stream: %v", err)
+			client.Logger().Error("Failed to start media stream", "error", err)
 			client.SendError(fmt.Sprintf("Failed to start stream: %v", err))
 		}
 	}()
@@ -163,89 +291,88 @@ func handleStartStream(client *Client, msg types.Message) error {
 
 func handleStopStream(client *Client) error {
 	media.StopStreaming(client)
-	isrunning = false
-	log.Println("Stream stopped for client:", client.GetPeerID(), "isrunning:", isrunning)
+	client.GetSession().SetRunning(false)
+	client.Logger().Info("Stream stopped")
 	return client.SendMessage(types.Message{
 		Type:    "stream_stopped",
 		Message: "Stream stopped",
 	})
 }
 
-func handleWebRTCOffer(client *Client, msg types.Message, room *Room) error {
-	if msg.Target != "" && msg.Target != client.GetPeerID() {
-		return room.ForwardMessage(msg, msg.Target)
+// forwardSignal relays msg to target and reports whether it did. Signalling
+// without a target, or addressed to the client itself, is for the server.
+func forwardSignal(client *Client, room *Room, msg types.Message, target string) (bool, error) {
+	if target == "" || target == client.GetPeerID() {
+		return false, nil
+	}
+	msg.From = client.GetPeerID()
+	msg.Target = target
+	return true, room.ForwardMessage(msg, target)
+}
+
+func handleWebRTCOffer(client *Client, room *Room, payload *offerPayload) error {
+	msg := types.Message{Type: "webrtc_offer", Offer: payload.Offer}
+	if forwarded, err := forwardSignal(client, room, msg, payload.Target); forwarded {
+		return err
 	}
 	return webrtc.HandleOffer(client, msg)
 }
 
-func handleWebRTCAnswer(client *Client, msg types.Message, room *Room) error {
-	if msg.Target != "" && msg.Target != client.GetPeerID() {
-		return room.ForwardMessage(msg, msg.Target)
+func handleWebRTCAnswer(client *Client, room *Room, payload *answerPayload) error {
+	msg := types.Message{Type: "webrtc_answer", Answer: payload.Answer}
+	if forwarded, err := forwardSignal(client, room, msg, payload.Target); forwarded {
+		return err
 	}
-	isrunning = true
-	log.Println("Stream started for client:", client.GetPeerID(), "isrunning:", isrunning)
+	client.GetSession().SetRunning(true)
+	client.Logger().Info("Stream started")
 	return webrtc.HandleAnswer(client, msg)
 }
 
-func handleWebRTCICECandidate(client *Client, msg types.Message, room *Room) error {
-	if msg.Target != "" && msg.Target != client.GetPeerID() {
-		return room.ForwardMessage(msg, msg.Target)
+func handleWebRTCICECandidate(client *Client, room *Room, payload *candidatePayload) error {
+	msg := types.Message{Type: "webrtc_ice_candidate", Candidate: payload.Candidate}
+	if forwarded, err := forwardSignal(client, room, msg, payload.Target); forwarded {
+		return err
 	}
 	return webrtc.HandleICECandidate(client, msg)
 }
 
-func handleEncryptedData(client *Client, msg types.Message, room *Room) error {
-	decryptedData, err := client.DecryptData(msg.Data)
+func handleGyroData(client *Client, room *Room, payload *gyroPayload) error {
+	host, err := vrHost(room)
 	if err != nil {
-		return fmt.Errorf("decryption failed: %w", err)
-	}
-
-	/*var controlMsg map[string]interface{}
-	if err := json.Unmarshal(decryptedData, &controlMsg); err != nil {
-		return fmt.Errorf("invalid control message: %w", err)
-	}
-
-	msgType, ok := controlMsg["type"].(string)
-	if !ok {
-		return fmt.Errorf("invalid control message type")
+		return err
 	}
-
-	return handleControlMessage(client, msgType, controlMsg)*/
-
-	return HandleJSONMessage(client, decryptedData, room)
-}
-
-func handleGyroData(client *Client, msg types.Message) error {
 	data := map[string]interface{}{
-		"alpha":     msg.Alpha,
-		"beta":      msg.Beta,
-		"gamma":     msg.Gamma,
+		"alpha":     payload.Alpha,
+		"beta":      payload.Beta,
+		"gamma":     payload.Gamma,
 		"timestamp": time.Now().UnixMilli(),
 	}
-	// log.Printf("Received gyro data from %s: %+v", client.GetPeerID(), data)
-	if err := stdinWriter.WriteStdin(data, isrunning, 0); err != nil {
-		log.Println("Error writing gyro data to Stdin:", err)
+	if err := host.GetSession().WriteGyro(data); err != nil {
+		client.stdinLog.Log(client.Logger(), slog.LevelWarn, "Error writing gyro data to stdin", "error", err)
 	}
 
 	return nil
 }
 
-func handleHandData(client *Client, msg types.Message) error {
+func handleHandData(client *Client, room *Room, payload *handPayload) error {
 	// 1. If the payload has no hands, it's a valid state (no hands in view).
-	if len(msg.Hands.Payload) == 0 {
+	if len(payload.Hands.Payload) == 0 {
 		return nil
 	}
+	host, err := vrHost(room)
+	if err != nil {
+		return err
+	}
 
-	// 2. Log receipt of data for operational awareness.
-	log.Printf("📡 Hand data received from peer %s, writing to process.", client.GetPeerID())
+	// 2. Log receipt of data for operational awareness, at most every few seconds.
+	client.handLog.Log(client.Logger(), slog.LevelDebug, "Hand data received, writing to process", "hands", len(payload.Hands.Payload))
 
 	// 3. Pass the hand data payload to the generic writer.
-	// We pass `msg.Hands.Payload`, which is a slice of Hand structs.
+	// We pass `payload.Hands.Payload`, which is a slice of Hand structs.
 	// `WriteStdin` will marshal this slice into a JSON array.
 	// `WriteStdinHandData` will then wrap it in the final object.
-	// The '1' indicates this is hand data.
-	if err := stdinWriter.WriteStdin(msg.Hands.Payload, isrunning, 1); err != nil {
-		log.Println("Error writing hand data to Stdin:", err)
+	if err := host.GetSession().WriteHand(payload.Hands.Payload); err != nil {
+		client.stdinLog.Log(client.Logger(), slog.LevelWarn, "Error writing hand data to stdin", "error", err)
 		// We log the error but return nil to allow the server to continue,
 		// matching the pattern of a fire-and-forget handler.
 	}
@@ -253,104 +380,58 @@ func handleHandData(client *Client, msg types.Message) error {
 	return nil
 }
 
-func handleEncryptedHandData(client *Client, handData map[string]interface{}) error {
-	rawHands, ok := handData["hands"]
-	if !ok {
-		log.Printf("🔸 'hands' field missing from handData for %s", client.GetPeerID())
-		return nil
+func handlePause(client *Client, room *Room, _ *emptyPayload) error {
+	host, err := vrHost(room)
+	if err != nil {
+		return err
 	}
+	client.Logger().Info("Received pause command")
+	// return handleStopStream(client)
+	host.SetPaused(true)
+	return nil
+}
 
-	hands, ok := rawHands.([]interface{})
-	if !ok {
-		log.Printf("🔸 Invalid 'hands' format from %s", client.GetPeerID())
-		return nil
+func handleResume(client *Client, room *Room, _ *emptyPayload) error {
+	host, err := vrHost(room)
+	if err != nil {
+		return err
 	}
+	client.Logger().Info("Received resume command")
+	// return handleStartStream(client, msg)
+	host.SetPaused(false)
+	return nil
+}
 
-	log.Printf("  Hand data received from peer %s:", client.GetPeerID())
-
-	for handIndex, hand := range hands {
-		landmarks, ok := hand.([]interface{})
-		if !ok {
-			log.Printf("    Hand %d has invalid landmark data", handIndex+1)
-			continue
-		}
-
-		log.Printf("    Hand %d:", handIndex+1)
-
-		for landmarkIndex, point := range landmarks {
-			coords, ok := point.([]interface{})
-			if !ok || len(coords) < 3 {
-				log.Printf("    Landmark %d → incomplete or invalid point data", landmarkIndex)
-				continue
-			}
-
-			x, xOk := coords[0].(float64)
-			y, yOk := coords[1].(float64)
-			z, zOk := coords[2].(float64)
-
-			if xOk && yOk && zOk {
-				log.Printf("    Landmark %2d → x: %.4f, y: %.4f, z: %.4f", landmarkIndex, x, y, z)
-			} else {
-				log.Printf("    Landmark %2d → invalid coordinate types", landmarkIndex)
-			}
-		}
+func handleTerminate(client *Client, room *Room, _ *emptyPayload) error {
+	host, err := vrHost(room)
+	if err != nil {
+		return err
 	}
+	client.Logger().Info("Received terminate command")
+	host.SetStreaming(false)
+	host.GetSession().Close(time.Duration(config.Current().Shutdown.ProcessGrace))
+	return messageErrorf(ErrCodeTerminated, "client requested termination")
+}
 
+func handleQuality(client *Client, room *Room, payload *qualityPayload) error {
+	client.Logger().Info("Received quality change", "value", payload.Value)
 	return nil
 }
 
-
-
-func handleControlMessage(client *Client, msgType string, controlMsg map[string]interface{}) error {
-	switch msgType {
-	case "start_vr":
-		err := stdinWriter.NewSharedMemoryWriter("gyro.dat", 65536) // initialize the gyroWriter on key exchange complete
-		if err != nil {
-			log.Fatal("Failed to initialize gyro shared memory:", err)
-			return err
-		}
-		configStruct := config.Load()
-		go media.StartStreaming(client, configStruct.DefaultFilePath)
-		client.SendMessage(types.Message{
-			Type:    "vr_ready",
-			Message: "VR process started",
-		})
-		log.Printf("VR started for client %s", client.GetPeerID())
-	
-	case "hand":
-		return handleEncryptedHandData(client, controlMsg)
-
-	case "pause":
-		log.Printf("Received pause command from %s", client.GetPeerID())
-		return handleStopStream(client)
-
-	case "resume":
-		log.Printf("Received resume command from %s", client.GetPeerID())
-		// return handleStartStream(client, controlMsg)
-
-	case "terminate":
-		log.Printf("Received terminate command from %s", client.GetPeerID())
-		client.SetStreaming(false)
-		stdinWriter.Close()
-		return fmt.Errorf("client requested termination")
-
-	case "quality":
-		if value, ok := controlMsg["value"].(float64); ok {
-			log.Printf("Received quality change from %s: %d", client.GetPeerID(), int(value))
-		}
-
-	case "toggle_vr_debugging":
-		if enabled, ok := controlMsg["enabled"].(bool); ok {
-			log.Printf("VR debugging toggled by %s: %t", client.GetPeerID(), enabled)
-			client.SendMessage(types.Message{
-				Type:    "vr_debugging_status",
-				Message: fmt.Sprintf("VR debugging %s", map[bool]string{true: "enabled", false: "disabled"}[enabled]),
-			})
-		}
-
-	default:
-		log.Printf("Unknown binary control message type from %s: %s", client.GetPeerID(), msgType)
+func handleTransferControl(client *Client, room *Room, payload *transferControlPayload) error {
+	if err := room.TransferControl(payload.Target); err != nil {
+		return err
 	}
-
+	client.Logger().Info("Control transferred", "controller", payload.Target)
+	announceRoles(room, client.GetPeerID(), "")
 	return nil
 }
+
+func handleToggleVRDebugging(client *Client, room *Room, payload *toggleDebuggingPayload) error {
+	client.Logger().Info("VR debugging toggled", "enabled", payload.Enabled)
+	return client.SendMessage(types.Message{
+		Type:    "vr_debugging_status",
+		Message: fmt.Sprintf("VR debugging %s", map[bool]string{true: "enabled", false: "disabled"}[payload.Enabled]),
+		Enabled: payload.Enabled,
+	})
+}
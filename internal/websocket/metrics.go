@@ -0,0 +1,119 @@
+package websocket
+
+import (
+    "errors"
+    "math"
+
+    "VR-Distributed/internal/crypto"
+    "VR-Distributed/internal/metrics"
+)
+
+var (
+    messagesReceived = metrics.NewCounterVec("vr_websocket_messages_total",
+        "WebSocket messages received, by message type.", "type")
+    decryptionFailures = metrics.NewCounter("vr_decryption_failures_total",
+        "Encrypted client messages that failed to decrypt.")
+    replayRejected = metrics.NewCounterVec("vr_replay_rejected_total",
+        "Encrypted client frames rejected by the replay window, by reason.", "reason")
+    authFailures = metrics.NewCounterVec("vr_auth_failures_total",
+        "WebSocket connection requests rejected before the upgrade, by reason.", "reason")
+    connectionRejections = metrics.NewCounterVec("vr_websocket_rejections_total",
+        "WebSocket connection requests rejected by the origin allow-list or per-IP cap, by reason.", "reason")
+    oversizedMessages = metrics.NewCounterVec("vr_websocket_oversized_messages_total",
+        "WebSocket connections closed for a message over its size limit, by message class.", "class")
+    rateLimited = metrics.NewCounterVec("vr_rate_limited_total",
+        "Client messages over their rate limit, by message type (all for the client-wide limit) and the policy applied.", "type", "policy")
+    sendQueueOverflows = metrics.NewCounter("vr_websocket_send_queue_overflows_total",
+        "Clients disconnected because their outbound queue was full.")
+    idleTimeouts = metrics.NewCounter("vr_websocket_idle_timeouts_total",
+        "Clients disconnected after sending nothing, not even a pong, for websocket.idle_timeout.")
+    pingRTT = metrics.NewHistogram("vr_websocket_ping_rtt_seconds",
+        "Round trip of WebSocket pings to clients.",
+        metrics.ExponentialBuckets(0.005, 2, 10))
+    roomRejections = metrics.NewCounterVec("vr_room_join_rejections_total",
+        "Clients refused by their room, by error code: room_full, room_password or room_closed.", "code")
+    resumeEvents = metrics.NewCounterVec("vr_session_resume_events_total",
+        "Sessions detached after losing their connection, and whether they were then resumed, rejected or expired.", "event")
+    rekeys = metrics.NewCounterVec("vr_rekeys_total",
+        "Session keys rotated, by the side that initiated the rekey.", "initiator")
+)
+
+func init() {
+    metrics.NewGaugeFunc("vr_rooms", "Rooms currently known to the server.", func() float64 {
+        roomsMutex.RLock()
+        defer roomsMutex.RUnlock()
+        return float64(len(rooms))
+    })
+    // Room IDs are chosen by clients and /metrics is public, so rooms are
+    // not labelled by ID: clients per room are shown as the number of rooms
+    // of each size and the largest room. The admin API lists them by room.
+    metrics.NewGaugeFunc("vr_clients", "Clients connected across all rooms.", func() float64 {
+        roomsMutex.RLock()
+        defer roomsMutex.RUnlock()
+        count := 0
+        for _, room := range rooms {
+            count += room.GetClientCount()
+        }
+        return float64(count)
+    })
+    metrics.NewGaugeVecFunc("vr_rooms_by_size", "Rooms by the number of clients connected to them.", "clients", func() map[string]float64 {
+        counts := make(map[string]float64, len(roomSizeBuckets))
+        for _, bucket := range roomSizeBuckets {
+            counts[bucket.label] = 0
+        }
+        roomsMutex.RLock()
+        defer roomsMutex.RUnlock()
+        for _, room := range rooms {
+            counts[roomSizeLabel(room.GetClientCount())]++
+        }
+        return counts
+    })
+    metrics.NewGaugeFunc("vr_room_clients_max", "Clients connected to the largest room.", func() float64 {
+        roomsMutex.RLock()
+        defer roomsMutex.RUnlock()
+        largest := 0
+        for _, room := range rooms {
+            largest = max(largest, room.GetClientCount())
+        }
+        return float64(largest)
+    })
+}
+
+// roomSizeBuckets are the label values of vr_rooms_by_size, each holding
+// rooms of up to max clients.
+var roomSizeBuckets = []struct {
+    max   int
+    label string
+}{
+    {0, "0"},
+    {1, "1"},
+    {2, "2"},
+    {4, "3-4"},
+    {8, "5-8"},
+    {math.MaxInt, "9+"},
+}
+
+func roomSizeLabel(clients int) string {
+    for _, bucket := range roomSizeBuckets {
+        if clients <= bucket.max {
+            return bucket.label
+        }
+    }
+    return ""
+}
+
+func replayReason(err error) string {
+    if errors.Is(err, crypto.ErrReplayed) {
+        return "duplicate"
+    }
+    return "out_of_window"
+}
+
+// messageTypeLabel bounds the label values of messagesReceived so clients
+// cannot create unbounded series by sending made-up types.
+func messageTypeLabel(msgType string) string {
+    if _, ok := messageHandlers[msgType]; ok {
+        return msgType
+    }
+    return "unknown"
+}
@@ -0,0 +1,116 @@
+package websocket
+
+import (
+    "sort"
+    "strings"
+    "time"
+    "unicode"
+
+    "VR-Distributed/pkg/types"
+)
+
+// Ping round trips below which a peer's latency is shown as good or fair.
+// Anything slower is poor.
+const (
+    goodLatency = 100 * time.Millisecond
+    fairLatency = 250 * time.Millisecond
+)
+
+// maxNameLength limits display names, in characters.
+const maxNameLength = 64
+
+// displayName cleans up the display name a client asked for, falling back
+// to its peer ID.
+func displayName(name, peerID string) string {
+    name = strings.TrimSpace(strings.Map(func(r rune) rune {
+        if unicode.IsControl(r) {
+            return -1
+        }
+        return r
+    }, name))
+    if runes := []rune(name); len(runes) > maxNameLength {
+        name = string(runes[:maxNameLength])
+    }
+    if name == "" {
+        return peerID
+    }
+    return name
+}
+
+// latencyClass buckets a ping round trip for display.
+func latencyClass(rtt time.Duration) string {
+    switch {
+    case rtt <= 0:
+        return "unknown"
+    case rtt < goodLatency:
+        return "good"
+    case rtt < fairLatency:
+        return "fair"
+    }
+    return "poor"
+}
+
+// GetName returns the client's display name.
+func (c *Client) GetName() string {
+    return c.name
+}
+
+// PeerState returns what the other clients in its room see of the client.
+func (c *Client) PeerState() types.PeerState {
+    return types.PeerState{
+        PeerID:    c.peerID,
+        Name:      c.name,
+        Role:      c.RoomRole(),
+        Streaming: c.IsStreaming(),
+        Paused:    c.IsPaused(),
+        Latency:   latencyClass(c.RTT()),
+        Detached:  c.IsDetached(),
+    }
+}
+
+// markPresence records the client's state as the one its room knows, and
+// returns it for the peer_joined message.
+func (c *Client) markPresence() types.PeerState {
+    c.presenceMutex.Lock()
+    defer c.presenceMutex.Unlock()
+    c.presence = c.PeerState()
+    return c.presence
+}
+
+// announcePresence broadcasts a presence message to the client's room,
+// the client included, if its state changed since the room last heard of
+// it. A client that is closing is announced by peer_left instead.
+func (c *Client) announcePresence() {
+    room := c.joinedRoom.Load()
+    if room == nil || c.IsClosed() {
+        return
+    }
+    c.presenceMutex.Lock()
+    defer c.presenceMutex.Unlock()
+    state := c.PeerState()
+    if state == c.presence {
+        return
+    }
+    c.presence = state
+    room.BroadcastMessage(types.Message{Type: "presence", Peer: &state}, "")
+}
+
+// roomState lists the room's peers in the order they connected, for a
+// client that just joined it.
+func roomState(room *Room) types.Message {
+    clients := room.Clients()
+    sort.Slice(clients, func(i, j int) bool { return clients[i].connectedAt.Before(clients[j].connectedAt) })
+
+    peers := make([]types.PeerState, 0, len(clients))
+    for _, client := range clients {
+        peers = append(peers, client.PeerState())
+    }
+    host, controller := room.roles()
+    return types.Message{
+        Type:       "room_state",
+        Room:       room.GetID(),
+        Host:       host,
+        Controller: controller,
+        Peers:      peers,
+    }
+}
@@ -0,0 +1,180 @@
+package websocket
+
+import (
+    "log/slog"
+    "math"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/internal/config"
+    "VR-Distributed/pkg/types"
+)
+
+// clientBucket is the key of the client-wide bucket in rateLimiter.
+const clientBucket = ""
+
+// tokenBucket allows limit.Rate messages per second on average, with bursts
+// of up to limit.Burst.
+type tokenBucket struct {
+    limit  config.RateLimit
+    tokens float64
+    last   time.Time
+}
+
+func newTokenBucket(limit config.RateLimit, now time.Time) *tokenBucket {
+    return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// take removes a token if one is available. Otherwise it returns how long
+// until the next one is.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+    b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+    b.last = now
+    if b.tokens >= 1 {
+        b.tokens--
+        return true, 0
+    }
+    return false, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// coalescedMessage is the latest message of a type held back by the
+// coalesce policy, handled once its bucket has a token again.
+type coalescedMessage struct {
+    data   []byte
+    handle func(data []byte) error
+    timer  *time.Timer
+}
+
+// rateLimiter holds a client's token buckets, by message type and
+// clientBucket for the client-wide one. A bucket is rebuilt when its
+// configured limit changes, so reloads apply to connected clients.
+type rateLimiter struct {
+    mutex     sync.Mutex
+    buckets   map[string]*tokenBucket
+    coalesced map[string]*coalescedMessage
+    stopped   bool
+}
+
+// take takes a token from the bucket for key. A zero rate always allows.
+func (l *rateLimiter) take(key string, limit config.RateLimit) (bool, time.Duration) {
+    if limit.Rate <= 0 {
+        return true, 0
+    }
+    now := time.Now()
+    bucket, ok := l.buckets[key]
+    if !ok || bucket.limit != limit {
+        if l.buckets == nil {
+            l.buckets = make(map[string]*tokenBucket)
+        }
+        bucket = newTokenBucket(limit, now)
+        l.buckets[key] = bucket
+    }
+    return bucket.take(now)
+}
+
+// stop cancels any coalesced messages not yet handled.
+func (l *rateLimiter) stop() {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    l.stopped = true
+    for _, pending := range l.coalesced {
+        pending.timer.Stop()
+    }
+    l.coalesced = nil
+}
+
+// allowMessage applies the client-wide rate limit to a message just read,
+// before it is decrypted or parsed. It reports whether the message may be
+// handled.
+func (c *Client) allowMessage() bool {
+    limit := config.Current().RateLimit.Client
+    c.rateLimiter.mutex.Lock()
+    ok, _ := c.rateLimiter.take(clientBucket, limit)
+    c.rateLimiter.mutex.Unlock()
+
+    if !ok {
+        c.rateLimited("all", limit.Policy)
+    }
+    return ok
+}
+
+// allowType applies the rate limit configured for msgType. It reports
+// whether the caller should handle the message now. Under the coalesce
+// policy a message over the limit replaces any earlier one of its type
+// still waiting, and the latest is passed to handle once a token is free.
+func (c *Client) allowType(msgType string, data []byte, handle func(data []byte) error) bool {
+    limit, ok := config.Current().RateLimit.Types[msgType]
+    if !ok {
+        return true
+    }
+
+    c.rateLimiter.mutex.Lock()
+    if pending, ok := c.rateLimiter.coalesced[msgType]; ok {
+        // Keep the order of the type: anything newer waits behind the
+        // message already held back
+        pending.data, pending.handle = data, handle
+        c.rateLimiter.mutex.Unlock()
+        rateLimited.WithLabelValues(msgType, limit.Policy).Inc()
+        return false
+    }
+    allowed, wait := c.rateLimiter.take(msgType, limit)
+    if !allowed && limit.Policy == config.RateLimitCoalesce && !c.rateLimiter.stopped {
+        if c.rateLimiter.coalesced == nil {
+            c.rateLimiter.coalesced = make(map[string]*coalescedMessage)
+        }
+        c.rateLimiter.coalesced[msgType] = &coalescedMessage{
+            data:   data,
+            handle: handle,
+            timer:  time.AfterFunc(wait, func() { c.flushCoalesced(msgType) }),
+        }
+    }
+    c.rateLimiter.mutex.Unlock()
+
+    if !allowed {
+        c.rateLimited(msgType, limit.Policy)
+    }
+    return allowed
+}
+
+// flushCoalesced handles the message of msgType held back by the coalesce
+// policy, or waits again if its bucket is still empty.
+func (c *Client) flushCoalesced(msgType string) {
+    limit := config.Current().RateLimit.Types[msgType]
+
+    c.rateLimiter.mutex.Lock()
+    pending, ok := c.rateLimiter.coalesced[msgType]
+    if !ok {
+        c.rateLimiter.mutex.Unlock()
+        return
+    }
+    if allowed, wait := c.rateLimiter.take(msgType, limit); !allowed {
+        pending.timer.Reset(wait)
+        c.rateLimiter.mutex.Unlock()
+        return
+    }
+    delete(c.rateLimiter.coalesced, msgType)
+    c.rateLimiter.mutex.Unlock()
+
+    if err := pending.handle(pending.data); err != nil {
+        c.Logger().Warn("Error handling coalesced message", "type", msgType, "error", err)
+        c.SendErrorCode(errorCode(err), err.Error())
+    }
+}
+
+// rateLimited counts a message over its limit and applies policy. Dropped
+// and coalesced messages are not answered, so a flood does not turn into
+// a flood of error replies.
+func (c *Client) rateLimited(msgType, policy string) {
+    rateLimited.WithLabelValues(msgType, policy).Inc()
+    c.rateLog.Log(c.Logger(), slog.LevelWarn, "Rate limit exceeded", "type", msgType, "policy", policy)
+    if policy == config.RateLimitDisconnect {
+        c.Logger().Warn("Disconnecting client over rate limit", "type", msgType)
+        disconnect(c, types.Message{
+            Type:    "error",
+            Code:    ErrCodeRateLimited,
+            Message: "rate limit exceeded for " + msgType + " messages",
+        }, websocket.ClosePolicyViolation)
+    }
+}
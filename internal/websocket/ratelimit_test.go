@@ -0,0 +1,220 @@
+package websocket
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/internal/auth"
+    "VR-Distributed/internal/config"
+)
+
+// testControlType is a message type only the room's controller may send,
+// which records the clients that got it handled.
+const testControlType = "test_control"
+
+var testControlHandled struct {
+    mutex sync.Mutex
+    peers []string
+}
+
+func init() {
+    registerMessage(testControlType, flagControl, func(client *Client, room *Room, _ *emptyPayload) error {
+        testControlHandled.mutex.Lock()
+        defer testControlHandled.mutex.Unlock()
+        testControlHandled.peers = append(testControlHandled.peers, client.GetPeerID())
+        return nil
+    })
+}
+
+func handledControl() []string {
+    testControlHandled.mutex.Lock()
+    defer testControlHandled.mutex.Unlock()
+    return append([]string(nil), testControlHandled.peers...)
+}
+
+// withRateLimit installs a config limiting msgType for the duration of the
+// test.
+func withRateLimit(t *testing.T, msgType string, limit config.RateLimit) {
+    t.Helper()
+    previous := config.Current()
+    cfg := config.Default()
+    cfg.RateLimit.Types = map[string]config.RateLimit{msgType: limit}
+    config.Store(cfg)
+    t.Cleanup(func() { config.Store(previous) })
+}
+
+// newTestClient returns a client on the server side of a real connection.
+func newTestClient(t *testing.T, peerID string, roles ...string) *Client {
+    t.Helper()
+    conns := make(chan *websocket.Conn, 1)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+        if err != nil {
+            t.Error(err)
+            return
+        }
+        conns <- conn
+    }))
+    t.Cleanup(server.Close)
+
+    peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { peer.Close() })
+    // Keep reading so the client's writer never blocks
+    go func() {
+        for {
+            if _, _, err := peer.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }()
+
+    client := NewClient(<-conns, peerID, "rate-limit-test")
+    client.roles = roles
+    t.Cleanup(func() { client.Close() })
+    return client
+}
+
+func TestTokenBucket(t *testing.T) {
+    start := time.Unix(1_700_000_000, 0)
+    bucket := newTokenBucket(config.RateLimit{Rate: 2, Burst: 2}, start)
+
+    for i := 0; i < 2; i++ {
+        if ok, _ := bucket.take(start); !ok {
+            t.Fatalf("take %d refused within the burst", i+1)
+        }
+    }
+    ok, wait := bucket.take(start)
+    if ok {
+        t.Fatal("take allowed past the burst")
+    }
+    if wait != 500*time.Millisecond {
+        t.Fatalf("wait = %s, want 500ms at 2 tokens a second", wait)
+    }
+    if ok, _ := bucket.take(start.Add(250 * time.Millisecond)); ok {
+        t.Fatal("take allowed before a token was refilled")
+    }
+    if ok, _ := bucket.take(start.Add(500 * time.Millisecond)); !ok {
+        t.Fatal("take refused once a token was refilled")
+    }
+
+    // A long pause refills no more than the burst
+    later := start.Add(time.Hour)
+    for i := 0; i < 2; i++ {
+        if ok, _ := bucket.take(later); !ok {
+            t.Fatalf("take %d refused after the bucket refilled", i+1)
+        }
+    }
+    if ok, _ := bucket.take(later); ok {
+        t.Fatal("bucket refilled past its burst")
+    }
+}
+
+func TestAllowTypeDrop(t *testing.T) {
+    withRateLimit(t, "gyro", config.RateLimit{Rate: 1, Burst: 1, Policy: config.RateLimitDrop})
+    client := newTestClient(t, "a")
+
+    handled := 0
+    handle := func([]byte) error { handled++; return nil }
+    if !client.allowType("gyro", []byte("1"), handle) {
+        t.Fatal("first message refused")
+    }
+    if client.allowType("gyro", []byte("2"), handle) {
+        t.Fatal("message over the limit allowed")
+    }
+    time.Sleep(1100 * time.Millisecond)
+    if handled != 0 {
+        t.Fatal("dropped message was handled later")
+    }
+    if client.IsClosed() {
+        t.Fatal("client disconnected under the drop policy")
+    }
+}
+
+func TestAllowTypeCoalesce(t *testing.T) {
+    withRateLimit(t, "gyro", config.RateLimit{Rate: 10, Burst: 1, Policy: config.RateLimitCoalesce})
+    client := newTestClient(t, "a")
+
+    handled := make(chan string, 4)
+    handle := func(data []byte) error { handled <- string(data); return nil }
+    if !client.allowType("gyro", []byte("1"), handle) {
+        t.Fatal("first message refused")
+    }
+    for _, data := range []string{"2", "3", "4"} {
+        if client.allowType("gyro", []byte(data), handle) {
+            t.Fatalf("message %s over the limit allowed", data)
+        }
+    }
+
+    select {
+    case data := <-handled:
+        if data != "4" {
+            t.Fatalf("coalesced message %s handled, want the latest, 4", data)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("coalesced message was never handled")
+    }
+    select {
+    case data := <-handled:
+        t.Fatalf("superseded message %s handled too", data)
+    case <-time.After(200 * time.Millisecond):
+    }
+}
+
+func TestAllowTypeDisconnect(t *testing.T) {
+    withRateLimit(t, "gyro", config.RateLimit{Rate: 1, Burst: 1, Policy: config.RateLimitDisconnect})
+    client := newTestClient(t, "a")
+
+    handle := func([]byte) error { return nil }
+    client.allowType("gyro", nil, handle)
+    if client.allowType("gyro", nil, handle) {
+        t.Fatal("message over the limit allowed")
+    }
+    if !client.IsClosed() {
+        t.Fatal("client not disconnected under the disconnect policy")
+    }
+}
+
+// TestCoalescedMessageRechecksRole checks that a message held back by the
+// rate limit is not handled if its sender lost control in the meantime.
+func TestCoalescedMessageRechecksRole(t *testing.T) {
+    withRateLimit(t, testControlType, config.RateLimit{Rate: 5, Burst: 1, Policy: config.RateLimitCoalesce})
+    host := newTestClient(t, "host", auth.RoleHost)
+    controller := newTestClient(t, "controller", auth.RoleController)
+    room := NewRoom("rate-limit-test", "host", "", "")
+    for _, client := range []*Client{host, controller} {
+        if err := room.AddClient(client, ""); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := room.TransferControl("controller"); err != nil {
+        t.Fatal(err)
+    }
+
+    msg := []byte(`{"type":"` + testControlType + `"}`)
+    before := len(handledControl())
+    for i := 0; i < 2; i++ {
+        if err := dispatch(controller, room, msg, true); err != nil {
+            t.Fatalf("dispatch %d: %v", i+1, err)
+        }
+    }
+    if err := room.TransferControl("host"); err != nil {
+        t.Fatal(err)
+    }
+    // The coalesced message is due after 200ms
+    time.Sleep(500 * time.Millisecond)
+
+    if handled := handledControl()[before:]; len(handled) != 1 {
+        t.Fatalf("handled %v, want only the message sent while in control", handled)
+    }
+    if err := dispatch(controller, room, msg, true); err == nil {
+        t.Fatal("message from a former controller accepted")
+    }
+}
@@ -0,0 +1,254 @@
+package websocket
+
+import (
+    "crypto/rand"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/internal/config"
+    "VR-Distributed/pkg/types"
+)
+
+// errSessionTaken is returned by reattach when another connection resumed
+// the session first.
+var errSessionTaken = errors.New("session was resumed by another connection")
+
+// Clients that can be resumed, by resume token. A client's token is
+// replaced on every resume and forgotten when its session ends.
+var (
+    resumeTokens      = make(map[string]*Client)
+    resumeTokensMutex sync.Mutex
+)
+
+// offerResume issues the client a new resume token in a msgType message,
+// replacing its previous one. It is only sent encrypted, so a token seen on
+// the wire is useless without the session key. Nothing is sent when
+// websocket.resume_grace is 0.
+func (c *Client) offerResume(msgType string) error {
+    if config.Current().WebSocket.ResumeGrace <= 0 {
+        return nil
+    }
+    raw := make([]byte, 32)
+    if _, err := rand.Read(raw); err != nil {
+        return fmt.Errorf("failed to generate resume token: %w", err)
+    }
+    token := base64.RawURLEncoding.EncodeToString(raw)
+
+    resumeTokensMutex.Lock()
+    delete(resumeTokens, c.resumeToken)
+    c.resumeToken = token
+    resumeTokens[token] = c
+    resumeTokensMutex.Unlock()
+
+    return c.SendMessage(types.Message{Type: msgType, PeerID: c.peerID, Room: c.room, ResumeToken: token})
+}
+
+// forgetResume invalidates the client's resume token.
+func (c *Client) forgetResume() {
+    resumeTokensMutex.Lock()
+    defer resumeTokensMutex.Unlock()
+    if resumeTokens[c.resumeToken] == c {
+        delete(resumeTokens, c.resumeToken)
+    }
+    c.resumeToken = ""
+}
+
+// resumable reports whether the client's session can outlive a connection
+// that ended with err: it holds a resume token, was not disconnected by the
+// server, did not close the socket itself and did not send a message over
+// its size limit.
+func (c *Client) resumable(err error) bool {
+    if config.Current().WebSocket.ResumeGrace <= 0 || c.IsClosed() || !c.IsKeyed() {
+        return false
+    }
+    if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+        return false
+    }
+    if errors.Is(err, errMessageTooBig) || errors.Is(err, websocket.ErrReadLimit) {
+        return false
+    }
+    select {
+    case <-c.sendQueue.overflow:
+        return false
+    default:
+    }
+    resumeTokensMutex.Lock()
+    defer resumeTokensMutex.Unlock()
+    return c.resumeToken != ""
+}
+
+// detach stops the writer of the client's lost connection and keeps the
+// session for grace, calling expire if the client has not reattached by
+// then. Messages sent to a detached client wait in its send queue. It
+// returns false if the client was closed meanwhile.
+func (c *Client) detach(grace time.Duration, expire func()) bool {
+    c.conn.Close()
+    c.attachMutex.Lock()
+    stop, writerDone := c.writerStop, c.writerDone
+    c.attachMutex.Unlock()
+    close(stop)
+    <-writerDone
+
+    c.attachMutex.Lock()
+    defer c.attachMutex.Unlock()
+    if c.IsClosed() {
+        return false
+    }
+    c.detached = true
+    c.expire = expire
+    c.attachChange.Broadcast()
+    c.graceTimer = time.AfterFunc(grace, func() {
+        c.attachMutex.Lock()
+        expired := c.detached
+        c.detached = false
+        c.attachMutex.Unlock()
+        if expired {
+            resumeEvents.WithLabelValues("expired").Inc()
+            c.Logger().Info("Resume grace expired", "grace", grace)
+            expire()
+        }
+    })
+    resumeEvents.WithLabelValues("detached").Inc()
+    return true
+}
+
+// IsDetached reports whether the client lost its connection and is waiting
+// to be resumed.
+func (c *Client) IsDetached() bool {
+    c.attachMutex.Lock()
+    defer c.attachMutex.Unlock()
+    return c.detached
+}
+
+// reattach moves a detached client onto conn. The client already received
+// the frames up to lastSeq; the rest are resent before its queued messages.
+// A client often reconnects before the server notices its old connection
+// dropped, so that connection is closed and reattach waits for the detach.
+func (c *Client) reattach(conn *websocket.Conn, lastSeq uint64) error {
+    c.attachMutex.Lock()
+    defer c.attachMutex.Unlock()
+    if !c.detached && !c.IsClosed() {
+        attachments := c.attachments
+        c.conn.Close()
+        for !c.detached && !c.IsClosed() && c.attachments == attachments {
+            c.attachChange.Wait()
+        }
+        if c.attachments != attachments {
+            return errSessionTaken
+        }
+    }
+    if !c.detached || c.IsClosed() {
+        return errors.New("session has ended")
+    }
+    select {
+    case <-c.sendQueue.overflow:
+        return errors.New("send queue overflowed while detached")
+    default:
+    }
+
+    c.mutex.Lock()
+    replay, err := c.framesAfter(lastSeq)
+    if err == nil {
+        c.conn = conn
+    }
+    c.mutex.Unlock()
+    if err != nil {
+        return err
+    }
+
+    // A timer that already fired finds the client attached and does nothing
+    c.graceTimer.Stop()
+    c.detached = false
+    c.expire = nil
+    c.remoteAddr = conn.RemoteAddr().String()
+    c.lastPing.Store(time.Now().UnixNano())
+    conn.SetPongHandler(c.handlePong)
+    c.extendReadDeadline()
+    c.startWriter(replay)
+    c.attachments++
+    c.attachChange.Broadcast()
+    return nil
+}
+
+// recordFrame keeps a sealed frame for resending after a resume, up to
+// websocket.resume_replay of them. The caller holds mutex.
+func (c *Client) recordFrame(frame []byte) {
+    limit := config.Current().WebSocket.ResumeReplay
+    c.sentFrames = append(c.sentFrames, frame)
+    if excess := len(c.sentFrames) - limit; excess > 0 {
+        c.sentFrames = c.sentFrames[excess:]
+    }
+}
+
+// framesAfter returns the sealed frames the client has not received, given
+// the last sequence number it did. The caller holds mutex.
+func (c *Client) framesAfter(lastSeq uint64) ([][]byte, error) {
+    if lastSeq > c.sendSeq {
+        return nil, fmt.Errorf("client received sequence number %d, only %d sent", lastSeq, c.sendSeq)
+    }
+    missed := c.sendSeq - lastSeq
+    if missed > uint64(len(c.sentFrames)) {
+        return nil, fmt.Errorf("client missed %d messages, %d kept for replay", missed, len(c.sentFrames))
+    }
+    return append([][]byte(nil), c.sentFrames[len(c.sentFrames)-int(missed):]...), nil
+}
+
+// resumeSession reattaches conn to the detached session named by the
+// request's resume token. It returns nil if the request does not resume a
+// session or the session cannot be resumed, and the client then starts a
+// new one.
+func resumeSession(conn *websocket.Conn, r *http.Request, id identity, cfg *config.Config) (*Client, *Room) {
+    query := r.URL.Query()
+    token := requestResumeToken(r)
+    if token == "" {
+        return nil, nil
+    }
+    reject := func(reason string, args ...interface{}) (*Client, *Room) {
+        resumeEvents.WithLabelValues("rejected").Inc()
+        args = append([]interface{}{"reason", reason, "remote_addr", conn.RemoteAddr().String()}, args...)
+        slog.Info("Session not resumed, starting a new one", args...)
+        return nil, nil
+    }
+
+    lastSeq, err := strconv.ParseUint(query.Get("last_seq"), 10, 64)
+    if err != nil {
+        return reject("invalid last_seq", "last_seq", query.Get("last_seq"))
+    }
+    resumeTokensMutex.Lock()
+    client := resumeTokens[token]
+    resumeTokensMutex.Unlock()
+    if client == nil {
+        return reject("unknown resume token")
+    }
+    // With auth enabled the token must name the same peer
+    if client.room != id.roomID || cfg.Auth.Secret != "" && client.peerID != id.peerID {
+        return reject("resume token is for another peer or room", "peer_id", id.peerID, "room", id.roomID)
+    }
+    room := findRoom(client.room)
+    if room == nil {
+        return reject("room no longer exists", "room", client.room)
+    }
+    if err := client.reattach(conn, lastSeq); err != nil {
+        // The client holds the token, so a session it can no longer
+        // resume is not kept waiting for it
+        if err != errSessionTaken {
+            endSession(client, room)
+        }
+        return reject(err.Error(), "peer_id", client.peerID)
+    }
+
+    resumeEvents.WithLabelValues("resumed").Inc()
+    client.Logger().Info("Session resumed", "remote_addr", client.RemoteAddr(), "last_seq", lastSeq)
+    if err := client.offerResume("resumed"); err != nil {
+        client.Logger().Warn("Failed to send resumed message", "error", err)
+    }
+    client.announcePresence()
+    return client, room
+}
@@ -0,0 +1,160 @@
+package websocket
+
+import (
+    "fmt"
+
+    "VR-Distributed/internal/auth"
+    "VR-Distributed/internal/webrtc"
+    "VR-Distributed/pkg/types"
+)
+
+// Room roles. The host starts and stops the VR process, whose stream every
+// other client in the room receives too. Its gyro, hand and playback input
+// comes from the controller, which is the host until it hands control to
+// another peer. Everyone else is a spectator.
+//
+// A client can only take a role its auth token grants: the host role needs
+// auth.RoleHost, control needs auth.RoleController or auth.RoleHost.
+
+// claimHost makes client the host of a room that has none, and its
+// controller if nobody controls it. The caller holds r.mutex.
+func (r *Room) claimHost(client *Client) {
+    if r.host != "" || !client.HasRole(auth.RoleHost) {
+        return
+    }
+    r.host = client.GetPeerID()
+    if r.controller == "" {
+        r.controller = r.host
+    }
+}
+
+// releaseRoles gives up the roles of peerID after it left. The host role
+// passes to the longest connected client its token allows to host, and
+// control returns to the host. It reports whether a role changed. The
+// caller holds r.mutex.
+func (r *Room) releaseRoles(peerID string) bool {
+    changed := false
+    if r.host == peerID {
+        r.host = ""
+        var next *Client
+        for _, client := range r.clients {
+            if client.HasRole(auth.RoleHost) && (next == nil || client.connectedAt.Before(next.connectedAt)) {
+                next = client
+            }
+        }
+        if next != nil {
+            r.host = next.GetPeerID()
+        }
+        changed = true
+    }
+    if r.controller == peerID {
+        r.controller = r.host
+        changed = true
+    }
+    return changed
+}
+
+// roles returns the peer IDs of the room's host and controller.
+func (r *Room) roles() (host, controller string) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    return r.host, r.controller
+}
+
+// announceRoles tells the clients in the room but exclude who hosts and
+// controls it after from changed it by joining, leaving or handing over
+// control.
+func announceRoles(room *Room, from, exclude string) {
+    host, controller := room.roles()
+    room.BroadcastMessage(types.Message{
+        Type:       "control_changed",
+        Host:       host,
+        Controller: controller,
+        From:       from,
+    }, exclude)
+}
+
+// GetHost returns the peer ID of the room's host, or "" if it has none.
+func (r *Room) GetHost() string {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    return r.host
+}
+
+// GetController returns the peer ID of the client whose input drives the
+// VR process, or "" if nobody controls it.
+func (r *Room) GetController() string {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    return r.controller
+}
+
+// Role returns the room role of peerID.
+func (r *Room) Role(peerID string) string {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    switch peerID {
+    case r.host:
+        return auth.RoleHost
+    case r.controller:
+        return auth.RoleController
+    }
+    return auth.RoleSpectator
+}
+
+// hostClient returns the host, whose session runs the room's VR process.
+func (r *Room) hostClient() *Client {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    return r.clients[r.host]
+}
+
+// TransferControl hands control of the VR process to target, which must be
+// in the room and allowed to control it.
+func (r *Room) TransferControl(target string) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    client, exists := r.clients[target]
+    if !exists {
+        return fmt.Errorf("peer %s: %w", target, ErrNotFound)
+    }
+    if !client.HasRole(auth.RoleController) && !client.HasRole(auth.RoleHost) {
+        return messageErrorf(ErrCodeForbidden, "peer %s may not take control", target)
+    }
+    r.controller = target
+    return nil
+}
+
+// vrHost returns the host whose VR process the room's controller drives.
+func vrHost(room *Room) (*Client, error) {
+    host := room.hostClient()
+    if host == nil {
+        return nil, messageErrorf(ErrCodeInvalidState, "room %s has no host", room.GetID())
+    }
+    return host, nil
+}
+
+// RoomRole returns the client's role in its room, or "" before it joined.
+func (c *Client) RoomRole() string {
+    room := c.joinedRoom.Load()
+    if room == nil {
+        return ""
+    }
+    return room.Role(c.peerID)
+}
+
+// Viewers returns the clients the host's stream is copied to: everyone
+// else in its room. Other clients have no viewers.
+func (c *Client) Viewers() []webrtc.MediaInterface {
+    room := c.joinedRoom.Load()
+    if room == nil || room.GetHost() != c.peerID {
+        return nil
+    }
+    var viewers []webrtc.MediaInterface
+    for _, client := range room.Clients() {
+        if client != c {
+            viewers = append(viewers, client)
+        }
+    }
+    return viewers
+}
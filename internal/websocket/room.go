@@ -1,43 +1,180 @@
 package websocket
 
 import (
-    "log"
-    "sync"
+    "crypto/sha256"
+    "crypto/subtle"
+    "errors"
     "fmt"
+    "log/slog"
+    "sync"
+    "time"
+
+    "VR-Distributed/internal/config"
     "VR-Distributed/pkg/types"
 )
 
+// Reasons a client cannot join a room.
+var (
+    ErrRoomFull     = errors.New("room is full")
+    ErrRoomClosed   = errors.New("room is closed")
+    ErrRoomPassword = errors.New("wrong room password")
+)
+
+// Room is a set of clients exchanging signalling. The client that creates
+// it is its owner and may give it a title and a password. It is deleted
+// once it has been empty for rooms.linger. Its clients' roles are
+// described in roles.go.
 type Room struct {
-    clients map[string]*Client
-    mutex   sync.RWMutex
+    id           string
+    title        string
+    owner        string
+    createdAt    time.Time
+    passwordHash []byte // nil when the room has no password
+    clients      map[string]*Client
+    host         string // peer IDs, "" when nobody holds the role
+    controller   string
+    closed       bool // deleted, joins fail with ErrRoomClosed
+    linger       *time.Timer
+    mutex        sync.RWMutex
 }
 
-func NewRoom() *Room {
-    return &Room{
-        clients: make(map[string]*Client),
+// NewRoom creates room id for owner. An empty title defaults to the ID and
+// an empty password lets anyone join.
+func NewRoom(id, owner, title, password string) *Room {
+    if title == "" {
+        title = id
+    }
+    room := &Room{
+        id:        id,
+        title:     title,
+        owner:     owner,
+        createdAt: time.Now(),
+        clients:   make(map[string]*Client),
+    }
+    if password != "" {
+        hash := sha256.Sum256([]byte(password))
+        room.passwordHash = hash[:]
     }
+    return room
+}
+
+func (r *Room) GetID() string {
+    return r.id
+}
+
+func (r *Room) GetTitle() string {
+    return r.title
+}
+
+// GetOwner returns the peer ID of the client that created the room.
+func (r *Room) GetOwner() string {
+    return r.owner
 }
 
-func (r *Room) AddClient(client *Client) {
+func (r *Room) GetCreatedAt() time.Time {
+    return r.createdAt
+}
+
+// HasPassword reports whether joining the room requires a password.
+func (r *Room) HasPassword() bool {
+    return r.passwordHash != nil
+}
+
+// AddClient adds client to the room. It fails with ErrRoomClosed once the
+// room is deleted, ErrRoomPassword unless password is the room's, and
+// ErrRoomFull when rooms.max_peers other peers are in it.
+func (r *Room) AddClient(client *Client, password string) error {
     r.mutex.Lock()
     defer r.mutex.Unlock()
+    if r.closed {
+        return ErrRoomClosed
+    }
+    if r.passwordHash != nil {
+        hash := sha256.Sum256([]byte(password))
+        if subtle.ConstantTimeCompare(hash[:], r.passwordHash) != 1 {
+            return ErrRoomPassword
+        }
+    }
+    if _, rejoining := r.clients[client.GetPeerID()]; !rejoining {
+        if maxPeers := config.Current().Rooms.MaxPeers; maxPeers > 0 && len(r.clients) >= maxPeers {
+            return ErrRoomFull
+        }
+    }
+    if r.linger != nil {
+        r.linger.Stop()
+        r.linger = nil
+    }
     r.clients[client.GetPeerID()] = client
+    client.joinedRoom.Store(r)
+    r.claimHost(client)
+    return nil
+}
+
+// RemoveClient removes client, unless another client with the same peer ID
+// has replaced it, and reports whether the room's host or controller
+// changed as a result. The room is deleted once it stays empty for
+// rooms.linger.
+func (r *Room) RemoveClient(client *Client) bool {
+    linger := time.Duration(config.Current().Rooms.Linger)
+    r.mutex.Lock()
+    rolesChanged := false
+    if r.clients[client.GetPeerID()] == client {
+        delete(r.clients, client.GetPeerID())
+        rolesChanged = r.releaseRoles(client.GetPeerID())
+    }
+    empty := len(r.clients) == 0 && !r.closed
+    if empty && linger > 0 && r.linger == nil {
+        r.linger = time.AfterFunc(linger, r.deleteIfEmpty)
+    }
+    r.mutex.Unlock()
+
+    if empty && linger <= 0 {
+        r.deleteIfEmpty()
+    }
+    return rolesChanged
 }
 
-func (r *Room) RemoveClient(peerID string) {
+// deleteIfEmpty deletes the room unless a client joined since it emptied.
+func (r *Room) deleteIfEmpty() {
+    roomsMutex.Lock()
+    defer roomsMutex.Unlock()
     r.mutex.Lock()
     defer r.mutex.Unlock()
-    delete(r.clients, peerID)
+    if r.closed || len(r.clients) > 0 {
+        return
+    }
+    r.closed = true
+    if rooms[r.id] == r {
+        delete(rooms, r.id)
+    }
+    slog.Info("Room deleted", "room", r.id, "age", time.Since(r.createdAt).Round(time.Second))
 }
 
-func (r *Room) BroadcastMessage(msg types.Message, excludePeerID string) {
+// markClosed makes clients still joining the room fail with ErrRoomClosed
+// after it was removed from rooms.
+func (r *Room) markClosed() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.closed = true
+    if r.linger != nil {
+        r.linger.Stop()
+        r.linger = nil
+    }
+}
+
+// GetClient returns the client with peerID.
+func (r *Room) GetClient(peerID string) (*Client, bool) {
     r.mutex.RLock()
     defer r.mutex.RUnlock()
-    
-    for peerID, client := range r.clients {
-        if peerID != excludePeerID {
+    client, exists := r.clients[peerID]
+    return client, exists
+}
+
+func (r *Room) BroadcastMessage(msg types.Message, excludePeerID string) {
+    for _, client := range r.Clients() {
+        if client.GetPeerID() != excludePeerID {
             if err := client.SendMessage(msg); err != nil {
-                log.Printf("Failed to send broadcast message to %s: %v", peerID, err)
+                client.Logger().Warn("Failed to send broadcast message", "type", msg.Type, "error", err)
             }
         }
     }
@@ -45,18 +182,29 @@ func (r *Room) BroadcastMessage(msg types.Message, excludePeerID string) {
 
 func (r *Room) ForwardMessage(msg types.Message, targetPeerID string) error {
     r.mutex.RLock()
-    defer r.mutex.RUnlock()
-    
     target, exists := r.clients[targetPeerID]
+    r.mutex.RUnlock()
     if !exists {
-        return fmt.Errorf("target peer %s not found", targetPeerID)
+        return fmt.Errorf("target peer %s: %w", targetPeerID, ErrNotFound)
     }
-    
+
     return target.SendMessage(msg)
 }
 
+// Clients returns a snapshot of the clients currently in the room.
+func (r *Room) Clients() []*Client {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+
+    clients := make([]*Client, 0, len(r.clients))
+    for _, client := range r.clients {
+        clients = append(clients, client)
+    }
+    return clients
+}
+
 func (r *Room) GetClientCount() int {
     r.mutex.RLock()
     defer r.mutex.RUnlock()
     return len(r.clients)
-}
\ No newline at end of file
+}
@@ -0,0 +1,49 @@
+package websocket
+
+import (
+    "context"
+    "log/slog"
+    "sync"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/pkg/types"
+)
+
+// Shutdown tells every connected client that the server is going away and
+// closes them, stopping their streams, peer connections and VR processes.
+// It returns ctx.Err() if the clients could not be drained before ctx ends.
+func Shutdown(ctx context.Context) error {
+    roomsMutex.RLock()
+    var clients []*Client
+    for _, room := range rooms {
+        clients = append(clients, room.Clients()...)
+    }
+    roomsMutex.RUnlock()
+
+    slog.Info("Draining clients", "count", len(clients))
+
+    var wg sync.WaitGroup
+    for _, client := range clients {
+        wg.Add(1)
+        go func(client *Client) {
+            defer wg.Done()
+            disconnect(client, types.Message{
+                Type:    "server_shutdown",
+                Message: "Server is shutting down",
+            }, websocket.CloseGoingAway)
+        }(client)
+    }
+
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
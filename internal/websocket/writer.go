@@ -0,0 +1,203 @@
+package websocket
+
+import (
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "VR-Distributed/internal/config"
+    "VR-Distributed/pkg/types"
+)
+
+var errClientClosed = errors.New("client is closed")
+
+// lowPriorityTypes are status updates that wait behind signalling, errors
+// and the handshake in a client's send queue.
+var lowPriorityTypes = map[string]bool{
+    "status":              true,
+    "vr_debugging_status": true,
+}
+
+// outbound is a message waiting in a client's send queue. A nonzero
+// closeCode makes it a close frame instead, with msg.Type as the reason,
+// and ping a keepalive ping.
+type outbound struct {
+    msg       types.Message
+    plaintext bool
+    closeCode int
+    ping      bool
+}
+
+// sendQueue holds the messages waiting for a client's writer goroutine,
+// which is the only one writing to its socket. Frames are sealed when they
+// are written, so sequence numbers stay in wire order even when status
+// updates are overtaken. The queue outlives a connection while the client
+// is detached, and the writer of the next one picks it up.
+type sendQueue struct {
+    high     chan outbound
+    low      chan outbound
+    done     chan struct{} // closed by Client.Close
+    overflow chan struct{} // closed when a queue is full
+}
+
+func newSendQueue(size int) sendQueue {
+    return sendQueue{
+        high:     make(chan outbound, size),
+        low:      make(chan outbound, size),
+        done:     make(chan struct{}),
+        overflow: make(chan struct{}),
+    }
+}
+
+// Queued returns the number of messages waiting to be written.
+func (q *sendQueue) Queued() int {
+    return len(q.high) + len(q.low)
+}
+
+// enqueue adds item to the client's send queue without blocking. A full
+// queue means the client cannot keep up, so it is disconnected rather than
+// holding up the sender.
+func (c *Client) enqueue(item outbound) error {
+    select {
+    case <-c.sendQueue.done:
+        return errClientClosed
+    default:
+    }
+
+    queue := c.sendQueue.high
+    if lowPriorityTypes[item.msg.Type] {
+        queue = c.sendQueue.low
+    }
+    select {
+    case queue <- item:
+        return nil
+    default:
+        c.overflowOnce.Do(func() {
+            sendQueueOverflows.Inc()
+            c.Logger().Warn("Send queue full, disconnecting client", "type", item.msg.Type, "queued", c.sendQueue.Queued())
+            close(c.sendQueue.overflow)
+        })
+        return fmt.Errorf("send queue full, %s message dropped", item.msg.Type)
+    }
+}
+
+// sendClose queues a close frame with code and reason after the messages
+// already queued.
+func (c *Client) sendClose(code int, reason string) error {
+    return c.enqueue(outbound{msg: types.Message{Type: reason}, closeCode: code})
+}
+
+// startWriter starts the writer goroutine for the client's current
+// connection, which first resends replay. The caller holds attachMutex.
+func (c *Client) startWriter(replay [][]byte) {
+    c.writerStop = make(chan struct{})
+    c.writerDone = make(chan struct{})
+    go c.writePump(replay, c.writerStop, c.writerDone)
+}
+
+// writePump writes queued messages and keepalive pings to the socket until
+// the client is closed, its queue overflows, a write fails or stop is closed
+// by detach. High priority messages are always written first.
+func (c *Client) writePump(replay [][]byte, stop, writerDone chan struct{}) {
+    defer close(writerDone)
+
+    for _, frame := range replay {
+        if err := c.writeFrame(frame, c.writeDeadline()); err != nil {
+            c.Logger().Warn("WebSocket write failed, closing connection", "type", "replay", "error", err)
+            c.conn.Close()
+            return
+        }
+    }
+
+    pingInterval := time.Duration(config.Current().WebSocket.PingInterval)
+    ping := time.NewTicker(pingInterval)
+    defer ping.Stop()
+
+    for {
+        // Overflow and pings are not only checked when both queues are
+        // empty, since a full queue would otherwise keep the writer busy
+        // at the slow client's pace
+        var item outbound
+        select {
+        case <-c.sendQueue.overflow:
+            c.write(outbound{msg: types.Message{Type: "send queue full"}, closeCode: websocket.ClosePolicyViolation}, c.writeDeadline())
+            c.conn.Close()
+            return
+        case <-ping.C:
+            item.ping = true
+        case item = <-c.sendQueue.high:
+        default:
+            select {
+            case item = <-c.sendQueue.high:
+            case item = <-c.sendQueue.low:
+            case <-c.sendQueue.overflow:
+                continue
+            case <-ping.C:
+                item.ping = true
+            case <-c.sendQueue.done:
+                c.drainSendQueue()
+                c.conn.Close()
+                return
+            case <-stop:
+                return
+            }
+        }
+
+        if err := c.write(item, c.writeDeadline()); err != nil {
+            c.Logger().Warn("WebSocket write failed, closing connection", "type", item.msg.Type, "ping", item.ping, "error", err)
+            c.conn.Close()
+            return
+        }
+        if err := c.rekeyIfDue(); err != nil {
+            c.Logger().Warn("Failed to start rekey", "error", err)
+        }
+        // Pick up a reloaded interval
+        if interval := time.Duration(config.Current().WebSocket.PingInterval); item.ping && interval != pingInterval {
+            pingInterval = interval
+            ping.Reset(interval)
+        }
+    }
+}
+
+// drainSendQueue writes what is still queued when the client is closed,
+// such as a disconnect reason and its close frame, within one write
+// timeout.
+func (c *Client) drainSendQueue() {
+    deadline := c.writeDeadline()
+    for {
+        var item outbound
+        select {
+        case item = <-c.sendQueue.high:
+        default:
+            select {
+            case item = <-c.sendQueue.high:
+            case item = <-c.sendQueue.low:
+            default:
+                return
+            }
+        }
+        if err := c.write(item, deadline); err != nil {
+            return
+        }
+    }
+}
+
+func (c *Client) writeDeadline() time.Time {
+    return time.Now().Add(time.Duration(config.Current().WebSocket.WriteTimeout))
+}
+
+func (c *Client) write(item outbound, deadline time.Time) error {
+    if item.ping {
+        return c.sendPing(deadline)
+    }
+    if item.closeCode != 0 {
+        return c.conn.WriteControl(websocket.CloseMessage,
+            websocket.FormatCloseMessage(item.closeCode, item.msg.Type), deadline)
+    }
+    c.conn.SetWriteDeadline(deadline)
+    if item.plaintext {
+        return c.writeMessage(item.msg, nil)
+    }
+    return c.writeMessage(item.msg, c.getAESCipher())
+}
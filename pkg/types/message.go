@@ -9,11 +9,31 @@ type Message struct {
     EncryptedKey string                     `json:"encrypted_key,omitempty"`
     IV           string                     `json:"iv,omitempty"`
     RSAPublicKey string                     `json:"rsa_public_key,omitempty"`
+    // Replacement AES session key, sent inside an encrypted rekey message
+    Key          string                     `json:"key,omitempty"`
+    // Handshake version and ephemeral ECDH public keys by curve, sent in init
+    Version        int               `json:"version,omitempty"`
+    ECDHPublicKeys map[string]string `json:"ecdh_public_keys,omitempty"`
+    // Identity signatures over the init transcript, current key first
+    KeyID        string                     `json:"key_id,omitempty"`
+    Signatures   []HandshakeSignature       `json:"signatures,omitempty"`
+    // Token for reattaching to the session after a reconnect, sent encrypted
+    // in resume_token and resumed
+    ResumeToken  string                     `json:"resume_token,omitempty"`
     PeerID       string                     `json:"peer_id,omitempty"`
     Room         string                     `json:"room,omitempty"`
+    // Peer IDs of the room's host and controller, sent in init and
+    // control_changed
+    Host         string                     `json:"host,omitempty"`
+    Controller   string                     `json:"controller,omitempty"`
+    // Room roster sent in room_state, and the peer a peer_joined or
+    // presence message is about
+    Peers        []PeerState                `json:"peers,omitempty"`
+    Peer         *PeerState                 `json:"peer,omitempty"`
     Data         string                     `json:"data,omitempty"`
     Timestamp    int64                      `json:"timestamp,omitempty"`
     Error        string                     `json:"error,omitempty"`
+    Code         string                     `json:"code,omitempty"`
     Message      string                     `json:"message,omitempty"`
     Hands        HandTrackingData           `json:"hands,omitempty"`
     // WebRTC specific fields
@@ -31,6 +51,28 @@ type Message struct {
     Value        int     `json:"value,omitempty"`
 }
 
+// PeerState is what the other clients in a room see of a peer: who it is,
+// its room role and what it is doing. Latency is good, fair, poor or
+// unknown before the first ping is answered.
+type PeerState struct {
+    PeerID    string `json:"peer_id"`
+    Name      string `json:"name"`
+    Role      string `json:"role"`
+    Streaming bool   `json:"streaming"`
+    Paused    bool   `json:"paused"`
+    Latency   string `json:"latency"`
+    Detached  bool   `json:"detached"`
+}
+
+// HandshakeSignature is a server identity key's signature over the init
+// message transcript. PublicKey is the base64 DER SubjectPublicKeyInfo whose
+// SHA-256 clients pin, and Signature the base64 ECDSA P-256 r || s.
+type HandshakeSignature struct {
+    KeyID     string `json:"key_id"`
+    PublicKey string `json:"public_key"`
+    Signature string `json:"signature"`
+}
+
 // Landmark represents a single 3D coordinate (x, y, z).
 type Landmark struct {
     X float32 `json:"x"`
@@ -2,8 +2,35 @@
  * Cryptography utilities for secure communication
  */
 
-let aesKey = null;
-let iv = null;
+// The ECDH handshake derives one AES-GCM key per direction; the legacy RSA
+// handshake uses the same key both ways.
+let sendKey = null;
+let recvKey = null;
+
+// Every encrypted frame is seq (8 bytes, big-endian) || nonce || ciphertext.
+// The direction, seq and our peer ID are authenticated as AES-GCM additional
+// data, and the server rejects replayed sequence numbers.
+const DIRECTION_CLIENT_TO_SERVER = 1;
+const DIRECTION_SERVER_TO_CLIENT = 2;
+const SEQ_SIZE = 8;
+let framePeerId = "";
+let sendSeq = 0n;
+let lastRecvSeq = 0n;
+
+// Either side replaces the session key over the encrypted channel after
+// REKEY_AFTER_MESSAGES frames or REKEY_AFTER_MS: it sends "rekey" with a new
+// AES key and switches once the other side answers "rekey_ack" under it.
+// Both sides derive a key per direction from the offered key with HKDF.
+// Frames sealed with the previous key are accepted for REKEY_GRACE_MS, and
+// an offer from the server wins over our own.
+const REKEY_AFTER_MESSAGES = 1000000;
+const REKEY_AFTER_MS = 30 * 60 * 1000;
+const REKEY_GRACE_MS = 10 * 1000;
+let keyedAt = 0;
+let keyFrames = 0;
+let previousRecvKey = null;
+let previousRecvUntil = 0;
+let pendingRekey = null; // { keys, since } offered by us until rekey_ack
 
 function base64Encode(buffer) {
   return btoa(String.fromCharCode(...buffer));
@@ -13,37 +40,360 @@ function base64Decode(str) {
   return new Uint8Array([...atob(str)].map((c) => c.charCodeAt(0)));
 }
 
-async function performKeyExchange(encodedPem) {
+function frameAAD(direction, seq, peerId) {
+  const peerBytes = new TextEncoder().encode(peerId);
+  const aad = new Uint8Array(1 + SEQ_SIZE + peerBytes.byteLength);
+  aad[0] = direction;
+  new DataView(aad.buffer).setBigUint64(1, seq);
+  aad.set(peerBytes, 1 + SEQ_SIZE);
+  return aad;
+}
+
+const HANDSHAKE_ECDH = 2;
+const HKDF_INFO_CLIENT_TO_SERVER = "vr-distributed client-to-server";
+const HKDF_INFO_SERVER_TO_CLIENT = "vr-distributed server-to-client";
+const HKDF_INFO_REKEY_CLIENT_TO_SERVER = "vr-distributed rekey client-to-server";
+const HKDF_INFO_REKEY_SERVER_TO_CLIENT = "vr-distributed rekey server-to-client";
+
+// Fingerprints of the server identity keys we trust. A page can pin them
+// explicitly in window.VR_IDENTITY_PINS; otherwise the keys seen on the
+// first connection are remembered in localStorage and updated as the server
+// rotates its key.
+const IDENTITY_PINS_STORAGE_KEY = "vr-identity-pins";
+
+// performKeyExchange answers the server's init message and returns the
+// message to send back. It prefers ECDH over X25519, then P-256, and only
+// falls back to RSA for servers that predate the handshake version.
+async function performKeyExchange(initMsg) {
+  await verifyServerIdentity(initMsg);
+
+  framePeerId = initMsg.peer_id;
+  sendSeq = 0n;
+  lastRecvSeq = 0n;
+  keyedAt = Date.now();
+  keyFrames = 0;
+  previousRecvKey = null;
+  pendingRekey = null;
+
+  if (initMsg.version >= HANDSHAKE_ECDH && initMsg.ecdh_public_keys) {
+    return performECDHKeyExchange(initMsg.ecdh_public_keys);
+  }
+  return performRSAKeyExchange(initMsg.rsa_public_key);
+}
+
+// handshakeTranscript encodes the init fields the server signs, each
+// prefixed with its byte length as a 4-byte big-endian integer. It covers
+// the key ID and public key of every signature, so none can be added to a
+// signed init.
+function handshakeTranscript(initMsg) {
+  const ecdhKeys = initMsg.ecdh_public_keys || {};
+  const fields = [
+    "vr-distributed handshake",
+    String(initMsg.version || 0),
+    initMsg.peer_id || "",
+    initMsg.room || "",
+  ];
+  for (const name of Object.keys(ecdhKeys).sort()) {
+    fields.push(name, ecdhKeys[name]);
+  }
+  fields.push(initMsg.rsa_public_key || "");
+  const signers = [...(initMsg.signatures || [])].sort((a, b) =>
+    a.key_id < b.key_id ? -1 : a.key_id > b.key_id ? 1 : 0,
+  );
+  for (const signer of signers) {
+    fields.push(signer.key_id || "", signer.public_key || "");
+  }
+
+  const encoded = fields.map((field) => new TextEncoder().encode(field));
+  const transcript = new Uint8Array(
+    encoded.reduce((length, field) => length + 4 + field.byteLength, 0),
+  );
+  const view = new DataView(transcript.buffer);
+  let offset = 0;
+  for (const field of encoded) {
+    view.setUint32(offset, field.byteLength);
+    transcript.set(field, offset + 4);
+    offset += 4 + field.byteLength;
+  }
+  return transcript;
+}
+
+async function identityFingerprint(spki) {
+  const digest = new Uint8Array(await crypto.subtle.digest("SHA-256", spki));
+  return [...digest]
+    .map((b) => b.toString(16).padStart(2, "0").toUpperCase())
+    .join(":");
+}
+
+function loadIdentityPins() {
+  if (typeof window !== "undefined" && Array.isArray(window.VR_IDENTITY_PINS)) {
+    return { pins: window.VR_IDENTITY_PINS, configured: true };
+  }
+  if (typeof localStorage === "undefined") {
+    return { pins: [], configured: false };
+  }
+  try {
+    const stored = JSON.parse(localStorage.getItem(IDENTITY_PINS_STORAGE_KEY));
+    return { pins: Array.isArray(stored) ? stored : [], configured: false };
+  } catch (e) {
+    return { pins: [], configured: false };
+  }
+}
+
+// nextIdentityPins returns the pins to remember after the keys with the
+// verified fingerprints signed an init, or null if the init must be
+// refused. Without pins the first keys seen are trusted. Otherwise a
+// pinned key must be among the signers, and only then are the other keys
+// it signed next to pinned: during a rotation the old key vouches for the
+// new one.
+function nextIdentityPins(pins, verified) {
+  if (verified.length === 0) return null;
+  if (pins.length === 0) return verified;
+  const pinned = new Set(pins.map((pin) => pin.toUpperCase()));
+  if (!verified.some((fingerprint) => pinned.has(fingerprint))) return null;
+  return verified;
+}
+
+// verifyServerIdentity checks the identity signatures in init against the
+// signed transcript and requires at least one key to be pinned. During a
+// key rotation the server signs with the old and the new key, so the
+// remembered pins move to the new key.
+async function verifyServerIdentity(initMsg) {
+  const { pins, configured } = loadIdentityPins();
+  const signatures = initMsg.signatures || [];
+  if (signatures.length === 0) {
+    if (pins.length > 0) {
+      throw new Error("Server did not sign the handshake but an identity key is pinned");
+    }
+    console.warn("Server handshake is not signed, cannot verify its identity");
+    return;
+  }
+
+  const transcript = handshakeTranscript(initMsg);
+  const verified = [];
+  for (const entry of signatures) {
+    try {
+      const spki = base64Decode(entry.public_key);
+      const key = await crypto.subtle.importKey(
+        "spki",
+        spki,
+        { name: "ECDSA", namedCurve: "P-256" },
+        false,
+        ["verify"],
+      );
+      const valid = await crypto.subtle.verify(
+        { name: "ECDSA", hash: "SHA-256" },
+        key,
+        base64Decode(entry.signature),
+        transcript,
+      );
+      if (valid) {
+        verified.push(await identityFingerprint(spki));
+      }
+    } catch (e) {
+      console.warn(`Invalid identity signature from key ${entry.key_id}:`, e);
+    }
+  }
+  if (verified.length === 0) {
+    throw new Error("Server handshake signature is invalid");
+  }
+
+  const nextPins = nextIdentityPins(pins, verified);
+  if (!nextPins) {
+    throw new Error(
+      `Server identity key ${initMsg.key_id} is not pinned (fingerprint ${verified[0]}). ` +
+        `If the server key was replaced on purpose, clear the "${IDENTITY_PINS_STORAGE_KEY}" pin.`,
+    );
+  }
+  if (!configured && typeof localStorage !== "undefined") {
+    localStorage.setItem(IDENTITY_PINS_STORAGE_KEY, JSON.stringify(nextPins));
+  }
+  console.log(`Verified server identity key ${initMsg.key_id} (${verified[0]})`);
+}
+
+async function generateECDHKeyPair(serverKeys) {
+  if (serverKeys["X25519"]) {
+    try {
+      const keyPair = await crypto.subtle.generateKey({ name: "X25519" }, false, [
+        "deriveBits",
+      ]);
+      return { curve: "X25519", keyPair, algorithm: { name: "X25519" } };
+    } catch (e) {
+      console.log("X25519 not supported, using P-256");
+    }
+  }
+  const algorithm = { name: "ECDH", namedCurve: "P-256" };
+  const keyPair = await crypto.subtle.generateKey(algorithm, false, [
+    "deriveBits",
+  ]);
+  return { curve: "P-256", keyPair, algorithm };
+}
+
+async function performECDHKeyExchange(serverKeys) {
+  const { curve, keyPair, algorithm } = await generateECDHKeyPair(serverKeys);
+  const serverPublicRaw = base64Decode(serverKeys[curve]);
+  const serverPublic = await crypto.subtle.importKey(
+    "raw",
+    serverPublicRaw,
+    algorithm,
+    false,
+    [],
+  );
+  const clientPublicRaw = new Uint8Array(
+    await crypto.subtle.exportKey("raw", keyPair.publicKey),
+  );
+
+  const secret = await crypto.subtle.deriveBits(
+    { name: algorithm.name, public: serverPublic },
+    keyPair.privateKey,
+    256,
+  );
+
+  // HKDF-SHA256, salted with SHA-256(server public || client public)
+  const transcript = new Uint8Array(
+    serverPublicRaw.byteLength + clientPublicRaw.byteLength,
+  );
+  transcript.set(serverPublicRaw, 0);
+  transcript.set(clientPublicRaw, serverPublicRaw.byteLength);
+  const salt = await crypto.subtle.digest("SHA-256", transcript);
+  const hkdfKey = await crypto.subtle.importKey("raw", secret, "HKDF", false, [
+    "deriveKey",
+  ]);
+  const deriveAESKey = (info) =>
+    crypto.subtle.deriveKey(
+      {
+        name: "HKDF",
+        hash: "SHA-256",
+        salt,
+        info: new TextEncoder().encode(info),
+      },
+      hkdfKey,
+      { name: "AES-GCM", length: 256 },
+      false,
+      ["encrypt", "decrypt"],
+    );
+
+  sendKey = await deriveAESKey(HKDF_INFO_CLIENT_TO_SERVER);
+  recvKey = await deriveAESKey(HKDF_INFO_SERVER_TO_CLIENT);
+
+  return {
+    type: "ecdh_key_exchange",
+    curve,
+    public_key: base64Encode(clientPublicRaw),
+  };
+}
+
+async function performRSAKeyExchange(encodedPem) {
   const pem = atob(encodedPem);
   const encrypt = new JSEncrypt();
   encrypt.setPublicKey(pem);
 
   const aesKeyRaw = crypto.getRandomValues(new Uint8Array(32));
-  iv = crypto.getRandomValues(new Uint8Array(12));
 
-  aesKey = await crypto.subtle.importKey(
+  sendKey = await crypto.subtle.importKey(
     "raw",
     aesKeyRaw,
     { name: "AES-GCM" },
     false,
     ["encrypt", "decrypt"],
   );
+  recvKey = sendKey;
 
   // Convert raw bytes to base64 for RSA encryption
   const aesKeyB64 = btoa(String.fromCharCode(...aesKeyRaw));
   const encryptedKey = encrypt.encrypt(aesKeyB64);
 
   return {
+    type: "aes_key_exchange",
     encrypted_key: encryptedKey,
-    iv: base64Encode(iv),
   };
 }
 
+// deriveRekeyKeys derives our send and receive keys from a key offered in
+// a rekey message, with HKDF-SHA256 and no salt, as the server does.
+async function deriveRekeyKeys(raw) {
+  const hkdfKey = await crypto.subtle.importKey("raw", raw, "HKDF", false, [
+    "deriveKey",
+  ]);
+  const deriveAESKey = (info) =>
+    crypto.subtle.deriveKey(
+      {
+        name: "HKDF",
+        hash: "SHA-256",
+        salt: new Uint8Array(0),
+        info: new TextEncoder().encode(info),
+      },
+      hkdfKey,
+      { name: "AES-GCM", length: 256 },
+      false,
+      ["encrypt", "decrypt"],
+    );
+  return {
+    send: await deriveAESKey(HKDF_INFO_REKEY_CLIENT_TO_SERVER),
+    recv: await deriveAESKey(HKDF_INFO_REKEY_SERVER_TO_CLIENT),
+  };
+}
+
+function installRekeyedKeys(keys) {
+  previousRecvKey = recvKey;
+  previousRecvUntil = Date.now() + REKEY_GRACE_MS;
+  sendKey = keys.send;
+  recvKey = keys.recv;
+  pendingRekey = null;
+  keyedAt = Date.now();
+  keyFrames = 0;
+}
+
+function isRekeyDue() {
+  if (!sendKey) return false;
+  if (pendingRekey) {
+    if (Date.now() - pendingRekey.since < REKEY_GRACE_MS) return false;
+    // Try again after another full interval rather than on every frame
+    console.warn("Server did not acknowledge rekey, keeping current key");
+    pendingRekey = null;
+    keyedAt = Date.now();
+    keyFrames = 0;
+    return false;
+  }
+  return (
+    keyFrames >= REKEY_AFTER_MESSAGES || Date.now() - keyedAt >= REKEY_AFTER_MS
+  );
+}
+
+// startRekey returns the rekey message offering a new key, to be sent
+// encrypted under the current key, or null if a server offer came first.
+async function startRekey() {
+  const raw = crypto.getRandomValues(new Uint8Array(32));
+  const offer = { keys: null, since: Date.now() };
+  // Set before the await so concurrent senders do not offer twice
+  pendingRekey = offer;
+  offer.keys = await deriveRekeyKeys(raw);
+  if (pendingRekey !== offer) return null;
+  return { type: "rekey", key: base64Encode(raw) };
+}
+
+// acceptRekey installs a key offered by the server, dropping any offer of
+// our own, and returns the acknowledgement to send under the new key.
+async function acceptRekey(msg) {
+  installRekeyedKeys(await deriveRekeyKeys(base64Decode(msg.key)));
+  return { type: "rekey_ack" };
+}
+
+function completeRekey() {
+  if (!pendingRekey || !pendingRekey.keys) {
+    console.warn("Ignoring unexpected rekey_ack");
+    return;
+  }
+  installRekeyedKeys(pendingRekey.keys);
+}
+
 async function encryptMessage(messageObj) {
-  if (!aesKey || !iv) return null;
+  if (!sendKey) return null;
 
   const encoded = new TextEncoder().encode(JSON.stringify(messageObj));
   const nonce = crypto.getRandomValues(new Uint8Array(12));
+  // Taken before the await so sequence numbers follow call order
+  const seq = ++sendSeq;
 
   try {
     const encrypted = await crypto.subtle.encrypt(
@@ -51,18 +401,21 @@ async function encryptMessage(messageObj) {
         name: "AES-GCM",
         iv: nonce,
         tagLength: 128,
+        additionalData: frameAAD(DIRECTION_CLIENT_TO_SERVER, seq, framePeerId),
       },
-      aesKey,
+      sendKey,
       encoded,
     );
 
-    const nonceAndEncrypted = new Uint8Array(
-      nonce.byteLength + encrypted.byteLength,
+    const frame = new Uint8Array(
+      SEQ_SIZE + nonce.byteLength + encrypted.byteLength,
     );
-    nonceAndEncrypted.set(nonce, 0);
-    nonceAndEncrypted.set(new Uint8Array(encrypted), nonce.byteLength);
+    new DataView(frame.buffer).setBigUint64(0, seq);
+    frame.set(nonce, SEQ_SIZE);
+    frame.set(new Uint8Array(encrypted), SEQ_SIZE + nonce.byteLength);
 
-    return nonceAndEncrypted.buffer;
+    keyFrames++;
+    return frame.buffer;
   } catch (e) {
     console.error("Failed to encrypt message:", e);
     return null;
@@ -70,39 +423,61 @@ async function encryptMessage(messageObj) {
 }
 
 async function decryptMessage(data) {
-  if (!aesKey) return null;
+  if (!recvKey) return null;
 
   const nonceSize = 12;
   const tagSize = 16;
 
-  if (data.byteLength < nonceSize + tagSize) return null;
+  if (data.byteLength < SEQ_SIZE + nonceSize + tagSize) return null;
 
-  const nonce = data.slice(0, nonceSize);
-  const ciphertext = data.slice(nonceSize, data.byteLength - tagSize);
-  const tag = data.slice(data.byteLength - tagSize);
+  // The server sends frames in order, so anything not newer is a replay
+  const seq = new DataView(data).getBigUint64(0);
+  if (seq <= lastRecvSeq) {
+    console.warn("Dropping replayed frame", seq);
+    return null;
+  }
 
-  const fullData = new Uint8Array(ciphertext.byteLength + tag.byteLength);
-  fullData.set(new Uint8Array(ciphertext), 0);
-  fullData.set(new Uint8Array(tag), ciphertext.byteLength);
+  const nonce = data.slice(SEQ_SIZE, SEQ_SIZE + nonceSize);
+  const ciphertext = data.slice(SEQ_SIZE + nonceSize);
 
-  try {
-    const decrypted = await crypto.subtle.decrypt(
-      {
-        name: "AES-GCM",
-        iv: nonce,
-        tagLength: 128,
-      },
-      aesKey,
-      fullData,
-    );
+  // Around a rekey the frame may be sealed with the offered or the old key
+  const keys = [recvKey];
+  if (pendingRekey && pendingRekey.keys) keys.push(pendingRekey.keys.recv);
+  if (previousRecvKey && Date.now() < previousRecvUntil) {
+    keys.push(previousRecvKey);
+  }
 
-    return JSON.parse(new TextDecoder().decode(decrypted));
-  } catch (e) {
-    console.warn("Failed to decrypt control message", e);
-    return null;
+  for (const key of keys) {
+    try {
+      const decrypted = await crypto.subtle.decrypt(
+        {
+          name: "AES-GCM",
+          iv: nonce,
+          tagLength: 128,
+          additionalData: frameAAD(DIRECTION_SERVER_TO_CLIENT, seq, framePeerId),
+        },
+        key,
+        ciphertext,
+      );
+
+      lastRecvSeq = seq;
+      keyFrames++;
+      return JSON.parse(new TextDecoder().decode(decrypted));
+    } catch (e) {
+      // Try the next key
+    }
   }
+  console.warn("Failed to decrypt control message", seq);
+  return null;
+}
+
+// lastReceivedSeq is the sequence number of the last server frame we
+// opened, which a resuming connection reports so the server resends the
+// rest.
+function lastReceivedSeq() {
+  return lastRecvSeq.toString();
 }
 
 function isEncryptionReady() {
-  return aesKey !== null && iv !== null;
+  return sendKey !== null && recvKey !== null;
 }
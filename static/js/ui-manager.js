@@ -19,6 +19,8 @@ class UIManager {
       applyQualityBtn: document.getElementById("applyQualityBtn"),
       peerList: document.getElementById("peerList"),
       peerItems: document.getElementById("peerItems"),
+      roster: document.getElementById("roster"),
+      rosterItems: document.getElementById("rosterItems"),
     };
 
     this.vrDebugging = false;
@@ -59,7 +61,7 @@ class UIManager {
         window.gyroManager.disableGyro();
       }
       if (window.websocketManager) {
-        window.websocketManager.disconnect();
+        window.websocketManager.terminate();
       }
     };
 
@@ -132,6 +134,30 @@ class UIManager {
     });
   }
 
+  // updateRoster lists who is in the room and what they are doing.
+  updateRoster(roster) {
+    if (roster.size === 0) {
+      this.elements.roster.style.display = "none";
+      return;
+    }
+
+    this.elements.roster.style.display = "block";
+    this.elements.rosterItems.innerHTML = "";
+    roster.forEach((peer) => {
+      const activity = peer.detached
+        ? "reconnecting"
+        : peer.paused
+          ? "paused"
+          : peer.streaming
+            ? "streaming"
+            : "idle";
+      const div = document.createElement("div");
+      div.className = "peer-item";
+      div.textContent = `${peer.name} (${peer.role}, ${activity}, ${peer.latency} latency)`;
+      this.elements.rosterItems.appendChild(div);
+    });
+  }
+
   updateVrDebuggingStatus(enabled) {
     this.vrDebugging = enabled;
     this.elements.vrDebugBtn.textContent = `VR Debugging: ${enabled ? "ON" : "OFF"}`;
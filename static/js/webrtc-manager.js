@@ -68,7 +68,7 @@ class WebRTCManager {
       if (event.candidate && event.candidate.candidate !== "") {
         console.log("Sending ICE candidate:", event.candidate);
         if (window.websocketManager) {
-          window.websocketManager.sendMessage({
+          window.websocketManager.sendSignal({
             type: "webrtc_ice_candidate",
             candidate: event.candidate,
             target: this.myPeerId,
@@ -180,7 +180,7 @@ class WebRTCManager {
       console.log("Sending WebRTC offer:", offer);
 
       if (window.websocketManager) {
-        window.websocketManager.sendMessage({
+        window.websocketManager.sendSignal({
           type: "webrtc_offer",
           offer: offer,
           target: peerId,
@@ -218,7 +218,7 @@ class WebRTCManager {
       console.log("Sending WebRTC answer:", answer);
 
       if (window.websocketManager) {
-        window.websocketManager.sendMessage({
+        window.websocketManager.sendSignal({
           type: "webrtc_answer",
           answer: answer,
           target: fromPeer,
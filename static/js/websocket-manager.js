@@ -2,6 +2,23 @@
  * WebSocket connection management and message handling
  */
 
+// When the connection drops, we reconnect with the resume token the server
+// sent once keyed and pick up the same session, VR process and stream. The
+// server keeps a detached session for 30 seconds by default, which these
+// backoff delays cover.
+const RECONNECT_ATTEMPTS = 8;
+const RECONNECT_BASE_MS = 500;
+const RECONNECT_MAX_MS = 5000;
+
+// base64UrlEncode encodes text as unpadded base64url, which is valid in a
+// subprotocol name.
+function base64UrlEncode(text) {
+  return base64Encode(new TextEncoder().encode(text))
+    .replace(/\+/g, "-")
+    .replace(/\//g, "_")
+    .replace(/=+$/, "");
+}
+
 class WebSocketManager {
   constructor() {
     this.socket = null;
@@ -10,41 +27,99 @@ class WebSocketManager {
     this.vrStarted = false;
     this.roomName = "default";
     this.myPeerId = null;
+    // The room's host runs the VR process and its controller drives it with
+    // gyro and hand input; everyone else watches
+    this.hostId = null;
+    this.controllerId = null;
+    // Everyone in the room by peer ID, with their name, role and presence
+    this.roster = new Map();
+    this.resumeToken = null;
+    this.resuming = false;
+    this.reconnectAttempts = 0;
+    this.sessionEnded = false;
+    this.closeReason = null;
   }
 
   connect() {
     const protocol = window.location.protocol === "https:" ? "wss" : "ws";
-    const wsUrl = `${protocol}://${window.location.host}/ws/webrtc/${this.roomName}/`;
-    this.socket = new WebSocket(wsUrl);
+    const pageParams = new URLSearchParams(window.location.search);
+    // The room to join and the title of a room we create are taken from
+    // the page URL
+    const params = new URLSearchParams();
+    for (const name of ["room", "title", "name"]) {
+      if (pageParams.get(name)) params.set(name, pageParams.get(name));
+    }
+    // Nothing is sent until the server confirms the resume, since a new
+    // session would not have our keys
+    this.resuming = this.resumeToken !== null;
+    if (this.resuming) {
+      params.set("last_seq", lastReceivedSeq());
+    }
+    const query = params.toString();
+    const wsUrl = `${protocol}://${window.location.host}/ws/webrtc/${this.roomName}/${query ? `?${query}` : ""}`;
+    this.sessionEnded = false;
+    this.closeReason = null;
+    // An auth token and the room password in the page URL, and the resume
+    // token, are offered as subprotocols rather than query parameters so
+    // they stay out of proxy logs. The password is best given in the URL
+    // fragment, which the browser never sends to the server at all.
+    const token = pageParams.get("token");
+    const password =
+      new URLSearchParams(window.location.hash.slice(1)).get("password") ||
+      pageParams.get("password");
+    const protocols = [];
+    if (token) protocols.push(`bearer.${token}`);
+    if (password) protocols.push(`password.${base64UrlEncode(password)}`);
+    if (this.resuming) protocols.push(`resume.${this.resumeToken}`);
+    const socket = protocols.length
+      ? new WebSocket(wsUrl, ["vr-distributed", ...protocols])
+      : new WebSocket(wsUrl);
+    this.socket = socket;
     this.socket.binaryType = "arraybuffer";
 
     this.socket.onopen = () => {
       this.isConnected = true;
       if (window.uiManager) {
         window.uiManager.updateStatus(
-          "Connected. Awaiting initialization...",
+          this.resuming
+            ? "Reconnected. Resuming session..."
+            : "Connected. Awaiting initialization...",
           "connected",
         );
       }
     };
 
     this.socket.onclose = () => {
-      if (window.uiManager) {
-        window.uiManager.updateStatus("Connection closed", "error");
-      }
+      if (socket !== this.socket) return;
       this.isConnected = false;
-      this.streamReady = false;
-      this.vrStarted = false;
-      if (window.uiManager) {
-        window.uiManager.enableStartVrButton();
-      }
-      if (window.webrtcManager) {
-        window.webrtcManager.peers.clear();
-        window.uiManager.updatePeerList(window.webrtcManager.peers);
+      if (
+        this.resumeToken &&
+        !this.sessionEnded &&
+        this.reconnectAttempts < RECONNECT_ATTEMPTS
+      ) {
+        const delay = Math.min(
+          RECONNECT_BASE_MS * 2 ** this.reconnectAttempts,
+          RECONNECT_MAX_MS,
+        );
+        this.reconnectAttempts++;
+        if (window.uiManager) {
+          window.uiManager.updateStatus(
+            "Connection lost. Reconnecting...",
+            "error",
+          );
+        }
+        setTimeout(() => this.connect(), delay);
+        return;
       }
-      if (window.handTrackingManager) {
-        window.handTrackingManager.stopTracking();
+
+      if (window.uiManager) {
+        window.uiManager.updateStatus(
+          this.closeReason || "Connection closed",
+          "error",
+        );
       }
+      this.resumeToken = null;
+      this.resetSession();
     };
 
     this.socket.onerror = () => {
@@ -53,35 +128,124 @@ class WebSocketManager {
       }
     };
 
-    this.socket.onmessage = async (event) => {
-      if (typeof event.data === "string") {
-        const msg = JSON.parse(event.data);
-        console.log("message Received" + event.data);
-        await this.handleMessage(msg);
-      } else {
-        // Handle binary data for encrypted messages
-        const decryptedMsg = await decryptMessage(event.data);
-        if (decryptedMsg) {
-          await this.handleMessage(decryptedMsg);
-        }
-      }
+    // Once keyed, every server message arrives encrypted. Decryption is
+    // async, so messages are handled one at a time to keep signalling in
+    // order, across a resume too.
+    this.receiveQueue = this.receiveQueue || Promise.resolve();
+    this.socket.onmessage = (event) => {
+      this.receiveQueue = this.receiveQueue
+        .then(() => this.receive(event))
+        .catch((e) => console.error("Failed to handle message:", e));
     };
   }
 
+  // resetSession forgets the state of a session that ended or could not be
+  // resumed.
+  resetSession() {
+    this.streamReady = false;
+    this.vrStarted = false;
+    this.hostId = null;
+    this.controllerId = null;
+    this.roster.clear();
+    if (window.uiManager) {
+      window.uiManager.enableStartVrButton();
+      window.uiManager.updateRoster(this.roster);
+    }
+    if (window.webrtcManager) {
+      window.webrtcManager.peers.clear();
+      window.uiManager.updatePeerList(window.webrtcManager.peers);
+    }
+    if (window.handTrackingManager) {
+      window.handTrackingManager.stopTracking();
+    }
+  }
+
+  isController() {
+    return this.myPeerId !== null && this.controllerId === this.myPeerId;
+  }
+
+  isHost() {
+    return this.myPeerId !== null && this.hostId === this.myPeerId;
+  }
+
+  // updateRoles records who hosts and controls the room, sent in init and
+  // control_changed, and starts or stops sending our motion accordingly.
+  async updateRoles(msg) {
+    const wasController = this.isController();
+    this.hostId = msg.host || null;
+    this.controllerId = msg.controller || null;
+    for (const peer of this.roster.values()) {
+      peer.role = this.roleOf(peer.peer_id);
+    }
+    this.showRoster();
+    if (!window.gyroManager || wasController === this.isController()) return;
+    if (this.isController() && this.vrStarted) {
+      await window.gyroManager.enableGyro();
+    } else if (!this.isController()) {
+      window.gyroManager.disableGyro();
+    }
+  }
+
+  roleOf(peerId) {
+    if (peerId === this.hostId) return "host";
+    if (peerId === this.controllerId) return "controller";
+    return "spectator";
+  }
+
+  // updatePeer records a peer's state from room_state, peer_joined or
+  // presence.
+  updatePeer(peer) {
+    this.roster.set(peer.peer_id, peer);
+    this.showRoster();
+  }
+
+  showRoster() {
+    if (window.uiManager) {
+      window.uiManager.updateRoster(this.roster);
+    }
+  }
+
+  async receive(event) {
+    if (typeof event.data === "string") {
+      const msg = JSON.parse(event.data);
+      console.log("message Received" + event.data);
+      await this.handleMessage(msg);
+    } else {
+      // Handle binary data for encrypted messages
+      const decryptedMsg = await decryptMessage(event.data);
+      if (decryptedMsg) {
+        await this.handleMessage(decryptedMsg);
+      }
+    }
+  }
+
   async handleMessage(msg) {
     switch (msg.type) {
       case "init":
+        if (this.resuming) {
+          // The server could not resume our session and started a new one
+          console.warn("Session not resumed, starting a new one");
+          this.resuming = false;
+          this.resumeToken = null;
+          this.reconnectAttempts = 0;
+          this.resetSession();
+        }
         this.myPeerId = msg.peer_id;
         this.roomName = msg.room;
+        await this.updateRoles(msg);
         if (window.webrtcManager) {
           window.webrtcManager.setMyPeerId(this.myPeerId);
         }
-        const keyExchangeData = await performKeyExchange(msg.rsa_public_key);
-        this.sendMessage({
-          type: "aes_key_exchange",
-          encrypted_key: keyExchangeData.encrypted_key,
-          iv: keyExchangeData.iv,
-        });
+        try {
+          this.sendMessage(await performKeyExchange(msg));
+        } catch (e) {
+          // Never talk to a server whose identity cannot be verified
+          console.error("Key exchange failed:", e);
+          if (window.uiManager) {
+            window.uiManager.updateStatus(e.message, "error");
+          }
+          this.socket.close();
+        }
         break;
 
       case "key_exchange_complete":
@@ -94,9 +258,31 @@ class WebSocketManager {
         }
         break;
 
+      case "resume_token":
+        this.resumeToken = msg.resume_token;
+        this.reconnectAttempts = 0;
+        break;
+
+      case "resumed":
+        this.resumeToken = msg.resume_token;
+        this.resuming = false;
+        this.reconnectAttempts = 0;
+        if (window.uiManager) {
+          window.uiManager.updateStatus("Reconnected", "connected");
+        }
+        break;
+
+      case "rekey":
+        await this.sendEncryptedMessage(await acceptRekey(msg));
+        break;
+
+      case "rekey_ack":
+        completeRekey();
+        break;
+
       case "vr_ready":
-        // Initialize gyroscope/motion tracking
-        if (window.gyroManager) {
+        // Initialize gyroscope/motion tracking if we drive the VR process
+        if (window.gyroManager && this.isController()) {
           await window.gyroManager.enableGyro();
         }
         if (window.uiManager) {
@@ -108,22 +294,53 @@ class WebSocketManager {
         }
         this.vrStarted = true;
 
-        // Initiate WebRTC connection to the server itself
+        // Initiate WebRTC connection to the server itself, which sends
+        // spectators a copy of the host's stream
         if (window.webrtcManager) {
           await window.webrtcManager.createOffer(this.myPeerId);
         }
         break;
 
+      case "control_changed":
+        await this.updateRoles(msg);
+        if (window.uiManager) {
+          window.uiManager.updateStatus(
+            this.isController()
+              ? "You are controlling the VR session"
+              : `${msg.controller || "Nobody"} is controlling the VR session`,
+            "connected",
+          );
+        }
+        break;
+
       case "status":
         if (window.uiManager) {
           window.uiManager.updateStatus(msg.message, "connected");
         }
         break;
 
+      case "server_shutdown":
+      case "kicked":
+      case "room_closed":
+        if (window.uiManager) {
+          window.uiManager.updateStatus(msg.message, "error");
+        }
+        this.sessionEnded = true;
+        this.closeReason = msg.message;
+        this.resumeToken = null;
+        this.vrStarted = false;
+        break;
+
       case "error":
         if (window.uiManager) {
           window.uiManager.updateStatus(`Error: ${msg.message}`, "error");
         }
+        // The room refused us (room_full, room_password or room_closed)
+        // and the server is closing the connection
+        if (msg.code && msg.code.startsWith("room_")) {
+          this.sessionEnded = true;
+          this.closeReason = `Error: ${msg.message}`;
+        }
         if (msg.message.includes("VR")) {
           if (window.uiManager) {
             window.uiManager.enableStartVrButton();
@@ -133,13 +350,32 @@ class WebSocketManager {
         break;
 
       // WebRTC signaling messages
+      case "room_state":
+        this.roster.clear();
+        for (const peer of msg.peers || []) {
+          this.roster.set(peer.peer_id, peer);
+        }
+        await this.updateRoles(msg);
+        break;
+
+      case "presence":
+        if (msg.peer) {
+          this.updatePeer(msg.peer);
+        }
+        break;
+
       case "peer_joined":
+        if (msg.peer) {
+          this.updatePeer(msg.peer);
+        }
         if (window.webrtcManager) {
           window.webrtcManager.handlePeerJoined(msg.peer_id, this.vrStarted);
         }
         break;
 
       case "peer_left":
+        this.roster.delete(msg.peer_id);
+        this.showRoster();
         if (window.webrtcManager) {
           window.webrtcManager.handlePeerLeft(msg.peer_id);
         }
@@ -185,13 +421,30 @@ class WebSocketManager {
     }
   }
 
+  // WebRTC signalling goes out encrypted once the key exchange is done, so
+  // it is accepted by servers with security.require_encryption set.
+  async sendSignal(messageObj) {
+    if (isEncryptionReady()) {
+      await this.sendEncryptedMessage(messageObj);
+    } else {
+      this.sendMessage(messageObj);
+    }
+  }
+
   async sendEncryptedMessage(messageObj) {
-    if (!isEncryptionReady() || !this.isConnected) return;
+    if (!isEncryptionReady() || !this.isConnected || this.resuming) return;
 
     const encryptedData = await encryptMessage(messageObj);
     if (encryptedData && this.socket) {
       this.socket.send(encryptedData);
     }
+    if (isRekeyDue()) {
+      const rekey = await startRekey();
+      const frame = rekey && (await encryptMessage(rekey));
+      if (frame && this.socket) {
+        this.socket.send(frame);
+      }
+    }
   }
 
   startVR() {
@@ -230,14 +483,34 @@ class WebSocketManager {
     });
   }
 
+  // transferControl hands control of the VR session to another peer. Only
+  // the host may.
+  transferControl(peerId) {
+    this.sendEncryptedMessage({ type: "transfer_control", target: peerId });
+  }
+
+  // disconnect leaves the room, leaving the VR process running for the
+  // others in it.
   disconnect() {
-    this.sendControl("terminate");
+    this.sessionEnded = true;
+    this.socket?.close(1000);
     console.log("disconnected");
+  }
+
+  // terminate stops the VR process for everyone in the room. Only the host
+  // may, and only when the user asks to.
+  terminate() {
+    if (!this.isHost()) {
+      this.disconnect();
+      return;
+    }
+    this.sendControl("terminate");
+    console.log("terminated");
     // Don't close socket immediately to allow cleanup message
   }
 
   sendGyroData(alpha, beta, gamma, timestamp) {
-    if (this.socket && this.isConnected) {
+    if (this.socket && this.isConnected && this.isController()) {
       this.sendEncryptedMessage({
         type: "gyro",
         alpha,
@@ -248,7 +521,7 @@ class WebSocketManager {
     }
   }
   sendHanddata(handsData) {
-    if (this.socket && this.isConnected) {
+    if (this.socket && this.isConnected && this.isController()) {
       this.sendEncryptedMessage({
         type: "hand",
         hands: handsData,
@@ -0,0 +1,125 @@
+// Run with: node --test test/js
+const assert = require("node:assert/strict");
+const fs = require("node:fs");
+const path = require("node:path");
+const test = require("node:test");
+const vm = require("node:vm");
+
+// loadCryptoUtils evaluates the browser script with the globals it uses
+// and an in-memory localStorage holding pins.
+function loadCryptoUtils(pins) {
+  const storage = new Map();
+  if (pins) storage.set("vr-identity-pins", JSON.stringify(pins));
+  const context = vm.createContext({
+    crypto: globalThis.crypto,
+    TextEncoder,
+    atob,
+    btoa,
+    console: { log() {}, warn() {}, error() {} },
+    localStorage: {
+      getItem: (key) => (storage.has(key) ? storage.get(key) : null),
+      setItem: (key, value) => storage.set(key, value),
+    },
+  });
+  const source = fs.readFileSync(
+    path.join(__dirname, "../../static/js/crypto-utils.js"),
+    "utf8",
+  );
+  vm.runInContext(source, context);
+  return {
+    context,
+    storedPins: () => JSON.parse(storage.get("vr-identity-pins") || "null"),
+  };
+}
+
+async function newIdentity(keyId) {
+  const keyPair = await crypto.subtle.generateKey(
+    { name: "ECDSA", namedCurve: "P-256" },
+    false,
+    ["sign", "verify"],
+  );
+  const spki = new Uint8Array(
+    await crypto.subtle.exportKey("spki", keyPair.publicKey),
+  );
+  return { keyId, keyPair, spki };
+}
+
+// signedInit returns an init signed by every identity in signers, over a
+// transcript listing all of them.
+async function signedInit(utils, signers) {
+  const initMsg = {
+    type: "init",
+    version: 2,
+    peer_id: "peer",
+    room: "room",
+    ecdh_public_keys: { "P-256": "cA==", X25519: "eA==" },
+    key_id: signers[0].keyId,
+    signatures: signers.map((signer) => ({
+      key_id: signer.keyId,
+      public_key: Buffer.from(signer.spki).toString("base64"),
+      signature: "",
+    })),
+  };
+  const transcript = utils.context.handshakeTranscript(initMsg);
+  for (const [i, signer] of signers.entries()) {
+    const signature = await crypto.subtle.sign(
+      { name: "ECDSA", hash: "SHA-256" },
+      signer.keyPair.privateKey,
+      transcript,
+    );
+    initMsg.signatures[i].signature = Buffer.from(signature).toString("base64");
+  }
+  return initMsg;
+}
+
+test("first keys seen are pinned", async () => {
+  const utils = loadCryptoUtils();
+  const server = await newIdentity("a1");
+  await utils.context.verifyServerIdentity(await signedInit(utils, [server]));
+  assert.deepEqual(utils.storedPins(), [
+    await utils.context.identityFingerprint(server.spki),
+  ]);
+});
+
+test("pinned key vouches for the rotated key", async () => {
+  const old = await newIdentity("a1");
+  const rotated = await newIdentity("b2");
+  const utils = loadCryptoUtils();
+  const oldPin = await utils.context.identityFingerprint(old.spki);
+  const rotatedPin = await utils.context.identityFingerprint(rotated.spki);
+  const pinned = loadCryptoUtils([oldPin]);
+  await pinned.context.verifyServerIdentity(
+    await signedInit(pinned, [rotated, old]),
+  );
+  assert.deepEqual(pinned.storedPins().sort(), [oldPin, rotatedPin].sort());
+});
+
+test("signature appended to a relayed init is not pinned", async () => {
+  const server = await newIdentity("a1");
+  const attacker = await newIdentity("ff");
+  const utils = loadCryptoUtils();
+  const serverPin = await utils.context.identityFingerprint(server.spki);
+  const pinned = loadCryptoUtils([serverPin]);
+
+  // The attacker relays the genuine init and adds its own signature over
+  // the same message
+  const initMsg = await signedInit(pinned, [server]);
+  const forged = await signedInit(pinned, [server, attacker]);
+  initMsg.signatures.push(forged.signatures[1]);
+
+  await assert.rejects(pinned.context.verifyServerIdentity(initMsg));
+  assert.deepEqual(pinned.storedPins(), [serverPin]);
+});
+
+test("keys that verify without a pinned key are not pinned", async () => {
+  const server = await newIdentity("a1");
+  const attacker = await newIdentity("ff");
+  const utils = loadCryptoUtils();
+  const serverPin = await utils.context.identityFingerprint(server.spki);
+  const pinned = loadCryptoUtils([serverPin]);
+
+  await assert.rejects(
+    pinned.context.verifyServerIdentity(await signedInit(pinned, [attacker])),
+  );
+  assert.deepEqual(pinned.storedPins(), [serverPin]);
+});